@@ -1,6 +1,6 @@
 #!/usr/bin/env bash
 
-for dir in web server oauth websocket expvar pprof examples/demo examples/twitter examples/facebook examples/wiki
+for dir in web server oauth websocket expvar pprof fcgi scgi cgi proxy examples/demo examples/cgi examples/restart examples/twitter examples/facebook examples/wiki
 do
     (cd $dir; pwd; make DEPS= $*)
 done
@@ -0,0 +1,86 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package cgi runs Twister applications as CGI programs. The CGI interface is
+// specified in RFC 3875.
+package cgi
+
+import (
+	"bufio"
+	"github.com/garyburd/twister/web"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Size of buffer for the response.
+const bufferSize = 4096
+
+// serve runs handler with the request in env and body and writes the
+// response to w.
+func serve(env map[string]string, body io.Reader, w io.Writer, handler web.Handler) os.Error {
+	bw, err := bufio.NewWriterSize(w, bufferSize)
+	if err != nil {
+		return err
+	}
+	r := web.NewCGIResponder(bw)
+
+	req, err := web.NewCGIRequest(env)
+	if err != nil {
+		log.Println("twister.cgi: bad request:", err)
+		r.Respond(web.StatusBadRequest, web.NewHeader(web.HeaderContentLength, "0"))
+		return bw.Flush()
+	}
+
+	if req.ContentLength >= 0 {
+		body = io.LimitReader(body, int64(req.ContentLength))
+	}
+	req.Body = body
+	req.Responder = r
+	r.InvokeHandler(req, handler)
+	return bw.Flush()
+}
+
+// Handle runs handler with the request in the CGI environment. The request
+// body is read from standard input and the response is written to standard
+// output. Handle returns an error if the response could not be written.
+//
+// The "Hello World" CGI program is:
+//
+//  package main
+//
+//  import (
+//      "github.com/garyburd/twister/cgi"
+//      "github.com/garyburd/twister/web"
+//      "io"
+//  )
+//
+//  func helloHandler(req *web.Request) {
+//      w := req.Respond(web.StatusOK, web.HeaderContentType, "text/plain")
+//      io.WriteString(w, "Hello, World!\n")
+//  }
+//
+//  func main() {
+//      cgi.Handle(web.HandlerFunc(helloHandler))
+//  }
+func Handle(handler web.Handler) os.Error {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return serve(env, os.Stdin, os.Stdout, handler)
+}
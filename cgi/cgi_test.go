@@ -0,0 +1,118 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cgi
+
+import (
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type silentLogger struct{ t *testing.T }
+
+func (l silentLogger) Write(p []byte) (int, os.Error) {
+	return len(p), nil
+}
+
+func echoHandler(req *web.Request) {
+	p, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		req.Error(web.StatusBadRequest, err)
+		return
+	}
+	s := req.Method + " " + req.URL.Host + " " + req.URL.Path + " " + req.URL.RawQuery + " " + string(p)
+	w := req.Respond(web.StatusOK,
+		web.HeaderContentType, "text/plain",
+		web.HeaderContentLength, strconv.Itoa(len(s)))
+	io.WriteString(w, s)
+}
+
+func hijackHandler(req *web.Request) {
+	status := web.StatusInternalServerError
+	if _, _, err := req.Responder.Hijack(); err != nil {
+		status = web.StatusNotImplemented
+	}
+	req.Respond(status, web.HeaderContentLength, "0")
+}
+
+var serveTests = []struct {
+	env     map[string]string
+	body    string
+	handler web.HandlerFunc
+	out     string
+}{
+	{
+		map[string]string{
+			"REQUEST_METHOD": "GET",
+			"SCRIPT_NAME":    "/hello.cgi",
+			"PATH_INFO":      "/a",
+			"QUERY_STRING":   "x=1",
+			"SERVER_NAME":    "example.com",
+			"SERVER_PORT":    "80",
+		},
+		"",
+		echoHandler,
+		"Status: 200 OK\r\nContent-Length: 33\r\nContent-Type: text/plain\r\n\r\nGET example.com /hello.cgi/a x=1 ",
+	},
+	{
+		map[string]string{
+			"REQUEST_METHOD": "POST",
+			"REQUEST_URI":    "/",
+			"HTTP_HOST":      "example.com",
+			"CONTENT_LENGTH": "5",
+		},
+		"HelloExtra",
+		echoHandler,
+		"Status: 200 OK\r\nContent-Length: 25\r\nContent-Type: text/plain\r\n\r\nPOST example.com /  Hello",
+	},
+	{
+		map[string]string{},
+		"",
+		echoHandler,
+		"Status: 400 Bad Request\r\nContent-Length: 0\r\n\r\n",
+	},
+	{
+		map[string]string{"REQUEST_METHOD": "GET", "REQUEST_URI": "/", "HTTP_HOST": "example.com"},
+		"",
+		func(req *web.Request) {},
+		"Status: 500 Internal Server Error\r\nContent-Length: 21\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nInternal Server Error",
+	},
+	{
+		map[string]string{"REQUEST_METHOD": "GET", "REQUEST_URI": "/", "HTTP_HOST": "example.com"},
+		"",
+		hijackHandler,
+		"Status: 501 Not Implemented\r\nContent-Length: 0\r\n\r\n",
+	},
+}
+
+func TestServe(t *testing.T) {
+	log.SetOutput(silentLogger{t})
+	defer log.SetOutput(os.Stdout)
+	for _, tt := range serveTests {
+		var out bytes.Buffer
+		if err := serve(tt.env, strings.NewReader(tt.body), &out, tt.handler); err != nil {
+			t.Errorf("%v, serve() = %v", tt.env, err)
+		}
+		if out.String() != tt.out {
+			t.Errorf("%v\ngot:  %q\nwant: %q", tt.env, out.String(), tt.out)
+		}
+	}
+}
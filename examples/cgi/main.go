@@ -0,0 +1,36 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This example runs a Twister handler as a CGI program. Build the program and
+// copy it to the web server's CGI directory, for example as
+// /usr/lib/cgi-bin/hello.cgi.
+package main
+
+import (
+	"github.com/garyburd/twister/cgi"
+	"github.com/garyburd/twister/web"
+	"io"
+	"log"
+)
+
+func serveHello(req *web.Request) {
+	w := req.Respond(web.StatusOK, web.HeaderContentType, "text/plain; charset=\"utf-8\"")
+	io.WriteString(w, "Hello World!")
+}
+
+func main() {
+	if err := cgi.Handle(web.HandlerFunc(serveHello)); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/garyburd/twister/web"
+	"io"
+	"time"
+)
+
+func eventsHandler(req *web.Request) {
+	io.WriteString(
+		req.Respond(web.StatusOK, web.HeaderContentType, "text/html"),
+		eventsStr)
+}
+
+func eventStreamHandler(req *web.Request) {
+	es := web.NewEventSource(req)
+	for {
+		if err := es.SendEvent("time", time.LocalTime().String()); err != nil {
+			return
+		}
+		time.Sleep(1e9)
+	}
+}
+
+const eventsStr = `
+<html>
+<head>
+<title>Server-Sent Events</title>
+<script type="text/javascript">
+window.onload = function() {
+    var es = new EventSource("/events/stream");
+    es.addEventListener("time", function(e) {
+        document.getElementById("time").innerHTML = e.data;
+    }, false);
+};
+</script>
+</head>
+<body>
+<h3>Server-Sent Events</h3>
+<hr>
+<div id="time"></div>
+</body>
+</html>`
@@ -30,6 +30,8 @@ func main() {
 				Register("/core/file", "GET", web.FileHandler("static/file.txt", nil)).
 				Register("/static/<path:.*>", "GET", web.DirectoryHandler("static/", nil)).
 				Register("/mp", "GET", mpGetHandler, "POST", mpPostHandler).
+				Register("/events", "GET", eventsHandler).
+				Register("/events/stream", "GET", eventStreamHandler).
 				Register("/debug/pprof/<command>", "*", web.HandlerFunc(pprof.ServeWeb)).
 				Register("/core/", "GET", coreHandler).
 				Register("/core/a/<a>/", "GET", coreHandler).
@@ -58,6 +60,7 @@ const homeStr = `
 <ul>
 <li><a href="/core">Core functionality</a>
 <li><a href="/mp">Multipart Form</a>
+<li><a href="/events">Server-Sent Events</a>
 </ul>
 </body>
 </html>`
@@ -0,0 +1,81 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// This example restarts the server without refusing connections. Send
+// SIGUSR2 to the process to start a new process with the listening socket
+// and shut down the old process.
+package main
+
+import (
+	"github.com/garyburd/twister/server"
+	"github.com/garyburd/twister/web"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+const listenerEnvVar = "TWISTER_RESTART_FD"
+
+func serveHello(req *web.Request) {
+	w := req.Respond(web.StatusOK, web.HeaderContentType, "text/plain; charset=\"utf-8\"")
+	io.WriteString(w, "Hello from process "+strconv.Itoa(os.Getpid())+"\n")
+}
+
+func main() {
+	l, err := server.InheritedListener(listenerEnvVar)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if l == nil {
+		l, err = net.Listen("tcp", ":8080")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	s := &server.Server{
+		Listener: l,
+		Handler:  web.NewRouter().Register("/", "GET", serveHello),
+		Logger:   server.LoggerFunc(server.ShortLogger),
+	}
+
+	done := make(chan bool)
+	go func() {
+		for sig := range signal.Incoming {
+			if sig.(signal.UnixSignal) != syscall.SIGUSR2 {
+				continue
+			}
+			p, err := s.StartProcess(listenerEnvVar, os.Args[0], os.Args)
+			if err != nil {
+				log.Println("restart failed:", err)
+				continue
+			}
+			log.Println("started process", p.Pid)
+			// Complete active requests before exiting.
+			s.Shutdown(30e9)
+			done <- true
+			return
+		}
+	}()
+
+	log.Println("serving in process", os.Getpid())
+	if err := s.Serve(); err != nil {
+		log.Fatal(err)
+	}
+	<-done
+}
@@ -0,0 +1,562 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package fcgi implements the responder role of the FastCGI protocol for
+// Twister applications. Use this package to run an application behind a web
+// server such as nginx or Apache that forwards requests with FastCGI.
+//
+// The protocol is specified at http://www.fastcgi.com/devkit/doc/fcgi-spec.html.
+package fcgi
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+)
+
+// Record types.
+const (
+	typeBeginRequest    = 1
+	typeAbortRequest    = 2
+	typeEndRequest      = 3
+	typeParams          = 4
+	typeStdin           = 5
+	typeStdout          = 6
+	typeStderr          = 7
+	typeData            = 8
+	typeGetValues       = 9
+	typeGetValuesResult = 10
+	typeUnknownType     = 11
+)
+
+const (
+	// Version of the protocol.
+	version = 1
+
+	// Role in the begin request record.
+	roleResponder = 1
+
+	// Flag in the begin request record. If not set, then the application
+	// closes the connection after responding to the request.
+	flagKeepConn = 1
+
+	// Protocol status in the end request record.
+	statusRequestComplete = 0
+	statusUnknownRole     = 3
+
+	// Maximum length of record content.
+	maxContentLength = 65535
+
+	// Size of buffer for the response body.
+	bufferSize = 8192
+
+	// Maximum size of the params stream for a request.
+	maxParamsSize = 1 << 16
+
+	// Maximum number of unread request body bytes buffered for a request.
+	maxBodyBuffer = 1 << 18
+)
+
+var (
+	errBadVersion = os.NewError("twister.fcgi: bad record version")
+	errBadRecord  = os.NewError("twister.fcgi: bad record")
+	errBadParams  = os.NewError("twister.fcgi: bad name-value pair")
+	errBigParams  = os.NewError("twister.fcgi: params too large")
+	errAborted    = os.NewError("twister.fcgi: request aborted")
+	errClosed     = os.NewError("twister.fcgi: connection closed")
+)
+
+// readRecord reads a record and returns the record type, request id and
+// content.
+func readRecord(r io.Reader) (typ byte, id uint16, content []byte, err os.Error) {
+	var h [8]byte
+	if _, err = io.ReadFull(r, h[:]); err != nil {
+		return
+	}
+	if h[0] != version {
+		err = errBadVersion
+		return
+	}
+	typ = h[1]
+	id = uint16(h[2])<<8 | uint16(h[3])
+	n := int(h[4])<<8 | int(h[5])
+	p := make([]byte, n+int(h[6]))
+	if _, err = io.ReadFull(r, p); err != nil {
+		if err == os.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	content = p[:n]
+	return
+}
+
+// appendRecord appends a record with the given type, request id and content
+// to b. The content is padded to a multiple of eight bytes.
+func appendRecord(b []byte, typ byte, id uint16, content []byte) []byte {
+	pad := -len(content) & 7
+	b = append(b, version, typ, byte(id>>8), byte(id), byte(len(content)>>8), byte(len(content)), byte(pad), 0)
+	b = append(b, content...)
+	for i := 0; i < pad; i++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// readSize reads a name or value length from a name-value pair.
+func readSize(p []byte) (int, []byte, os.Error) {
+	if len(p) == 0 {
+		return 0, nil, errBadParams
+	}
+	if p[0]&0x80 == 0 {
+		return int(p[0]), p[1:], nil
+	}
+	if len(p) < 4 {
+		return 0, nil, errBadParams
+	}
+	return int(p[0]&0x7f)<<24 | int(p[1])<<16 | int(p[2])<<8 | int(p[3]), p[4:], nil
+}
+
+// parseParams parses the name-value pairs in p.
+func parseParams(p []byte) (map[string]string, os.Error) {
+	env := make(map[string]string)
+	for len(p) > 0 {
+		var nameLen, valueLen int
+		var err os.Error
+		if nameLen, p, err = readSize(p); err != nil {
+			return nil, err
+		}
+		if valueLen, p, err = readSize(p); err != nil {
+			return nil, err
+		}
+		if nameLen > len(p) || valueLen > len(p)-nameLen {
+			return nil, errBadParams
+		}
+		env[string(p[:nameLen])] = string(p[nameLen : nameLen+valueLen])
+		p = p[nameLen+valueLen:]
+	}
+	return env, nil
+}
+
+// appendSize appends a name or value length to b.
+func appendSize(b []byte, n int) []byte {
+	if n < 0x80 {
+		return append(b, byte(n))
+	}
+	return append(b, byte(n>>24)|0x80, byte(n>>16), byte(n>>8), byte(n))
+}
+
+// appendParam appends a name-value pair to b.
+func appendParam(b []byte, name, value string) []byte {
+	b = appendSize(b, len(name))
+	b = appendSize(b, len(value))
+	b = append(b, name...)
+	return append(b, value...)
+}
+
+// conn represents a connection from the web server.
+type conn struct {
+	rwc     io.ReadWriteCloser
+	handler web.Handler
+
+	// Serializes writes to rwc.
+	writeMu sync.Mutex
+
+	// Protects the following fields.
+	mu       sync.Mutex
+	requests map[uint16]*request
+	readDone bool // true if reading from the connection stopped
+	closed   bool // true if the application closed the connection
+}
+
+func newConn(rwc io.ReadWriteCloser, handler web.Handler) *conn {
+	return &conn{rwc: rwc, handler: handler, requests: make(map[uint16]*request)}
+}
+
+// writeRecord writes a record to the connection.
+func (c *conn) writeRecord(typ byte, id uint16, content []byte) os.Error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.rwc.Write(appendRecord(nil, typ, id, content))
+	return err
+}
+
+// writeEndRequest writes an end request record with the given protocol
+// status.
+func (c *conn) writeEndRequest(id uint16, protocolStatus byte) os.Error {
+	return c.writeRecord(typeEndRequest, id, []byte{0, 0, 0, 0, protocolStatus, 0, 0, 0})
+}
+
+// close closes the connection.
+func (c *conn) close() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.rwc.Close()
+}
+
+// request returns the active request with the given id or nil if the
+// request is not active.
+func (c *conn) request(id uint16) *request {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.requests[id]
+}
+
+// serve reads records from the connection until the connection is closed.
+func (c *conn) serve() {
+	defer c.stopReading()
+	br := bufio.NewReader(c.rwc)
+	for {
+		typ, id, content, err := readRecord(br)
+		if err != nil {
+			c.mu.Lock()
+			closed := c.closed
+			c.mu.Unlock()
+			// The read fails after the application closes the connection
+			// at the end of a request.
+			if err != os.EOF && !closed {
+				log.Println("twister.fcgi: read failed:", err)
+			}
+			return
+		}
+		switch typ {
+		case typeBeginRequest:
+			if len(content) < 8 {
+				log.Println("twister.fcgi:", errBadRecord)
+				return
+			}
+			if role := int(content[0])<<8 | int(content[1]); role != roleResponder {
+				c.writeEndRequest(id, statusUnknownRole)
+				continue
+			}
+			r := newRequest(c, id, content[2]&flagKeepConn != 0)
+			c.mu.Lock()
+			c.requests[id] = r
+			c.mu.Unlock()
+		case typeParams:
+			r := c.request(id)
+			if r == nil || r.started {
+				continue
+			}
+			if len(content) > 0 {
+				if r.bigParams || len(r.params)+len(content) > maxParamsSize {
+					// Discard the params and respond with an error
+					// when the stream ends.
+					r.params = nil
+					r.bigParams = true
+				} else {
+					r.params = append(r.params, content...)
+				}
+				continue
+			}
+			// An empty params record ends the stream.
+			r.started = true
+			go r.serve()
+		case typeStdin:
+			// Stdin follows the params stream. The handler is running and
+			// reading the body when stdin arrives.
+			if r := c.request(id); r != nil && r.started {
+				r.body.write(content)
+			}
+		case typeAbortRequest:
+			r := c.request(id)
+			switch {
+			case r == nil:
+			case r.started:
+				r.abort(errAborted)
+			default:
+				// The handler was not started. End the request here.
+				c.mu.Lock()
+				c.requests[id] = nil, false
+				c.mu.Unlock()
+				c.writeEndRequest(id, statusRequestComplete)
+			}
+		case typeGetValues:
+			c.getValues(content)
+		default:
+			if id == 0 {
+				// Unknown management record.
+				c.writeRecord(typeUnknownType, 0, []byte{typ, 0, 0, 0, 0, 0, 0, 0})
+			}
+		}
+	}
+}
+
+// getValues responds to a get values management record.
+func (c *conn) getValues(content []byte) {
+	names, err := parseParams(content)
+	if err != nil {
+		log.Println("twister.fcgi:", err)
+		return
+	}
+	var b []byte
+	if _, found := names["FCGI_MPXS_CONNS"]; found {
+		b = appendParam(b, "FCGI_MPXS_CONNS", "1")
+	}
+	c.writeRecord(typeGetValuesResult, 0, b)
+}
+
+// stopReading aborts the active requests after the connection cannot be
+// read. The connection is closed when the active requests complete.
+func (c *conn) stopReading() {
+	c.mu.Lock()
+	c.readDone = true
+	requests := make([]*request, 0, len(c.requests))
+	for id, r := range c.requests {
+		if r.started {
+			requests = append(requests, r)
+		} else {
+			c.requests[id] = nil, false
+		}
+	}
+	c.mu.Unlock()
+	for _, r := range requests {
+		r.abort(errClosed)
+	}
+	if len(requests) == 0 {
+		c.close()
+	}
+}
+
+// body is the request body. The connection adds data to the body as stdin
+// records are read. The connection stops reading records while the body has
+// maxBodyBuffer unread bytes, so a handler that does not read the body delays
+// other requests on the connection until the handler returns.
+type body struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	err  os.Error // os.EOF after the end of stdin or the reason for abort
+}
+
+func newBody() *body {
+	b := &body{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// write adds data from a stdin record to the body. An empty record ends the
+// body. Write blocks while the buffer is full.
+func (b *body) write(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buf.Len() >= maxBodyBuffer && b.err == nil {
+		b.cond.Wait()
+	}
+	if b.err == nil {
+		if len(p) == 0 {
+			b.err = os.EOF
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	b.cond.Broadcast()
+}
+
+// close ends the body with the error err.
+func (b *body) close(err os.Error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+}
+
+func (b *body) Read(p []byte) (int, os.Error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buf.Len() == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if b.buf.Len() > 0 {
+		// Wake the connection if it is waiting for space in the buffer.
+		b.cond.Broadcast()
+		return b.buf.Read(p)
+	}
+	return 0, b.err
+}
+
+// request is a request on a connection and the request's responder. The
+// embedded CGIResponder writes the response to w.
+type request struct {
+	*web.CGIResponder
+
+	c         *conn
+	id        uint16
+	keepConn  bool
+	params    []byte
+	bigParams bool // true if the params stream exceeded maxParamsSize
+	started   bool
+	body      *body
+	w         *bufio.Writer
+
+	// Closed when the request is aborted. Protected by c.mu.
+	done    chan bool
+	aborted bool
+}
+
+// The request is the web request's responder.
+var (
+	_ web.Responder         = (*request)(nil)
+	_ web.DoneNotifier      = (*request)(nil)
+	_ web.RespondedReporter = (*request)(nil)
+)
+
+func newRequest(c *conn, id uint16, keepConn bool) *request {
+	r := &request{c: c, id: id, keepConn: keepConn, body: newBody(), done: make(chan bool)}
+	r.w, _ = bufio.NewWriterSize(streamWriter{c, typeStdout, id}, bufferSize)
+	r.CGIResponder = web.NewCGIResponder(r.w)
+	return r
+}
+
+// abort ends the request body with the error err and closes the done
+// channel.
+func (r *request) abort(err os.Error) {
+	r.c.mu.Lock()
+	if !r.aborted {
+		r.aborted = true
+		close(r.done)
+	}
+	r.c.mu.Unlock()
+	r.body.close(err)
+}
+
+// streamWriter writes data as stream records.
+type streamWriter struct {
+	c   *conn
+	typ byte
+	id  uint16
+}
+
+func (w streamWriter) Write(p []byte) (int, os.Error) {
+	n := 0
+	for len(p) > 0 {
+		m := len(p)
+		if m > maxContentLength {
+			m = maxContentLength
+		}
+		if err := w.c.writeRecord(w.typ, w.id, p[:m]); err != nil {
+			return n, err
+		}
+		n += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+func (r *request) Done() <-chan bool {
+	return r.done
+}
+
+// serve runs the handler and completes the request.
+func (r *request) serve() {
+	var env map[string]string
+	err := errBigParams
+	if !r.bigParams {
+		env, err = parseParams(r.params)
+	}
+	r.params = nil
+	var req *web.Request
+	if err == nil {
+		req, err = web.NewCGIRequest(env)
+	}
+	if err != nil {
+		log.Println("twister.fcgi: bad request:", err)
+		status := web.StatusBadRequest
+		if err == errBigParams {
+			status = web.StatusRequestHeaderFieldsTooLarge
+		}
+		r.Respond(status, web.NewHeader(web.HeaderContentLength, "0"))
+	} else {
+		req.Body = r.body
+		req.Responder = r
+		r.InvokeHandler(req, r.c.handler)
+	}
+	r.finish()
+}
+
+// finish ends the stdout stream, writes the end request record and closes
+// the connection if the web server did not ask to keep the connection open.
+func (r *request) finish() {
+	// Discard stdin received after the handler returns.
+	r.body.close(web.ErrInvalidState)
+
+	err := r.w.Flush()
+	if err == nil {
+		err = r.c.writeRecord(typeStdout, r.id, nil)
+	}
+	if err == nil {
+		err = r.c.writeEndRequest(r.id, statusRequestComplete)
+	}
+
+	c := r.c
+	c.mu.Lock()
+	c.requests[r.id] = nil, false
+	closeConn := !r.keepConn || (c.readDone && len(c.requests) == 0)
+	aborted := r.aborted
+	c.mu.Unlock()
+	if err != nil && !aborted {
+		log.Println("twister.fcgi: write failed:", err)
+	}
+	if closeConn {
+		c.close()
+	}
+}
+
+// Serve accepts incoming FastCGI connections on the listener l, creating a
+// new goroutine for each. The goroutines read requests and then call handler
+// to respond to the requests. If l is nil, then Serve accepts connections on
+// the listening socket passed as standard input by the web server.
+//
+// Here's an example of how to use this package with nginx:
+//
+//  location / {
+//      include fastcgi_params;
+//      fastcgi_param PATH_INFO $fastcgi_script_name;
+//      fastcgi_keep_conn on;
+//      fastcgi_pass 127.0.0.1:9000;
+//  }
+//
+// In the main function for the application:
+//
+//  l, err := net.Listen("tcp", "127.0.0.1:9000")
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  log.Fatal(fcgi.Serve(l, handler))
+func Serve(l net.Listener, handler web.Handler) os.Error {
+	if l == nil {
+		var err os.Error
+		l, err = net.FileListener(os.Stdin)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+	}
+	for {
+		rwc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go newConn(rwc, handler).serve()
+	}
+	return nil
+}
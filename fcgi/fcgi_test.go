@@ -0,0 +1,314 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package fcgi
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type silentLogger struct{ t *testing.T }
+
+func (l silentLogger) Write(p []byte) (int, os.Error) {
+	return len(p), nil
+}
+
+func params(keysAndValues ...string) []byte {
+	var b []byte
+	for i := 0; i < len(keysAndValues); i += 2 {
+		b = appendParam(b, keysAndValues[i], keysAndValues[i+1])
+	}
+	return b
+}
+
+func beginRequest(id uint16, role byte, keepConn bool) []byte {
+	var flags byte
+	if keepConn {
+		flags = flagKeepConn
+	}
+	return appendRecord(nil, typeBeginRequest, id, []byte{0, role, flags, 0, 0, 0, 0, 0})
+}
+
+func records(rs ...[]byte) []byte {
+	var b []byte
+	for _, r := range rs {
+		b = append(b, r...)
+	}
+	return b
+}
+
+type testResponse struct {
+	stdout         bytes.Buffer
+	protocolStatus int
+}
+
+// serveTest serves the records in the input on a connection and returns the
+// responses by request id after n requests end.
+func serveTest(t *testing.T, handler web.Handler, in []byte, n int) map[uint16]*testResponse {
+	client, server := net.Pipe()
+	defer client.Close()
+	go newConn(server, handler).serve()
+	go client.Write(in)
+	responses := make(map[uint16]*testResponse)
+	br := bufio.NewReader(client)
+	for n > 0 {
+		typ, id, content, err := readRecord(br)
+		if err != nil {
+			t.Fatalf("readRecord() = %v", err)
+		}
+		r := responses[id]
+		if r == nil {
+			r = &testResponse{}
+			responses[id] = r
+		}
+		switch typ {
+		case typeStdout:
+			r.stdout.Write(content)
+		case typeEndRequest:
+			r.protocolStatus = int(content[4])
+			n -= 1
+		}
+	}
+	return responses
+}
+
+func echoHandler(req *web.Request) {
+	p, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		req.Error(web.StatusBadRequest, err)
+		return
+	}
+	s := req.Method + " " + req.URL.Host + " " + req.URL.Path + " " + req.URL.RawQuery + " " + string(p)
+	w := req.Respond(web.StatusOK,
+		web.HeaderContentType, "text/plain",
+		web.HeaderContentLength, strconv.Itoa(len(s)))
+	io.WriteString(w, s)
+}
+
+func echoResponse(s string) string {
+	return "Status: 200 OK\r\nContent-Length: " + strconv.Itoa(len(s)) + "\r\nContent-Type: text/plain\r\n\r\n" + s
+}
+
+var requestParams = params(
+	"REQUEST_METHOD", "POST",
+	"SERVER_PROTOCOL", "HTTP/1.1",
+	"SCRIPT_NAME", "/app",
+	"PATH_INFO", "/echo",
+	"QUERY_STRING", "x=1",
+	"HTTP_HOST", "example.com",
+	"CONTENT_LENGTH", "5")
+
+func TestServe(t *testing.T) {
+	in := records(
+		beginRequest(1, roleResponder, false),
+		appendRecord(nil, typeParams, 1, requestParams[:10]),
+		appendRecord(nil, typeParams, 1, requestParams[10:]),
+		appendRecord(nil, typeParams, 1, nil),
+		appendRecord(nil, typeStdin, 1, []byte("Hel")),
+		appendRecord(nil, typeStdin, 1, []byte("lo")),
+		appendRecord(nil, typeStdin, 1, nil))
+	responses := serveTest(t, web.HandlerFunc(echoHandler), in, 1)
+	r := responses[1]
+	if r == nil {
+		t.Fatal("no response")
+	}
+	if want := echoResponse("POST example.com /app/echo x=1 Hello"); r.stdout.String() != want {
+		t.Errorf("got:  %q\nwant: %q", r.stdout.String(), want)
+	}
+	if r.protocolStatus != statusRequestComplete {
+		t.Errorf("protocolStatus = %d, want %d", r.protocolStatus, statusRequestComplete)
+	}
+}
+
+func TestMultiplexed(t *testing.T) {
+	in := records(
+		beginRequest(1, roleResponder, true),
+		beginRequest(2, roleResponder, true),
+		appendRecord(nil, typeParams, 2, requestParams),
+		appendRecord(nil, typeParams, 1, requestParams),
+		appendRecord(nil, typeParams, 1, nil),
+		appendRecord(nil, typeStdin, 1, []byte("one")),
+		appendRecord(nil, typeParams, 2, nil),
+		appendRecord(nil, typeStdin, 2, []byte("two")),
+		appendRecord(nil, typeStdin, 2, nil),
+		appendRecord(nil, typeStdin, 1, nil))
+	responses := serveTest(t, web.HandlerFunc(echoHandler), in, 2)
+	for id, body := range map[uint16]string{1: "one", 2: "two"} {
+		r := responses[id]
+		if r == nil {
+			t.Errorf("%d: no response", id)
+			continue
+		}
+		if want := echoResponse("POST example.com /app/echo x=1 " + body); r.stdout.String() != want {
+			t.Errorf("%d\ngot:  %q\nwant: %q", id, r.stdout.String(), want)
+		}
+	}
+}
+
+func TestUnknownRole(t *testing.T) {
+	in := beginRequest(1, 2, false)
+	responses := serveTest(t, web.HandlerFunc(echoHandler), in, 1)
+	if r := responses[1]; r.protocolStatus != statusUnknownRole || r.stdout.Len() != 0 {
+		t.Errorf("protocolStatus = %d, stdout = %q, want %d, \"\"", r.protocolStatus, r.stdout.String(), statusUnknownRole)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	in := records(
+		beginRequest(1, roleResponder, false),
+		appendRecord(nil, typeParams, 1, params("REQUEST_METHOD", "GET", "REQUEST_URI", "/", "HTTP_HOST", "example.com")),
+		appendRecord(nil, typeParams, 1, nil),
+		appendRecord(nil, typeAbortRequest, 1, nil))
+	responses := serveTest(t, web.HandlerFunc(func(req *web.Request) {
+		status := web.StatusOK
+		select {
+		case <-req.Done():
+			status = web.StatusNoContent
+		case <-time.After(5e9):
+		}
+		req.Respond(status)
+	}), in, 1)
+	if out, want := responses[1].stdout.String(), "Status: 204 No Content\r\n\r\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestNoRespond(t *testing.T) {
+	log.SetOutput(silentLogger{t})
+	defer log.SetOutput(os.Stdout)
+	in := records(
+		beginRequest(1, roleResponder, false),
+		appendRecord(nil, typeParams, 1, params("REQUEST_METHOD", "GET", "REQUEST_URI", "/", "HTTP_HOST", "example.com")),
+		appendRecord(nil, typeParams, 1, nil))
+	responses := serveTest(t, web.HandlerFunc(func(req *web.Request) {}), in, 1)
+	if out := responses[1].stdout.String(); !strings.HasPrefix(out, "Status: 500 Internal Server Error\r\n") {
+		t.Errorf("got %q, want status 500", out)
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go newConn(server, web.HandlerFunc(echoHandler)).serve()
+	go client.Write(appendRecord(nil, typeGetValues, 0, params("FCGI_MPXS_CONNS", "", "FCGI_MAX_CONNS", "")))
+	typ, _, content, err := readRecord(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != typeGetValuesResult || string(content) != string(params("FCGI_MPXS_CONNS", "1")) {
+		t.Errorf("got type %d, content %q", typ, content)
+	}
+}
+
+func TestParams(t *testing.T) {
+	long := strings.Repeat("x", 200)
+	env := map[string]string{"A": "", "B": "b", long: long}
+	p := params("A", "", "B", "b", long, long)
+	got, err := parseParams(p)
+	if err != nil || !reflect.DeepEqual(got, env) {
+		t.Errorf("parseParams() = %v, %v, want %v", got, err, env)
+	}
+	for i := 1; i < len(p); i++ {
+		if _, err := parseParams(p[:i]); err == nil && i != 3 && i != 7 {
+			t.Errorf("parseParams(p[:%d]), expected error", i)
+		}
+	}
+}
+
+func TestParamsTooLarge(t *testing.T) {
+	log.SetOutput(silentLogger{t})
+	defer log.SetOutput(os.Stdout)
+	long := strings.Repeat("x", maxParamsSize/2)
+	in := records(
+		beginRequest(1, roleResponder, false),
+		appendRecord(nil, typeParams, 1, params("REQUEST_METHOD", "GET", "HTTP_A", long)),
+		appendRecord(nil, typeParams, 1, params("HTTP_B", long)),
+		appendRecord(nil, typeParams, 1, nil))
+	responses := serveTest(t, web.HandlerFunc(echoHandler), in, 1)
+	if out, want := responses[1].stdout.String(), "Status: 431 Request Header Fields Too Large\r\nContent-Length: 0\r\n\r\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestBodyBuffer(t *testing.T) {
+	b := newBody()
+	written := make(chan bool)
+	go func() {
+		b.write(make([]byte, maxBodyBuffer))
+		b.write([]byte("x"))
+		written <- true
+	}()
+	select {
+	case <-written:
+		t.Fatal("write did not block on full buffer")
+	case <-time.After(1e8):
+	}
+	p := make([]byte, 1024)
+	if n, err := b.Read(p); n != len(p) || err != nil {
+		t.Fatalf("Read() = %d, %v, want %d, nil", n, err, len(p))
+	}
+	select {
+	case <-written:
+	case <-time.After(5e9):
+		t.Fatal("write blocked after read")
+	}
+}
+
+// closedConn returns an error other than os.EOF from Read after the
+// connection is closed.
+type closedConn struct{ net.Conn }
+
+func (c closedConn) Read(p []byte) (int, os.Error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		err = os.EINVAL
+	}
+	return n, err
+}
+
+func TestCloseNoLog(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stdout)
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan bool)
+	go func() {
+		newConn(closedConn{server}, web.HandlerFunc(echoHandler)).serve()
+		done <- true
+	}()
+	go client.Write(records(
+		beginRequest(1, roleResponder, false),
+		appendRecord(nil, typeParams, 1, requestParams),
+		appendRecord(nil, typeParams, 1, nil),
+		appendRecord(nil, typeStdin, 1, []byte("hello")),
+		appendRecord(nil, typeStdin, 1, nil)))
+	io.Copy(ioutil.Discard, client)
+	<-done
+	if buf.Len() != 0 {
+		t.Errorf("log = %q, want none", buf.String())
+	}
+}
@@ -26,9 +26,18 @@ import (
 	"io"
 )
 
-type responder struct{ w http.ResponseWriter }
+type responder struct {
+	w             http.ResponseWriter
+	respondCalled bool
+}
+
+var (
+	_ web.Responder         = (*responder)(nil)
+	_ web.RespondedReporter = (*responder)(nil)
+)
 
-func (r responder) Respond(status int, header web.Header) io.Writer {
+func (r *responder) Respond(status int, header web.Header) io.Writer {
+	r.respondCalled = true
 	for k, v := range header {
 		r.w.Header()[k] = v
 	}
@@ -36,10 +45,14 @@ func (r responder) Respond(status int, header web.Header) io.Writer {
 	return r.w
 }
 
-func (r responder) Hijack() (conn net.Conn, br *bufio.Reader, err os.Error) {
+func (r *responder) Hijack() (conn net.Conn, br *bufio.Reader, err os.Error) {
 	return nil, nil, os.NewError("not implemented")
 }
 
+func (r *responder) Responded() bool {
+	return r.respondCalled
+}
+
 func webRequestFromHTTPRequest(w http.ResponseWriter, r *http.Request) *web.Request {
 	header := web.Header(map[string][]string(r.Header))
 	foo := header.Get("Cookie")
@@ -59,7 +72,7 @@ func webRequestFromHTTPRequest(w http.ResponseWriter, r *http.Request) *web.Requ
 		header)
 
 	req.Body = r.Body
-	req.Responder = responder{w}
+	req.Responder = &responder{w: w}
 	req.ContentLength = int(r.ContentLength)
 	if r.Form != nil {
 		req.Param = web.Values(map[string][]string(r.Form))
@@ -80,6 +93,7 @@ func (h wrappedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	req := webRequestFromHTTPRequest(w, r)
 	req.Env["twister.gae.context"] = appengine.NewContext(r)
 	req.Env["twister.gae.request"] = r
+	defer req.Finish()
 	h.h.ServeWeb(req)
 }
 
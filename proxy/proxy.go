@@ -0,0 +1,465 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package proxy implements a reverse proxy handler for Twister applications.
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"github.com/garyburd/twister/web"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"url"
+)
+
+const (
+	// Size of buffers for the backend connection.
+	bufferSize = 4096
+
+	// Maximum size of a chunk size line in a backend response.
+	maxChunkLineSize = 4096
+)
+
+var (
+	errBadStatusLine    = os.NewError("twister.proxy: bad status line in backend response")
+	errBadContentLength = os.NewError("twister.proxy: bad content length in backend response")
+	errBadChunkedFormat = os.NewError("twister.proxy: bad chunked format in backend response")
+)
+
+// hopHeaders are the headers that apply to a single connection. The proxy
+// removes these headers and the headers named in the Connection header from
+// requests and responses.
+var hopHeaders = []string{
+	web.HeaderConnection,
+	web.HeaderName("Keep-Alive"),
+	web.HeaderProxyAuthenticate,
+	web.HeaderProxyAuthorization,
+	web.HeaderTE,
+	web.HeaderTrailer,
+	web.HeaderTransferEncoding,
+	web.HeaderUpgrade,
+}
+
+// removeHopHeaders removes the hop-by-hop headers from header.
+func removeHopHeaders(header web.Header) {
+	for _, name := range header.GetList(web.HeaderConnection) {
+		header[web.HeaderName(name)] = nil, false
+	}
+	for _, name := range hopHeaders {
+		header[name] = nil, false
+	}
+}
+
+// Proxy is a handler that forwards requests to a single backend server and
+// copies the backend's responses to the client.
+type Proxy struct {
+	// Target is the URL of the backend server. The scheme is "http" or
+	// "https". The request path is appended to the path of the target URL.
+	Target *url.URL
+
+	// MaxIdleConns is the maximum number of idle connections to the backend
+	// kept for reuse. If zero, then a new connection is used for every
+	// request.
+	MaxIdleConns int
+
+	mu   sync.Mutex // protects idle
+	idle []*backendConn
+}
+
+// NewSingleHostProxy returns a handler that forwards requests to the server
+// at target. The request path is appended to the path of target:
+//
+//  target, _ := url.Parse("http://127.0.0.1:8080/app")
+//  h := proxy.NewSingleHostProxy(target)
+//
+// forwards a request for /hello?x=1 to http://127.0.0.1:8080/app/hello?x=1.
+// Use a Proxy directly to enable reuse of connections to the backend.
+func NewSingleHostProxy(target *url.URL) web.Handler {
+	return &Proxy{Target: target}
+}
+
+// backendConn is a connection to the backend server.
+type backendConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	bw   *bufio.Writer
+}
+
+// dial opens a new connection to the backend server.
+func (p *Proxy) dial() (*backendConn, os.Error) {
+	addr := p.Target.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if p.Target.Scheme == "https" {
+			addr += ":443"
+		} else {
+			addr += ":80"
+		}
+	}
+	var conn net.Conn
+	var err os.Error
+	if p.Target.Scheme == "https" {
+		conn, err = tls.Dial("tcp", addr, nil)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	br, _ := bufio.NewReaderSize(conn, bufferSize)
+	bw, _ := bufio.NewWriterSize(conn, bufferSize)
+	return &backendConn{conn: conn, br: br, bw: bw}, nil
+}
+
+// getConn returns an idle connection from the pool or nil if the pool is
+// empty.
+func (p *Proxy) getConn() *backendConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) == 0 {
+		return nil
+	}
+	bc := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return bc
+}
+
+// putConn returns a connection to the pool or closes the connection if the
+// pool is full.
+func (p *Proxy) putConn(bc *backendConn) {
+	p.mu.Lock()
+	if len(p.idle) < p.MaxIdleConns {
+		p.idle = append(p.idle, bc)
+		bc = nil
+	}
+	p.mu.Unlock()
+	if bc != nil {
+		bc.conn.Close()
+	}
+}
+
+// requestURI returns the request URI to send to the backend.
+func (p *Proxy) requestURI(req *web.Request) string {
+	uri := req.URL.RawPath
+	if uri == "" {
+		uri = req.URL.Path
+		if req.URL.RawQuery != "" {
+			uri += "?" + req.URL.RawQuery
+		}
+	}
+	if path := strings.TrimRight(p.Target.Path, "/"); path != "" {
+		uri = path + uri
+	}
+	return uri
+}
+
+// requestHeader returns the header to send to the backend.
+func (p *Proxy) requestHeader(req *web.Request) web.Header {
+	header := make(web.Header)
+	for name, values := range req.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	removeHopHeaders(header)
+	header.Set(web.HeaderHost, p.Target.Host)
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if forwardedFor := header[web.HeaderXForwardedFor]; len(forwardedFor) > 0 {
+		// Append to all of the addresses from the previous proxies.
+		host = strings.Join(forwardedFor, ", ") + ", " + host
+	}
+	header.Set(web.HeaderXForwardedFor, host)
+
+	if p.MaxIdleConns <= 0 {
+		header.Set(web.HeaderConnection, "close")
+	}
+	return header
+}
+
+// writeRequest writes the request line, header and body to the backend.
+func writeRequest(bc *backendConn, req *web.Request, uri string, header web.Header) os.Error {
+	chunked := false
+	switch {
+	case req.ContentLength >= 0:
+		header.Set(web.HeaderContentLength, strconv.Itoa(req.ContentLength))
+	case req.Method != "GET" && req.Method != "HEAD":
+		header.Set(web.HeaderTransferEncoding, "chunked")
+		chunked = true
+	}
+
+	bc.bw.WriteString(req.Method + " " + uri + " HTTP/1.1\r\n")
+	if err := header.WriteHttpHeader(bc.bw); err != nil {
+		return err
+	}
+
+	switch {
+	case req.ContentLength > 0:
+		if _, err := io.Copy(bc.bw, io.LimitReader(req.Body, int64(req.ContentLength))); err != nil {
+			return err
+		}
+	case chunked:
+		if _, err := io.Copy(chunkedWriter{bc.bw}, req.Body); err != nil {
+			return err
+		}
+		bc.bw.WriteString("0\r\n\r\n")
+	}
+	return bc.bw.Flush()
+}
+
+// readResponse reads the status line and header of the backend response.
+// Informational responses are skipped.
+func readResponse(bc *backendConn) (protocolVersion int, status int, header web.Header, err os.Error) {
+	for {
+		line, isPrefix, err := bc.br.ReadLine()
+		if err != nil {
+			if err == os.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, 0, nil, err
+		}
+		if isPrefix {
+			return 0, 0, nil, errBadStatusLine
+		}
+		protocolVersion, status, err = parseStatusLine(string(line))
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		header = make(web.Header)
+		if err := (&web.HeaderParser{}).ParseHttpHeader(bc.br, header); err != nil {
+			return 0, 0, nil, err
+		}
+		if status >= 200 {
+			return protocolVersion, status, header, nil
+		}
+	}
+	return
+}
+
+// parseStatusLine parses a status line of the form "HTTP/1.1 200 OK".
+func parseStatusLine(line string) (protocolVersion int, status int, err os.Error) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") || len(fields[1]) != 3 {
+		return 0, 0, errBadStatusLine
+	}
+	version := strings.SplitN(fields[0][len("HTTP/"):], ".", 2)
+	if len(version) != 2 {
+		return 0, 0, errBadStatusLine
+	}
+	major, err := strconv.Atoi(version[0])
+	if err != nil {
+		return 0, 0, errBadStatusLine
+	}
+	minor, err := strconv.Atoi(version[1])
+	if err != nil {
+		return 0, 0, errBadStatusLine
+	}
+	status, err = strconv.Atoi(fields[1])
+	if err != nil || status < 100 {
+		return 0, 0, errBadStatusLine
+	}
+	return major*1000 + minor, status, nil
+}
+
+// canRetry returns true if the request can be sent again after a failure.
+// The request must be idempotent and must not have a body.
+func canRetry(req *web.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return req.ContentLength == 0 ||
+			(req.ContentLength < 0 && req.Header.Get(web.HeaderTransferEncoding) == "")
+	}
+	return false
+}
+
+// roundTrip sends the request to the backend and reads the response header.
+// If a pooled connection fails before the response is read and the request
+// can be retried, then the request is retried on a new connection.
+func (p *Proxy) roundTrip(req *web.Request, uri string, header web.Header) (bc *backendConn, protocolVersion int, status int, responseHeader web.Header, err os.Error) {
+	retry := canRetry(req)
+	bc = p.getConn()
+	if bc == nil {
+		retry = false
+		if bc, err = p.dial(); err != nil {
+			return nil, 0, 0, nil, err
+		}
+	}
+	for {
+		err = writeRequest(bc, req, uri, header)
+		if err == nil {
+			protocolVersion, status, responseHeader, err = readResponse(bc)
+			if err == nil {
+				return bc, protocolVersion, status, responseHeader, nil
+			}
+		}
+		bc.conn.Close()
+		if !retry {
+			return nil, 0, 0, nil, err
+		}
+		retry = false
+		if bc, err = p.dial(); err != nil {
+			return nil, 0, 0, nil, err
+		}
+	}
+	return
+}
+
+// ServeWeb forwards the request to the backend and copies the response to
+// the client. The proxy responds with status 502 if the backend cannot be
+// reached or returns a malformed response.
+func (p *Proxy) ServeWeb(req *web.Request) {
+	uri := p.requestURI(req)
+	bc, protocolVersion, status, header, err := p.roundTrip(req, uri, p.requestHeader(req))
+	if err != nil {
+		req.Error(web.StatusBadGateway, err)
+		return
+	}
+
+	reuse := p.MaxIdleConns > 0 &&
+		protocolVersion >= web.ProtocolVersion(1, 1) &&
+		!header.HasToken(web.HeaderConnection, "close")
+
+	var body io.Reader
+	switch {
+	case req.Method == "HEAD" || status == web.StatusNoContent || status == web.StatusNotModified:
+		// No body.
+	case header.HasToken(web.HeaderTransferEncoding, "chunked"):
+		body = &chunkedReader{br: bc.br}
+		header[web.HeaderContentLength] = nil, false
+	case header.Get(web.HeaderContentLength) != "":
+		n, err := strconv.Atoi64(header.Get(web.HeaderContentLength))
+		if err != nil || n < 0 {
+			bc.conn.Close()
+			req.Error(web.StatusBadGateway, errBadContentLength)
+			return
+		}
+		body = io.LimitReader(bc.br, n)
+	default:
+		body = bc.br
+		reuse = false
+	}
+	removeHopHeaders(header)
+
+	w := req.Responder.Respond(status, header)
+	if body != nil {
+		if _, err := io.Copy(w, body); err != nil {
+			log.Println("twister.proxy: error copying response body:", err)
+			reuse = false
+		}
+	}
+	if reuse {
+		p.putConn(bc)
+	} else {
+		bc.conn.Close()
+	}
+}
+
+// chunkedWriter writes data to the backend using chunked encoding.
+type chunkedWriter struct {
+	bw *bufio.Writer
+}
+
+func (w chunkedWriter) Write(p []byte) (int, os.Error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	fmt.Fprintf(w.bw, "%x\r\n", len(p))
+	w.bw.Write(p)
+	if _, err := w.bw.WriteString("\r\n"); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// chunkedReader decodes a chunked response body from the backend. Trailers
+// are read and discarded.
+type chunkedReader struct {
+	br      *bufio.Reader
+	avail   int
+	started bool
+	err     os.Error
+}
+
+func (r *chunkedReader) Read(p []byte) (int, os.Error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.avail == 0 {
+		if r.avail, r.err = r.readChunkFraming(); r.err != nil {
+			return 0, r.err
+		}
+	}
+	if len(p) > r.avail {
+		p = p[:r.avail]
+	}
+	n, err := r.br.Read(p)
+	if err == os.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	r.avail -= n
+	r.err = err
+	return n, nil
+}
+
+// readChunkFraming reads the framing before a chunk and returns the size of
+// the chunk. The function returns os.EOF after the last chunk and trailer.
+func (r *chunkedReader) readChunkFraming() (int, os.Error) {
+	if r.started {
+		// CRLF following data in previous chunk.
+		var p [2]byte
+		if _, err := io.ReadFull(r.br, p[:]); err != nil {
+			if err == os.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if p[0] != '\r' || p[1] != '\n' {
+			return 0, errBadChunkedFormat
+		}
+	}
+	r.started = true
+
+	line, isPrefix, err := r.br.ReadLine()
+	switch {
+	case err == os.EOF:
+		return 0, io.ErrUnexpectedEOF
+	case err != nil:
+		return 0, err
+	case isPrefix || len(line) > maxChunkLineSize:
+		return 0, errBadChunkedFormat
+	}
+
+	s := string(line)
+	if i := strings.Index(s, ";"); i >= 0 {
+		s = s[:i]
+	}
+	n, err := strconv.Btoui64(strings.TrimSpace(s), 16)
+	if err != nil || n > 1<<31-1 {
+		return 0, errBadChunkedFormat
+	}
+	if n == 0 {
+		if err := (&web.HeaderParser{}).ParseHttpHeader(r.br, make(web.Header)); err != nil {
+			return 0, err
+		}
+		return 0, os.EOF
+	}
+	return int(n), nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"github.com/garyburd/twister/server"
+	"github.com/garyburd/twister/web"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"url"
+)
+
+func echoHandler(req *web.Request) {
+	p, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		req.Error(web.StatusBadRequest, err)
+		return
+	}
+	w := req.Respond(web.StatusOK, web.HeaderContentType, "text/plain")
+	io.WriteString(w, req.Method+" "+req.URL.Host+" "+req.URL.RawPath+"\n")
+	for _, name := range []string{web.HeaderXForwardedFor, "X-Foo", "X-Bar", web.HeaderName("Keep-Alive")} {
+		if v := req.Header.Get(name); v != "" {
+			io.WriteString(w, name+": "+v+"\n")
+		}
+	}
+	w.Write(p)
+}
+
+func mustParseURL(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+var proxyTests = []struct {
+	method string
+	path   string
+	header web.Header
+	body   string
+	out    string
+}{
+	{"GET", "/", nil, "", "GET HOST /app/\nX-Forwarded-For: 1.2.3.4\n"},
+	{"GET", "/a/b?x=1", nil, "", "GET HOST /app/a/b?x=1\nX-Forwarded-For: 1.2.3.4\n"},
+	{"POST", "/form", web.NewHeader(web.HeaderContentLength, "5"), "Hello", "POST HOST /app/form\nX-Forwarded-For: 1.2.3.4\nHello"},
+	{"GET", "/", web.NewHeader(web.HeaderXForwardedFor, "5.6.7.8"), "", "GET HOST /app/\nX-Forwarded-For: 5.6.7.8, 1.2.3.4\n"},
+	{"GET", "/", web.NewHeader(web.HeaderXForwardedFor, "5.6.7.8", web.HeaderXForwardedFor, "9.9.9.9, 10.0.0.1"), "", "GET HOST /app/\nX-Forwarded-For: 5.6.7.8, 9.9.9.9, 10.0.0.1, 1.2.3.4\n"},
+	{"GET", "/", web.NewHeader(
+		web.HeaderConnection, "X-Foo",
+		"X-Foo", "foo",
+		"X-Bar", "bar",
+		web.HeaderName("Keep-Alive"), "300"), "", "GET HOST /app/\nX-Forwarded-For: 1.2.3.4\nX-Bar: bar\n"},
+}
+
+func TestProxy(t *testing.T) {
+	ts := server.NewTestServer(web.HandlerFunc(echoHandler))
+	defer ts.Close()
+	h := NewSingleHostProxy(mustParseURL(ts.URL + "/app/"))
+	for _, tt := range proxyTests {
+		status, _, body := web.RunHandler("http://example.com"+tt.path, tt.method, tt.header, []byte(tt.body), h)
+		out := strings.Replace(tt.out, "HOST", ts.Addr(), 1)
+		if status != web.StatusOK || string(body) != out {
+			t.Errorf("%s %s: got %d, %q, want %d, %q", tt.method, tt.path, status, body, web.StatusOK, out)
+		}
+	}
+}
+
+func TestChunkedResponse(t *testing.T) {
+	ts := server.NewTestServer(web.HandlerFunc(func(req *web.Request) {
+		w := req.Respond(web.StatusOK, web.HeaderContentType, "text/plain")
+		io.WriteString(w, "Hello")
+		w.(web.Flusher).Flush()
+		io.WriteString(w, ", World")
+	}))
+	defer ts.Close()
+	status, header, body := web.RunHandler("http://example.com/", "GET", nil, nil, NewSingleHostProxy(mustParseURL(ts.URL)))
+	if status != web.StatusOK || string(body) != "Hello, World" {
+		t.Errorf("got %d, %q, want %d, %q", status, body, web.StatusOK, "Hello, World")
+	}
+	if te := header.Get(web.HeaderTransferEncoding); te != "" {
+		t.Errorf("Transfer-Encoding = %q, want none", te)
+	}
+}
+
+// rawBackend starts a backend server that reads one request header and writes
+// response on the connection.
+func rawBackend(t *testing.T, response string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if err := (&web.HeaderParser{}).ParseHttpHeader(bufio.NewReader(conn), make(web.Header)); err != nil {
+			return
+		}
+		io.WriteString(conn, response)
+	}()
+	return l
+}
+
+var responseTests = []struct {
+	response string
+	status   int
+	header   web.Header
+	body     string
+}{
+	{
+		"HTTP/1.1 200 OK\r\nConnection: close, X-Foo\r\nX-Foo: foo\r\nX-Bar: bar\r\nKeep-Alive: 300\r\nUpgrade: x\r\n\r\nHello",
+		web.StatusOK,
+		web.NewHeader("X-Bar", "bar"),
+		"Hello",
+	},
+	{
+		"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 404 Not Found\r\nContent-Length: 5\r\n\r\nHelloExtra",
+		web.StatusNotFound,
+		web.NewHeader(web.HeaderContentLength, "5"),
+		"Hello",
+	},
+	{
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Foo\r\n\r\n5;ext\r\nHello\r\n7\r\n, World\r\n0\r\nX-Foo: foo\r\n\r\n",
+		web.StatusOK,
+		web.Header{},
+		"Hello, World",
+	},
+	{
+		"HTTP/1.0 200 OK\r\n\r\nHello",
+		web.StatusOK,
+		web.Header{},
+		"Hello",
+	},
+	{
+		"HTTP/1.1 200\r\n\r\n",
+		web.StatusOK,
+		web.Header{},
+		"",
+	},
+	{
+		"garbage\r\n\r\n",
+		web.StatusBadGateway,
+		nil,
+		"",
+	},
+	{
+		"HTTP/1.1 200 OK\r\nContent-Length: x\r\n\r\n",
+		web.StatusBadGateway,
+		nil,
+		"",
+	},
+}
+
+func TestResponse(t *testing.T) {
+	for _, tt := range responseTests {
+		l := rawBackend(t, tt.response)
+		status, header, body := web.RunHandler("http://example.com/", "GET", nil, nil,
+			NewSingleHostProxy(mustParseURL("http://"+l.Addr().String())))
+		l.Close()
+		if status != tt.status {
+			t.Errorf("%q: status = %d, want %d", tt.response, status, tt.status)
+			continue
+		}
+		if tt.header == nil {
+			continue
+		}
+		if len(header) != len(tt.header) || string(body) != tt.body {
+			t.Errorf("%q: got %v, %q, want %v, %q", tt.response, header, body, tt.header, tt.body)
+			continue
+		}
+		for name, values := range tt.header {
+			if header.Get(name) != values[0] {
+				t.Errorf("%q: header %s = %q, want %q", tt.response, name, header.Get(name), values[0])
+			}
+		}
+	}
+}
+
+func TestBadGateway(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	status, _, _ := web.RunHandler("http://example.com/", "GET", nil, nil, NewSingleHostProxy(mustParseURL("http://"+addr)))
+	if status != web.StatusBadGateway {
+		t.Errorf("status = %d, want %d", status, web.StatusBadGateway)
+	}
+}
+
+func TestPool(t *testing.T) {
+	ts := server.NewTestServer(web.HandlerFunc(func(req *web.Request) {
+		io.WriteString(req.Respond(web.StatusOK, web.HeaderContentType, "text/plain"), req.RemoteAddr)
+	}))
+	defer ts.Close()
+	p := &Proxy{Target: mustParseURL(ts.URL), MaxIdleConns: 1}
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		status, _, body := web.RunHandler("http://example.com/", "GET", nil, nil, p)
+		if status != web.StatusOK {
+			t.Fatalf("%d: status = %d, want %d", i, status, web.StatusOK)
+		}
+		addrs = append(addrs, string(body))
+	}
+	if addrs[0] != addrs[1] || addrs[1] != addrs[2] {
+		t.Errorf("requests used different connections: %v", addrs)
+	}
+	if len(p.idle) != 1 {
+		t.Errorf("idle connections = %d, want 1", len(p.idle))
+	}
+
+	// Retry the request on a new connection when the pooled connection fails.
+	p.idle[0].conn.Close()
+	status, _, body := web.RunHandler("http://example.com/", "GET", nil, nil, p)
+	if status != web.StatusOK || string(body) == addrs[0] {
+		t.Errorf("after close: got %d, %q, want %d and a new connection", status, body, web.StatusOK)
+	}
+
+	// Do not retry a request that is not idempotent.
+	p.idle[0].conn.Close()
+	status, _, _ = web.RunHandler("http://example.com/", "DELETE", nil, nil, p)
+	if status != web.StatusBadGateway {
+		t.Errorf("DELETE after close: status = %d, want %d", status, web.StatusBadGateway)
+	}
+}
+
+var canRetryTests = []struct {
+	method string
+	header web.Header
+	retry  bool
+}{
+	{"GET", nil, true},
+	{"HEAD", nil, true},
+	{"OPTIONS", nil, true},
+	{"TRACE", nil, true},
+	{"GET", web.NewHeader(web.HeaderContentLength, "0"), true},
+	{"OPTIONS", web.NewHeader(web.HeaderContentLength, "5"), false},
+	{"OPTIONS", web.NewHeader(web.HeaderTransferEncoding, "chunked"), false},
+	{"POST", nil, false},
+	{"POST", web.NewHeader(web.HeaderContentLength, "0"), false},
+	{"PUT", nil, false},
+	{"DELETE", nil, false},
+}
+
+func TestCanRetry(t *testing.T) {
+	for _, tt := range canRetryTests {
+		req, err := web.NewRequest("1.2.3.4:5678", tt.method, mustParseURL("http://example.com/"), web.ProtocolVersion11, tt.header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retry := canRetry(req); retry != tt.retry {
+			t.Errorf("%s %v, canRetry() = %v, want %v", tt.method, tt.header, retry, tt.retry)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package scgi implements the SCGI protocol for Twister applications. Use
+// this package to run an application behind a web server such as lighttpd or
+// nginx that forwards requests with SCGI.
+//
+// The protocol is specified at http://python.ca/scgi/protocol.txt.
+package scgi
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"io"
+	"log"
+	"net"
+	"os"
+)
+
+const (
+	// Maximum size of the header netstring.
+	maxHeaderSize = 1 << 20
+
+	// Size of buffer for the response.
+	bufferSize = 4096
+)
+
+var (
+	errBadNetstring = os.NewError("twister.scgi: bad netstring")
+	errBadHeader    = os.NewError("twister.scgi: bad header")
+)
+
+// readHeader reads the netstring containing the request headers and returns
+// the headers as a map from name to value.
+func readHeader(br *bufio.Reader) (map[string]string, os.Error) {
+	n := 0
+	for i := 0; ; i++ {
+		c, err := br.ReadByte()
+		if err != nil {
+			if err == os.EOF && i > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if c == ':' && i > 0 {
+			break
+		}
+		if c < '0' || c > '9' || (i == 1 && n == 0) {
+			return nil, errBadNetstring
+		}
+		n = n*10 + int(c-'0')
+		if n > maxHeaderSize {
+			return nil, errBadNetstring
+		}
+	}
+
+	p := make([]byte, n+1)
+	if _, err := io.ReadFull(br, p); err != nil {
+		if err == os.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if p[n] != ',' {
+		return nil, errBadNetstring
+	}
+	p = p[:n]
+
+	env := make(map[string]string)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, 0)
+		if i <= 0 {
+			return nil, errBadHeader
+		}
+		j := bytes.IndexByte(p[i+1:], 0)
+		if j < 0 {
+			return nil, errBadHeader
+		}
+		env[string(p[:i])] = string(p[i+1 : i+1+j])
+		p = p[i+1+j+1:]
+	}
+
+	if _, found := env["CONTENT_LENGTH"]; !found || env["SCGI"] != "1" {
+		return nil, errBadHeader
+	}
+	return env, nil
+}
+
+// serveConnection reads a request from the connection, runs the handler and
+// closes the connection.
+func serveConnection(conn net.Conn, handler web.Handler) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	bw, _ := bufio.NewWriterSize(conn, bufferSize)
+	r := web.NewCGIResponder(bw)
+
+	env, err := readHeader(br)
+	var req *web.Request
+	if err == nil {
+		req, err = web.NewCGIRequest(env)
+	}
+	if err != nil {
+		if err != os.EOF {
+			log.Println("twister.scgi: bad request:", err)
+			r.Respond(web.StatusBadRequest, web.NewHeader(web.HeaderContentLength, "0"))
+			bw.Flush()
+		}
+		return
+	}
+
+	contentLength := req.ContentLength
+	if contentLength < 0 {
+		contentLength = 0
+	}
+	req.Body = io.LimitReader(br, int64(contentLength))
+	req.Responder = r
+	r.InvokeHandler(req, handler)
+	if err := bw.Flush(); err != nil {
+		log.Println("twister.scgi: write failed:", err)
+	}
+}
+
+// Serve accepts incoming SCGI connections on the listener l, creating a new
+// goroutine for each. The goroutines read the request and then call handler
+// to respond to the request.
+//
+// Here's an example of how to use this package with nginx:
+//
+//  location / {
+//      include scgi_params;
+//      scgi_pass 127.0.0.1:4000;
+//  }
+//
+// In the main function for the application:
+//
+//  l, err := net.Listen("tcp", "127.0.0.1:4000")
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  log.Fatal(scgi.Serve(l, handler))
+func Serve(l net.Listener, handler web.Handler) os.Error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConnection(conn, handler)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package scgi
+
+import (
+	"bufio"
+	"github.com/garyburd/twister/web"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type silentLogger struct{ t *testing.T }
+
+func (l silentLogger) Write(p []byte) (int, os.Error) {
+	return len(p), nil
+}
+
+// netstring returns a netstring containing the given header names and
+// values.
+func netstring(keysAndValues ...string) string {
+	s := ""
+	for _, kv := range keysAndValues {
+		s += kv + "\x00"
+	}
+	return strconv.Itoa(len(s)) + ":" + s + ","
+}
+
+func echoHandler(req *web.Request) {
+	p, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		req.Error(web.StatusBadRequest, err)
+		return
+	}
+	s := req.Method + " " + req.URL.Host + " " + req.URL.Path + " " + req.URL.RawQuery + " " + string(p)
+	w := req.Respond(web.StatusOK,
+		web.HeaderContentType, "text/plain",
+		web.HeaderContentLength, strconv.Itoa(len(s)))
+	io.WriteString(w, s)
+}
+
+var serveTests = []struct {
+	in  string
+	out string
+}{
+	{
+		netstring("CONTENT_LENGTH", "0", "SCGI", "1", "REQUEST_METHOD", "GET", "REQUEST_URI", "/a?x=1", "HTTP_HOST", "example.com"),
+		"Status: 200 OK\r\nContent-Length: 23\r\nContent-Type: text/plain\r\n\r\nGET example.com /a x=1 ",
+	},
+	{
+		netstring("CONTENT_LENGTH", "5", "SCGI", "1", "REQUEST_METHOD", "POST", "REQUEST_URI", "/", "HTTP_HOST", "example.com") + "HelloExtra",
+		"Status: 200 OK\r\nContent-Length: 25\r\nContent-Type: text/plain\r\n\r\nPOST example.com /  Hello",
+	},
+	{
+		// Missing SCGI header.
+		netstring("CONTENT_LENGTH", "0", "REQUEST_METHOD", "GET", "REQUEST_URI", "/"),
+		"Status: 400 Bad Request\r\nContent-Length: 0\r\n\r\n",
+	},
+	{
+		// Missing comma after netstring.
+		"4:A\x00B\x00;",
+		"Status: 400 Bad Request\r\nContent-Length: 0\r\n\r\n",
+	},
+}
+
+func TestServe(t *testing.T) {
+	log.SetOutput(silentLogger{t})
+	defer log.SetOutput(os.Stdout)
+	for _, tt := range serveTests {
+		client, server := net.Pipe()
+		go serveConnection(server, web.HandlerFunc(echoHandler))
+		go io.WriteString(client, tt.in)
+		p, _ := ioutil.ReadAll(client)
+		client.Close()
+		if string(p) != tt.out {
+			t.Errorf("in=%q\ngot:  %q\nwant: %q", tt.in, p, tt.out)
+		}
+	}
+}
+
+var readHeaderTests = []struct {
+	in  string
+	env map[string]string
+}{
+	{netstring("CONTENT_LENGTH", "0", "SCGI", "1"), map[string]string{"CONTENT_LENGTH": "0", "SCGI": "1"}},
+	{netstring("CONTENT_LENGTH", "0", "SCGI", "1", "A", ""), map[string]string{"CONTENT_LENGTH": "0", "SCGI": "1", "A": ""}},
+	{"0:,", nil},
+	{"01:,", nil},
+	{":,", nil},
+	{"x:,", nil},
+	{"5:A\x00B\x00,", nil},
+	{"4:\x00B\x00,", nil},
+	{"99999999:", nil},
+}
+
+func TestReadHeader(t *testing.T) {
+	for _, tt := range readHeaderTests {
+		env, err := readHeader(bufio.NewReader(strings.NewReader(tt.in)))
+		if tt.env == nil {
+			if err == nil {
+				t.Errorf("in=%q, expected error", tt.in)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(env, tt.env) {
+			t.Errorf("in=%q, got %v, %v, want %v", tt.in, env, err, tt.env)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// inheritedFD is the file descriptor of the listener in a process started
+// by Server.StartProcess.
+const inheritedFD = 3
+
+// ListenerFromFD returns a listener for the listening socket with the file
+// descriptor fd. The file descriptor is usually inherited from the parent
+// process. The returned listener uses a duplicate of fd and fd is closed.
+func ListenerFromFD(fd int) (net.Listener, os.Error) {
+	f := os.NewFile(fd, "listener")
+	if f == nil {
+		return nil, os.NewError("twister.server: bad listener file descriptor")
+	}
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// InheritedListener returns a listener for the file descriptor named by the
+// environment variable envVar. InheritedListener returns nil, nil if the
+// variable is not set. The file descriptor is marked close-on-exec so that it
+// is not leaked to other child processes.
+//
+// Example usage:
+//
+//  l, err := server.InheritedListener("TWISTER_FD")
+//  if err != nil {
+//      log.Fatal(err)
+//  }
+//  if l == nil {
+//      l, err = net.Listen("tcp", ":8080")
+//      if err != nil {
+//          log.Fatal(err)
+//      }
+//  }
+//  s := &server.Server{Listener: l, Handler: h}
+//  s.Serve()
+func InheritedListener(envVar string) (net.Listener, os.Error) {
+	s := os.Getenv(envVar)
+	if s == "" {
+		return nil, nil
+	}
+	fd, err := strconv.Atoi(s)
+	if err != nil || fd < 0 {
+		return nil, os.NewError("twister.server: bad file descriptor in " + envVar)
+	}
+	syscall.CloseOnExec(fd)
+	return ListenerFromFD(fd)
+}
+
+// ListenerFile returns a duplicate of the server's listening socket. The
+// listener must be a *net.TCPListener or a *net.UnixListener. The caller is
+// responsible for closing the returned file.
+func (s *Server) ListenerFile() (*os.File, os.Error) {
+	switch l := s.Listener.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		return l.File()
+	}
+	return nil, os.NewError("twister.server: listener does not have a file")
+}
+
+// StartProcess starts a new process running the program name with the
+// arguments argv and passes the server's listening socket to the process.
+// The environment variable envVar is set to the file descriptor of the
+// socket in the new process. The new process obtains the listener with
+// InheritedListener(envVar).
+//
+// To restart a server without refusing connections, call StartProcess and
+// then Shutdown. The listening socket stays open in the new process while
+// the old process completes active requests.
+func (s *Server) StartProcess(envVar string, name string, argv []string) (*os.Process, os.Error) {
+	f, err := s.ListenerFile()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envVar+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, envVar+"="+strconv.Itoa(inheritedFD))
+
+	return os.StartProcess(name, argv, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, f},
+	})
+}
@@ -0,0 +1,67 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestInheritedListenerNotSet(t *testing.T) {
+	os.Setenv("TWISTER_TEST_FD", "")
+	l, err := InheritedListener("TWISTER_TEST_FD")
+	if l != nil || err != nil {
+		t.Errorf("InheritedListener() = %v, %v, want nil, nil", l, err)
+	}
+}
+
+func TestListenerFromFD(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	f, err := (&Server{Listener: l}).ListenerFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2, err := ListenerFromFD(f.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Serve on the duplicate after closing the original listener.
+	l.Close()
+	s := &Server{Listener: l2, Handler: web.HandlerFunc(testHandler)}
+	go s.Serve()
+	defer s.Shutdown(0)
+
+	c, err := net.Dial("tcp", l2.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(c, "GET /?w=Hello&cl=5 HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	p, _ := ioutil.ReadAll(c)
+	c.Close()
+	if !bytes.HasSuffix(p, []byte("\r\n\r\nHello")) {
+		t.Errorf("response %q", p)
+	}
+}
@@ -20,10 +20,8 @@ import (
 	"github.com/garyburd/twister/web"
 	"io"
 	"log"
-	"net"
 	"os"
 	"sync"
-	"time"
 )
 
 // LogRecord records information about a request for logging.
@@ -48,6 +46,10 @@ type LogRecord struct {
 
 	// True if connection hijacked.
 	Hijacked bool
+
+	// Time in nanoseconds from reading the request line to completing the
+	// response.
+	Elapsed int64
 }
 
 func writeStringMap(w io.Writer, title string, m map[string][]string) {
@@ -96,7 +98,8 @@ func VerboseLogger(lr *LogRecord) {
 	log.Print(b.String())
 }
 
-// ApacheCombinedLogger writes Apache Combined Log style logs to the given writer.
+// ApacheCombinedLogger writes Apache Combined Log style logs to the given
+// writer. The elapsed time in microseconds is appended to each line.
 //
 // Example usage:
 //
@@ -112,8 +115,6 @@ type ApacheCombinedLogger struct {
 	w     io.Writer
 }
 
-const apacheTimeFormat = "02/Jan/2006:15:04:05 -0700"
-
 // NewApacheCombinedLogger creates a new Apache logger.
 func NewApacheCombinedLogger(w io.Writer) *ApacheCombinedLogger {
 	return &ApacheCombinedLogger{w: w}
@@ -132,23 +133,45 @@ func (acl *ApacheCombinedLogger) Log(lr *LogRecord) {
 		return
 	}
 
-	host, _, err := net.SplitHostPort(lr.Request.RemoteAddr)
-	if err != nil {
-		log.Print(fmt.Sprintf("Failed to resolve \"%s\": %s", lr.Request.RemoteAddr, err.String()))
-		return
+	line := &web.LogLine{
+		Request:  lr.Request,
+		Status:   lr.Status,
+		Written:  lr.Written - lr.HeaderSize,
+		Elapsed:  lr.Elapsed,
+		Combined: true,
 	}
 
-	var b = &bytes.Buffer{}
-	fmt.Fprintf(b, "%s - - [%s] ", host, time.LocalTime().Format(apacheTimeFormat))
-	fmt.Fprintf(b, "\"%s %s HTTP/%d.%d\" ",
-		lr.Request.Method, lr.Request.URL, lr.Request.ProtocolVersion/1000, lr.Request.ProtocolVersion%1000)
-	fmt.Fprintf(b, "%d %d \"%s\" \"%s\"\n",
-		lr.Status, lr.Written-lr.HeaderSize, lr.Request.Header.Get(web.HeaderReferer),
-		lr.Request.Header.Get(web.HeaderUserAgent))
-
 	// Lock to make sure that we don't write while log output is being changed.
 	acl.mutex.Lock()
 	defer acl.mutex.Unlock()
 
-	acl.w.Write(b.Bytes())
+	line.WriteTo(acl.w)
+}
+
+// CommonLogger writes Common Log Format logs to the given writer. The elapsed
+// time in microseconds is appended to each line.
+type CommonLogger struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewCommonLogger creates a new Common Log Format logger.
+func NewCommonLogger(w io.Writer) *CommonLogger {
+	return &CommonLogger{w: w}
+}
+
+func (cl *CommonLogger) Log(lr *LogRecord) {
+	if lr.Hijacked {
+		return
+	}
+	line := &web.LogLine{
+		Request: lr.Request,
+		Status:  lr.Status,
+		Written: lr.Written - lr.HeaderSize,
+		Elapsed: lr.Elapsed,
+	}
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	line.WriteTo(cl.w)
 }
@@ -16,9 +16,11 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"github.com/garyburd/twister/web"
 	"io"
 	"os"
+	"strconv"
 )
 
 type responseBody interface {
@@ -74,6 +76,11 @@ type identityResponseBody struct {
 	bw  *bufio.Writer
 	wr  io.Writer
 
+	// True if the handler attempted to write past the declared length. The
+	// overflow is kept separate from err so that the buffered response is
+	// flushed to the connection before the overflow is reported.
+	overflow bool
+
 	// Value of Content-Length header.
 	contentLength int
 
@@ -98,14 +105,36 @@ func newIdentityResponseBody(wr io.Writer, header []byte, bufferSize, contentLen
 
 type writerOnly struct{ io.Writer }
 
+// writeErr returns the error for a write to the response body.
+func (w *identityResponseBody) writeErr() os.Error {
+	if w.err == nil && w.overflow {
+		return web.ErrResponseOverflow
+	}
+	return w.err
+}
+
+// ReadFrom copies src to the connection. When the Content-Length is
+// declared, ReadFrom stops reading after the declared number of bytes and
+// leaves any remaining data in src unread. Reading past the declared length
+// to detect an overflow would block on sources such as an open pipe.
 func (w *identityResponseBody) ReadFrom(src io.Reader) (n int64, err os.Error) {
+	if err = w.writeErr(); err != nil {
+		return 0, err
+	}
 	if rf, ok := w.wr.(io.ReaderFrom); ok {
 		err = w.bw.Flush()
 		if err != nil {
+			w.err = err
 			return
 		}
+		if w.contentLength >= 0 {
+			src = io.LimitReader(src, int64(w.contentLength-w.written))
+		}
 		n, err = rf.ReadFrom(src)
 		w.written += int(n)
+		if err != nil {
+			w.err = err
+		}
 		return
 	}
 	// Fall back to default io.Copy implementation.
@@ -114,29 +143,33 @@ func (w *identityResponseBody) ReadFrom(src io.Reader) (n int64, err os.Error) {
 }
 
 func (w *identityResponseBody) Write(p []byte) (int, os.Error) {
-	if w.err != nil {
-		return 0, w.err
+	if err := w.writeErr(); err != nil {
+		return 0, err
+	}
+	if w.contentLength >= 0 && w.written+len(p) > w.contentLength {
+		// Do not write past the declared length.
+		p = p[:w.contentLength-w.written]
+		w.overflow = true
 	}
 	var n int
 	n, w.err = w.bw.Write(p)
 	w.written += n
-	if w.err == nil && w.contentLength >= 0 && w.written > w.contentLength {
-		w.err = os.NewError("twister: long write by handler")
-	}
-	return n, w.err
+	return n, w.writeErr()
 }
 
 func (w *identityResponseBody) WriteString(p string) (int, os.Error) {
-	if w.err != nil {
-		return 0, w.err
+	if err := w.writeErr(); err != nil {
+		return 0, err
+	}
+	if w.contentLength >= 0 && w.written+len(p) > w.contentLength {
+		// Do not write past the declared length.
+		p = p[:w.contentLength-w.written]
+		w.overflow = true
 	}
 	var n int
 	n, w.err = w.bw.WriteString(p)
 	w.written += n
-	if w.err == nil && w.contentLength >= 0 && w.written > w.contentLength {
-		w.err = os.NewError("twister: long write by handler")
-	}
-	return n, w.err
+	return n, w.writeErr()
 }
 
 func (w *identityResponseBody) Flush() os.Error {
@@ -144,7 +177,7 @@ func (w *identityResponseBody) Flush() os.Error {
 		return w.err
 	}
 	w.err = w.bw.Flush()
-	return w.err
+	return w.writeErr()
 }
 
 func (w *identityResponseBody) finish() (int, os.Error) {
@@ -152,8 +185,10 @@ func (w *identityResponseBody) finish() (int, os.Error) {
 	if w.err != nil {
 		return w.headerWritten + w.written, w.err
 	}
-	if w.contentLength >= 0 && w.written < w.contentLength {
-		w.err = os.NewError("twister: short write by handler")
+	if w.overflow {
+		w.err = web.ErrResponseOverflow
+	} else if w.contentLength >= 0 && w.written < w.contentLength {
+		w.err = &shortWriteError{written: w.written, contentLength: w.contentLength}
 	}
 	err := w.err
 	if w.err == nil {
@@ -162,18 +197,33 @@ func (w *identityResponseBody) finish() (int, os.Error) {
 	return w.headerWritten + w.written, err
 }
 
+// shortWriteError is returned when the handler writes fewer bytes than
+// declared in the Content-Length header.
+type shortWriteError struct {
+	written       int
+	contentLength int
+}
+
+func (e *shortWriteError) String() string {
+	return "HTTP response body shorter than Content-Length, wrote " +
+		strconv.Itoa(e.written) + " of " + strconv.Itoa(e.contentLength) + " bytes"
+}
+
+var lastChunk = []byte("0\r\n\r\n")
+
 type chunkedResponseBody struct {
-	err     os.Error  // error from wr
-	wr      io.Writer // write here
-	buf     []byte    // buffered output
-	s       int       // start of chunk in buf 
-	n       int       // current write position in buf
-	ndigit  int       // number of hex digits in chunk size
+	err     os.Error   // error from wr
+	wr      io.Writer  // write here
+	buf     []byte     // buffered output
+	s       int        // start of chunk in buf 
+	n       int        // current write position in buf
+	ndigit  int        // number of hex digits in chunk size
+	trailer web.Header // trailer written after last chunk
 	written int
 }
 
-func newChunkedResponseBody(wr io.Writer, header []byte, bufferSize int) (*chunkedResponseBody, os.Error) {
-	w := &chunkedResponseBody{wr: wr, buf: make([]byte, bufferSize)}
+func newChunkedResponseBody(wr io.Writer, header []byte, bufferSize int, trailer web.Header) (*chunkedResponseBody, os.Error) {
+	w := &chunkedResponseBody{wr: wr, buf: make([]byte, bufferSize), trailer: trailer}
 
 	for n := int32(bufferSize); n != 0; n >>= 4 {
 		w.ndigit += 1
@@ -243,7 +293,21 @@ func (w *chunkedResponseBody) finish() (int, os.Error) {
 		return w.written, w.err
 	}
 	w.finalizeChunk()
-	const last = "0\r\n\r\n"
+	last := lastChunk
+	if len(w.trailer) > 0 {
+		var b bytes.Buffer
+		b.WriteString("0\r\n")
+		trailer := web.Header{}
+		for name, values := range w.trailer {
+			for _, value := range values {
+				if value != "" {
+					trailer.Add(name, value)
+				}
+			}
+		}
+		trailer.WriteHttpHeader(&b)
+		last = b.Bytes()
+	}
 	if w.n+len(last) > len(w.buf) {
 		w.writeBuf()
 		if w.err != nil {
@@ -251,9 +315,15 @@ func (w *chunkedResponseBody) finish() (int, os.Error) {
 		}
 		w.n = 0
 	}
-	copy(w.buf[w.n:], last)
-	w.n += len(last)
-	w.writeBuf()
+	if len(last) > len(w.buf) {
+		var n int
+		n, w.err = w.wr.Write(last)
+		w.written += n
+	} else {
+		copy(w.buf[w.n:], last)
+		w.n += len(last)
+		w.writeBuf()
+	}
 	err := w.err
 	if w.err == nil {
 		w.err = web.ErrInvalidState
@@ -276,6 +346,27 @@ func (w *chunkedResponseBody) ncopy(max int) int {
 	return n
 }
 
+// ReadFrom reads from src directly into the chunk buffer. This avoids copying
+// through an intermediate buffer in io.Copy.
+func (w *chunkedResponseBody) ReadFrom(src io.Reader) (n int64, err os.Error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	for err == nil {
+		m := w.ncopy(len(w.buf))
+		if m < 0 {
+			return n, w.err
+		}
+		m, err = src.Read(w.buf[w.n : w.n+m])
+		w.n += m
+		n += int64(m)
+	}
+	if err == os.EOF {
+		err = nil
+	}
+	return n, err
+}
+
 func (w *chunkedResponseBody) Write(p []byte) (int, os.Error) {
 	if w.err != nil {
 		return 0, w.err
@@ -311,3 +402,156 @@ func (w *chunkedResponseBody) WriteString(p string) (int, os.Error) {
 	}
 	return nn, w.err
 }
+
+// bufferedResponseBody buffers a response body of unknown length. If the
+// response is finished before the buffer exceeds max bytes, then the response
+// is written with a Content-Length header. Otherwise, the response switches
+// to chunked encoding. If discard is true, then the body is counted but not
+// written as required for responses to HEAD requests.
+type bufferedResponseBody struct {
+	err        os.Error
+	wr         io.Writer
+	buf        bytes.Buffer
+	size       int
+	max        int
+	bufferSize int
+	discard    bool
+
+	// Function to format the response header for chunked or identity
+	// encoding.
+	header func(chunked bool, contentLength int) []byte
+
+	// Set after the response switches to chunked encoding.
+	chunked responseBody
+}
+
+func newBufferedResponseBody(wr io.Writer, bufferSize, max int, discard bool, header func(chunked bool, contentLength int) []byte) *bufferedResponseBody {
+	return &bufferedResponseBody{wr: wr, bufferSize: bufferSize, max: max, discard: discard, header: header}
+}
+
+// startChunked switches the response to chunked encoding.
+func (w *bufferedResponseBody) startChunked() os.Error {
+	if w.chunked != nil || w.err != nil {
+		return w.err
+	}
+	if w.discard {
+		w.chunked, w.err = newNullResponseBody(w.wr, w.header(true, 0))
+		return w.err
+	}
+	w.chunked, w.err = newChunkedResponseBody(w.wr, w.header(true, 0), w.bufferSize, nil)
+	if w.err != nil {
+		return w.err
+	}
+	_, w.err = w.chunked.Write(w.buf.Bytes())
+	w.buf.Reset()
+	return w.err
+}
+
+// buffer returns true if n more bytes can be added to the buffer.
+func (w *bufferedResponseBody) buffer(n int) bool {
+	if w.chunked == nil && w.size+n > w.max {
+		w.startChunked()
+	}
+	if w.chunked != nil {
+		return false
+	}
+	w.size += n
+	return true
+}
+
+func (w *bufferedResponseBody) Write(p []byte) (int, os.Error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if !w.buffer(len(p)) {
+		if w.err != nil {
+			return 0, w.err
+		}
+		return w.chunked.Write(p)
+	}
+	if w.discard {
+		return len(p), nil
+	}
+	return w.buf.Write(p)
+}
+
+func (w *bufferedResponseBody) WriteString(p string) (int, os.Error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if !w.buffer(len(p)) {
+		if w.err != nil {
+			return 0, w.err
+		}
+		return io.WriteString(w.chunked, p)
+	}
+	if w.discard {
+		return len(p), nil
+	}
+	return w.buf.WriteString(p)
+}
+
+// ReadFrom buffers src up to the limit. If src has more data, then ReadFrom
+// switches the response to chunked encoding and copies the remainder of src
+// with the chunked body's ReadFrom.
+func (w *bufferedResponseBody) ReadFrom(src io.Reader) (n int64, err os.Error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.discard {
+		return io.Copy(writerOnly{w}, src)
+	}
+	if w.chunked == nil {
+		// Read one byte past the limit to detect a body that does not fit
+		// in the buffer.
+		n, err = w.buf.ReadFrom(io.LimitReader(src, int64(w.max-w.size+1)))
+		w.size += int(n)
+		if err != nil || w.size <= w.max {
+			return n, err
+		}
+		if err = w.startChunked(); err != nil {
+			return n, err
+		}
+	}
+	m, err := w.chunked.(io.ReaderFrom).ReadFrom(src)
+	return n + m, err
+}
+
+// reset discards the buffered response and returns true if nothing has been
+// written to the connection.
+func (w *bufferedResponseBody) reset() bool {
+	if w.chunked != nil || w.err != nil {
+		return false
+	}
+	w.buf.Reset()
+	w.size = 0
+	w.err = web.ErrInvalidState
+	return true
+}
+
+func (w *bufferedResponseBody) Flush() os.Error {
+	if err := w.startChunked(); err != nil {
+		return err
+	}
+	return w.chunked.Flush()
+}
+
+func (w *bufferedResponseBody) finish() (int, os.Error) {
+	if w.chunked != nil {
+		return w.chunked.finish()
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	p := w.header(false, w.size)
+	if w.buf.Len() > 0 {
+		p = append(p, w.buf.Bytes()...)
+	}
+	var n int
+	n, w.err = w.wr.Write(p)
+	err := w.err
+	if w.err == nil {
+		w.err = web.ErrInvalidState
+	}
+	return n, err
+}
@@ -16,11 +16,15 @@ package server
 
 import (
 	"bytes"
+	"fmt"
+	"github.com/garyburd/twister/web"
 	"io"
+	"io/ioutil"
 	"os"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 var chunkHeaderRegexp = regexp.MustCompile("^[0-9A-Z]+\r\n")
@@ -62,7 +66,7 @@ func TestChunkedResponse(t *testing.T) {
 		for _, tt := range chunkedResponseTests {
 			var buf bytes.Buffer
 			nn := tt.n[0]
-			w, _ := newChunkedResponseBody(&buf, []byte(dots[:nn]), chunkTestBufferSize)
+			w, _ := newChunkedResponseBody(&buf, []byte(dots[:nn]), chunkTestBufferSize, nil)
 			for i := 1; i < len(tt.n); i++ {
 				n := tt.n[i]
 				if n < 0 {
@@ -84,6 +88,24 @@ func TestChunkedResponse(t *testing.T) {
 	}
 }
 
+func TestChunkedResponseReadFrom(t *testing.T) {
+	for _, tt := range chunkedResponseTests {
+		if len(tt.n) > 2 || tt.n[0] != 0 {
+			continue
+		}
+		var buf bytes.Buffer
+		w, _ := newChunkedResponseBody(&buf, nil, chunkTestBufferSize, nil)
+		n, err := w.ReadFrom(strings.NewReader(dots[:tt.n[1]]))
+		if n != int64(tt.n[1]) || err != nil {
+			t.Errorf("%v, ReadFrom() = %d, %v, want %d, nil", tt.n, n, err, tt.n[1])
+		}
+		w.finish()
+		if out := buf.String(); out != tt.out {
+			t.Errorf("%v\ngot:  %q\nwant: %q", tt.n, out, tt.out)
+		}
+	}
+}
+
 type addReaderFrom struct {
 	io.Writer
 }
@@ -109,3 +131,219 @@ func TestIdentityResponseReadFrom(t *testing.T) {
 		}
 	}
 }
+
+// blockingReader returns data and then blocks until closed.
+type blockingReader struct {
+	data   string
+	closed chan bool
+}
+
+func (r *blockingReader) Read(p []byte) (int, os.Error) {
+	if r.data == "" {
+		<-r.closed
+		return 0, os.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestIdentityResponseReadFromLimit(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := newIdentityResponseBody(addReaderFrom{&buf}, nil, 1024, 5)
+	r := &blockingReader{data: "Hello", closed: make(chan bool)}
+	defer close(r.closed)
+	done := make(chan bool)
+	go func() {
+		n, err := w.ReadFrom(r)
+		if n != 5 || err != nil {
+			t.Errorf("ReadFrom() = %d, %v, want 5, nil", n, err)
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(1e9):
+		t.Fatal("ReadFrom blocked after reading the declared length")
+	}
+	if _, err := w.finish(); err != nil {
+		t.Errorf("finish() returned error %v", err)
+	}
+	if buf.String() != "Hello" {
+		t.Errorf("body = %q, want %q", buf.String(), "Hello")
+	}
+
+	// Data past the declared length is left in the source.
+	buf.Reset()
+	w, _ = newIdentityResponseBody(addReaderFrom{&buf}, nil, 1024, 3)
+	src := strings.NewReader("Hello")
+	if n, err := w.ReadFrom(src); n != 3 || err != nil {
+		t.Errorf("ReadFrom() = %d, %v, want 3, nil", n, err)
+	}
+	if rest, _ := ioutil.ReadAll(src); string(rest) != "lo" {
+		t.Errorf("rest = %q, want %q", rest, "lo")
+	}
+}
+
+var identityResponseLengthTests = []struct {
+	contentLength int
+	body          string
+	out           string
+	writeErr      os.Error
+	finishErr     bool
+}{
+	{5, "Hello", "Hello", nil, false},
+	{3, "Hello", "Hel", web.ErrResponseOverflow, true},
+	{7, "Hello", "Hello", nil, true},
+}
+
+func TestIdentityResponseLength(t *testing.T) {
+	for writerName, writer := range writers {
+		for _, tt := range identityResponseLengthTests {
+			var buf bytes.Buffer
+			w, _ := newIdentityResponseBody(&buf, nil, 1024, tt.contentLength)
+			_, err := writer(w, tt.body)
+			if err != tt.writeErr {
+				t.Errorf("%s %d, write error = %v, want %v", writerName, tt.contentLength, err, tt.writeErr)
+			}
+			_, err = w.finish()
+			if (err != nil) != tt.finishErr {
+				t.Errorf("%s %d, finish error = %v, want error %v", writerName, tt.contentLength, err, tt.finishErr)
+			}
+			if out := buf.String(); out != tt.out {
+				t.Errorf("%s %d, got %q, want %q", writerName, tt.contentLength, out, tt.out)
+			}
+		}
+	}
+}
+
+func TestChunkedResponseTrailer(t *testing.T) {
+	for _, n := range []int{0, 20, 26} {
+		var buf bytes.Buffer
+		trailer := web.Header{"X-A": []string{"1"}, "X-B": []string{""}}
+		w, _ := newChunkedResponseBody(&buf, nil, chunkTestBufferSize, trailer)
+		w.Write([]byte(dots[:n]))
+		w.finish()
+		want := "0\r\nX-A: 1\r\n\r\n"
+		if n > 0 {
+			want = fmt.Sprintf("%02x\r\n%s\r\n", n, dots[:n]) + want
+		}
+		if out := buf.String(); out != want {
+			t.Errorf("%d\ngot:  %q\nwant: %q", n, out, want)
+		}
+	}
+}
+
+// writeCounter counts calls to Write.
+type writeCounter struct {
+	n int
+}
+
+func (w *writeCounter) Write(p []byte) (int, os.Error) {
+	w.n += 1
+	return len(p), nil
+}
+
+func TestChunkedResponseWrites(t *testing.T) {
+	const chunks = 10
+	var wc writeCounter
+	w, _ := newChunkedResponseBody(&wc, []byte(dots[:100]), 4096, nil)
+	for i := 0; i < chunks; i++ {
+		w.Write([]byte(dots[:1024]))
+		w.Flush()
+	}
+	w.finish()
+	// One write per chunk with the header coalesced into the first chunk and
+	// one write for the last chunk.
+	if wc.n != chunks+1 {
+		t.Errorf("writes = %d, want %d", wc.n, chunks+1)
+	}
+}
+
+func BenchmarkChunkedResponse(b *testing.B) {
+	p := []byte(dots[:1024])
+	var wc writeCounter
+	w, _ := newChunkedResponseBody(&wc, nil, 4096, nil)
+	for i := 0; i < b.N; i++ {
+		w.Write(p)
+		w.Flush()
+	}
+	w.finish()
+}
+
+var bufferedResponseTests = []struct {
+	discard bool
+	n       []int
+	out     string
+}{
+	// Empty body
+	{false, []int{}, "L0|"},
+	// Body in multiple writes within the limit
+	{false, []int{4, 4}, "L8|" + dots[:8]},
+	// Write exceeding the limit switches to chunked
+	{false, []int{5, 5}, "C|0a\r\n" + dots[:10] + "\r\n0\r\n\r\n"},
+	// Flush switches to chunked
+	{false, []int{5, -1, 5}, "C|05\r\n" + dots[:5] + "\r\n05\r\n" + dots[:5] + "\r\n0\r\n\r\n"},
+	// Discarded body within the limit
+	{true, []int{4, 4}, "L8|"},
+	// Discarded body exceeding the limit
+	{true, []int{5, 5}, "C|"},
+}
+
+func TestBufferedResponse(t *testing.T) {
+	for writerName, writer := range writers {
+		for _, tt := range bufferedResponseTests {
+			var buf bytes.Buffer
+			w := newBufferedResponseBody(&buf, chunkTestBufferSize, 8, tt.discard, func(chunked bool, contentLength int) []byte {
+				if chunked {
+					return []byte("C|")
+				}
+				return []byte(fmt.Sprintf("L%d|", contentLength))
+			})
+			for _, n := range tt.n {
+				if n < 0 {
+					w.Flush()
+				} else {
+					writer(w, dots[:n])
+				}
+			}
+			w.finish()
+			if out := buf.String(); out != tt.out {
+				t.Errorf("%s %v %v\ngot:  %q\nwant: %q", writerName, tt.discard, tt.n, out, tt.out)
+			}
+		}
+	}
+}
+
+var bufferedResponseReadFromTests = []struct {
+	discard bool
+	n       int
+	out     string
+}{
+	{false, 0, "L0|"},
+	{false, 8, "L8|" + dots[:8]},
+	{false, 9, "C|09\r\n" + dots[:9] + "\r\n0\r\n\r\n"},
+	{false, 40, "C|18\r\n" + dots[:24] + "\r\n10\r\n" + dots[:16] + "\r\n0\r\n\r\n"},
+	{true, 8, "L8|"},
+	{true, 9, "C|"},
+}
+
+func TestBufferedResponseReadFrom(t *testing.T) {
+	for _, tt := range bufferedResponseReadFromTests {
+		var buf bytes.Buffer
+		w := newBufferedResponseBody(&buf, chunkTestBufferSize, 8, tt.discard, func(chunked bool, contentLength int) []byte {
+			if chunked {
+				return []byte("C|")
+			}
+			return []byte(fmt.Sprintf("L%d|", contentLength))
+		})
+		n, err := io.Copy(w, strings.NewReader(dots[:tt.n]))
+		if n != int64(tt.n) || err != nil {
+			t.Errorf("%v %d, io.Copy() = %d, %v, want %d, nil", tt.discard, tt.n, n, err, tt.n)
+		}
+		w.finish()
+		if out := buf.String(); out != tt.out {
+			t.Errorf("%v %d\ngot:  %q\nwant: %q", tt.discard, tt.n, out, tt.out)
+		}
+	}
+}
@@ -18,49 +18,231 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"github.com/garyburd/twister/web"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"os"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"url"
 )
 
 var errBadRequestLine = os.NewError("twister.server: could not parse request line")
+var errVersionNotSupported = os.NewError("twister.server: HTTP version not supported")
+var errBadLineTerminator = os.NewError("twister.server: request line not terminated by CRLF")
+var errBadContentLength = os.NewError("twister.server: bad content length")
+var errBadTransferEncoding = os.NewError("twister.server: bad transfer encoding")
+var errLengthAndTransferEncoding = os.NewError("twister.server: request has both Content-Length and Transfer-Encoding")
+var errUnexpectedBody = os.NewError("twister.server: GET or HEAD request has a body")
+var errBadRequestTarget = os.NewError("twister.server: bad request target")
+var errConnectNotAllowed = os.NewError("twister.server: CONNECT not allowed")
+var errMissingHost = os.NewError("twister.server: missing Host header")
+var errBadHost = os.NewError("twister.server: bad Host header")
 
 // Server defines parameters for running an HTTP server.
 type Server struct {
+	// Counters for server activity. The field is first in the struct so that
+	// the counters are 64-bit aligned for atomic operations on 32-bit
+	// platforms.
+	Stats Stats
+
 	// The server accepts incoming connections on this listener. The
-	// application is required to set this field.
+	// application is required to set this field or add listeners with
+	// AddListener.
 	Listener net.Listener
 
 	// The server dispatches requests to this handler. The application is
 	// required to set this field.
 	Handler web.Handler
 
-	// If true, then set the request URL protocol to HTTPS.
+	// If true, then set the request URL protocol to HTTPS for requests on
+	// Listener. The protocol in an absolute-form request target takes
+	// precedence over this field.
 	Secure bool
 
 	// Set request URL host to this string if host is not specified in the
 	// request or headers.
 	DefaultHost string
 
-	// The net.Conn.SetReadTimeout value for new connections.
+	// The net.Conn.SetReadTimeout value for connections. The timeout is set
+	// before reading each request and applies to each read from the
+	// connection, including the wait for the next request on a keep-alive
+	// connection. A slow request body is not interrupted as long as each read
+	// completes within the timeout. The connection is closed when a read times
+	// out.
 	ReadTimeout int64
 
-	// The net.Conn.SetWriteTimeout value for new connections.
+	// Maximum time in nanoseconds to read the request line and header after
+	// the first byte of the request arrives. The server responds with status
+	// 408 and closes the connection when the deadline is exceeded. The
+	// deadline protects against clients that send the header slowly to hold
+	// the connection open. If zero, then the time is not limited.
+	HeaderReadTimeout int64
+
+	// The net.Conn.SetReadTimeout value used while a keep-alive connection
+	// waits for the next request. When the first byte of the next request
+	// arrives, the timeout is switched back to ReadTimeout. The connection
+	// is closed when the timeout expires. If zero, then ReadTimeout is used.
+	IdleTimeout int64
+
+	// Maximum number of requests served on a connection. The server closes
+	// the connection after the response to the last request. If zero, then
+	// the number of requests is not limited.
+	MaxRequestsPerConn int
+
+	// The net.Conn.SetWriteTimeout value for connections. The timeout is set
+	// before the handler is called for each request and applies to each write
+	// to the connection. The connection is closed when a write times out.
 	WriteTimeout int64
 
 	// Log the request.
 	Logger Logger
 
-	// If true, do not recover from handler panics.
+	// If true, the server dispatches CONNECT requests to the handler with
+	// the request URL host set to the authority from the request target. The
+	// handler can implement a tunnel by hijacking the connection. Otherwise,
+	// the server responds to CONNECT requests with status 405 and closes the
+	// connection. The Allow header in the 405 response is OptionsAllow if
+	// set or DefaultAllow otherwise.
+	AllowConnect bool
+
+	// If not empty, the server responds to "OPTIONS *" requests with status
+	// 200 and an Allow header containing this value. Otherwise, the server
+	// dispatches "OPTIONS *" requests to the handler with the request URL
+	// path set to "*".
+	OptionsAllow string
+
+	// If true, do not enable TCP keep-alive on accepted TCP connections.
+	// Otherwise, the server enables keep-alive so that the operating system
+	// detects and closes connections to dead clients. The TCP options are
+	// set on connections from TCP listeners and from TLS listeners created
+	// with ServeTLS or TLSListener.
+	NoTCPKeepAlive bool
+
+	// If true, do not disable Nagle's algorithm on accepted TCP connections.
+	// Otherwise, the server sets the TCP_NODELAY option so that small writes
+	// are sent without delay.
+	NoTCPNoDelay bool
+
+	// If true, the server reads a PROXY protocol version 1 header at the
+	// start of each connection and uses the client address from the header
+	// as the remote address of requests on the connection. Connections
+	// without a valid header are closed. Set this field only when all
+	// connections are accepted from a proxy that sends the header.
+	AcceptProxyProtocol bool
+
+	// If true, do not recover from handler panics. Otherwise, the server logs
+	// the panic, responds with status 500 if the handler did not start a
+	// response and closes the connection.
 	NoRecoverHandlers bool
+
+	// Maximum size of a request header line. If zero, then
+	// web.DefaultMaxHeaderLineSize is used.
+	MaxHeaderLineSize int
+
+	// Maximum size of a request header value. If zero, then
+	// web.DefaultMaxHeaderValueSize is used.
+	MaxHeaderValueSize int
+
+	// Maximum number of request headers. If zero, then
+	// web.DefaultMaxHeaderCount is used.
+	MaxHeaderCount int
+
+	// Maximum total size of the request header lines. If zero, then the total
+	// size is not limited.
+	MaxHeaderSize int
+
+	// If true, the server responds with status 400 to requests with lines
+	// not terminated by CRLF, whitespace between a header name and the
+	// colon or folded header continuation lines. Otherwise, these forms are
+	// accepted. Enable strict parsing when the server is not behind a proxy
+	// that sanitizes requests.
+	StrictParsing bool
+
+	// Maximum number of unread request body bytes that the server discards
+	// after the response so that the connection can be reused. If the unread
+	// body is larger, then the connection is closed. If zero, then
+	// DefaultMaxDrainSize is used. If negative, then the server does not
+	// discard unread request bodies.
+	MaxDrainSize int
+
+	// Maximum size of a response body that the server buffers when the
+	// handler does not set the Content-Length header. If the handler
+	// completes the response within this size, then the server sets the
+	// Content-Length header. Otherwise, the server sends the response with
+	// chunked encoding. A call to Flush by the handler switches the response
+	// to chunked encoding. If zero, then DefaultMaxBufferedResponseSize is
+	// used. If negative, then responses are not buffered.
+	MaxBufferedResponseSize int
+
+	// Maximum size of a request body. If the request specifies a larger
+	// Content-Length, then the server responds with status 413 and closes
+	// the connection without calling the handler. If a chunked request body
+	// is larger than this size, then reads from the request body return the
+	// error web.ErrRequestEntityTooLarge. Handlers can lower the limit for a
+	// request with web.Request.LimitBody. If zero, then the size of request
+	// bodies is not limited.
+	MaxRequestBodySize int
+
+	// Value of the Server header added to responses, including the minimal
+	// responses to malformed requests and rejected connections. The header is
+	// not added if this field is empty or if the handler sets the header.
+	// Leave this field empty to avoid advertising the server software. The
+	// Run and RunTLS functions set this field to DefaultServerHeader.
+	ServerHeader string
+
+	// Maximum number of connections served concurrently. When the limit is
+	// reached, each listener holds its next accepted connection and stops
+	// accepting until a connection is closed, unless RejectExcessConnections
+	// is set. If zero, then the number of connections is not limited.
+	MaxConcurrentConnections int
+
+	// If true, then connections accepted when MaxConcurrentConnections is
+	// reached receive a 503 response and are closed.
+	RejectExcessConnections bool
+
+	// Logger for errors encountered by the server. The remote address of the
+	// connection is included in each message. If nil, then the log package's
+	// standard logger is used.
+	ErrorLog *log.Logger
+
+	listeners []serverListener  // listeners added with AddListener
+	sem       chan bool         // counts connections when MaxConcurrentConnections > 0
+	mu        sync.Mutex        // protects conns and shutdown
+	conns     map[net.Conn]bool // active connections, true if idle
+	shutdown  bool              // true if Shutdown called
+	wg        sync.WaitGroup    // counts active connections
+}
+
+// serverListener is a listener and the secure flag for the listener.
+type serverListener struct {
+	listener net.Listener
+	secure   bool
 }
 
+// DefaultMaxDrainSize is the default value for Server.MaxDrainSize.
+const DefaultMaxDrainSize = 256 * 1024
+
+// DefaultMaxBufferedResponseSize is the default value for
+// Server.MaxBufferedResponseSize.
+const DefaultMaxBufferedResponseSize = 4096
+
+// DefaultServerHeader is the Server header value used by Run and RunTLS.
+const DefaultServerHeader = "twister"
+
+// DefaultAllow is the Allow header value in the response to a CONNECT request
+// when Server.AllowConnect is false and Server.OptionsAllow is not set.
+const DefaultAllow = "GET, HEAD, POST, PUT, DELETE, OPTIONS"
+
 // Logger defines an interface for logging a request.
 type Logger interface {
 	Log(lr *LogRecord)
@@ -80,11 +262,15 @@ type transaction struct {
 	responseBody       responseBody
 	chunkedResponse    bool
 	chunkedRequest     bool
+	drainRequest       bool // true if unread request body is discarded after the response
 	closeAfterResponse bool
 	hijacked           bool
 	req                *web.Request
 	requestAvail       int
+	requestLimit       int // remaining allowed body bytes, -1 if no limit
 	requestErr         os.Error
+	parseErrorStatus   int  // status for response to unparsable request, 0 if none
+	parseErrorBody     bool // true if parse error response includes a body
 	requestConsumed    bool
 	respondCalled      bool
 	responseErr        os.Error
@@ -92,6 +278,13 @@ type transaction struct {
 	status             int
 	header             web.Header
 	headerSize         int
+	headerParser       web.HeaderParser
+	start              int64 // time request line was read in nanoseconds
+	remoteAddr         string
+	secure             bool      // true if the connection is from a secure listener
+	done               chan bool // closed when the client closes the connection
+	watchStop          chan bool // stops the goroutine watching the connection
+	watchExit          chan bool // closed when the watching goroutine exits
 }
 
 var httpslash = []byte("HTTP/")
@@ -129,13 +322,53 @@ func nextWord(p []byte) (s string, rest []byte, err os.Error) {
 	return
 }
 
-func readRequestLine(b *bufio.Reader) (method string, urlStr string, version int, err os.Error) {
-	var p []byte
-	var isPrefix bool
+// validRequestTarget returns true if s is not empty and does not contain
+// control characters. The target is parsed later as a URL.
+func validRequestTarget(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
 
-	p, isPrefix, err = b.ReadLine()
-	if isPrefix {
-		err = web.ErrLineTooLong
+// validHost returns true if s is a plausible host with optional port.
+func validHost(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c <= ' ' || c == 0x7f:
+			return false
+		case c == '/' || c == '\\' || c == '?' || c == '#' || c == '@':
+			return false
+		}
+	}
+	return true
+}
+
+// readRequestLine reads and parses the request line. If strict is true, then
+// the line must be terminated by CRLF.
+func readRequestLine(b *bufio.Reader, strict bool) (method string, urlStr string, version int, err os.Error) {
+	var p []byte
+	if strict {
+		p, err = b.ReadSlice('\n')
+		switch {
+		case err == bufio.ErrBufferFull:
+			err = web.ErrLineTooLong
+		case err == nil && (len(p) < 2 || p[len(p)-2] != '\r'):
+			err = errBadLineTerminator
+		case err == nil:
+			p = p[:len(p)-2]
+		}
+	} else {
+		var isPrefix bool
+		p, isPrefix, err = b.ReadLine()
+		if isPrefix {
+			err = web.ErrLineTooLong
+		}
 	}
 	if err != nil {
 		return
@@ -145,11 +378,19 @@ func readRequestLine(b *bufio.Reader) (method string, urlStr string, version int
 	if err != nil {
 		return
 	}
+	if !web.IsToken(method) {
+		err = errBadRequestLine
+		return
+	}
 
 	urlStr, p, err = nextWord(p)
 	if err != nil {
 		return
 	}
+	if !validRequestTarget(urlStr) {
+		err = errBadRequestLine
+		return
+	}
 
 	if !bytes.HasPrefix(p, httpslash) {
 		err = errBadRequestLine
@@ -178,74 +419,283 @@ func readRequestLine(b *bufio.Reader) (method string, urlStr string, version int
 		return
 	}
 
+	switch {
+	case major != 1:
+		err = errVersionNotSupported
+		return
+	case minor > 1:
+		// Treat later HTTP/1.x versions as HTTP/1.1.
+		minor = 1
+	}
+
 	version = web.ProtocolVersion(major, minor)
 	return
 }
 
+var errBadProxyLine = os.NewError("twister.server: bad PROXY protocol header")
+
+// maxProxyLineSize is the maximum size of a PROXY protocol version 1 header
+// including the terminating CRLF.
+const maxProxyLineSize = 107
+
+// readProxyLine reads a PROXY protocol version 1 header from br and returns
+// the client address. The returned address is "" if the proxy does not know
+// the client address.
+func readProxyLine(br *bufio.Reader) (string, os.Error) {
+	p, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errBadProxyLine
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(p) > maxProxyLineSize || len(p) < 2 || p[len(p)-2] != '\r' {
+		return "", errBadProxyLine
+	}
+	fields := strings.Split(string(p[:len(p)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return "", errBadProxyLine
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return "", nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return "", errBadProxyLine
+		}
+	default:
+		return "", errBadProxyLine
+	}
+	for _, s := range fields[2:4] {
+		if net.ParseIP(s) == nil || strings.Contains(s, ":") != (fields[1] == "TCP6") {
+			return "", errBadProxyLine
+		}
+	}
+	for _, s := range fields[4:6] {
+		port, err := strconv.Atoi(s)
+		if err != nil || port < 0 || port > 65535 || s != strconv.Itoa(port) {
+			return "", errBadProxyLine
+		}
+	}
+	return net.JoinHostPort(fields[2], fields[4]), nil
+}
+
+// checkContentLength returns the request content length given the values of
+// the Content-Length header. An error is returned if a value is not a
+// non-negative decimal integer or if the values are not all the same.
+func checkContentLength(values []string) (string, os.Error) {
+	var result string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				return "", errBadContentLength
+			}
+			for i := 0; i < len(s); i++ {
+				if s[i] < '0' || s[i] > '9' {
+					return "", errBadContentLength
+				}
+			}
+			if _, err := strconv.Atoi(s); err != nil {
+				return "", errBadContentLength
+			}
+			if result != "" && s != result {
+				return "", errBadContentLength
+			}
+			result = s
+		}
+	}
+	if result == "" {
+		return "", errBadContentLength
+	}
+	return result, nil
+}
+
 func (t *transaction) prepare() (err os.Error) {
-	method, urlStr, version, err := readRequestLine(t.br)
+	method, urlStr, version, err := readRequestLine(t.br, t.server.StrictParsing)
 	if err != nil {
+		switch err {
+		case web.ErrLineTooLong:
+			t.parseErrorStatus = web.StatusRequestURITooLong
+		case errVersionNotSupported:
+			t.parseErrorStatus = web.StatusHTTPVersionNotSupported
+			t.parseErrorBody = true
+		case errBadRequestLine, errBadLineTerminator:
+			// The response does not have a body because the request's
+			// protocol version is not known.
+			t.parseErrorStatus = web.StatusBadRequest
+		}
 		return err
 	}
+	t.start = time.Nanoseconds()
 
 	header := web.Header{}
-	err = header.ParseHttpHeader(t.br)
+	t.headerParser = web.HeaderParser{
+		MaxLineSize:    t.server.MaxHeaderLineSize,
+		MaxValueSize:   t.server.MaxHeaderValueSize,
+		MaxHeaderCount: t.server.MaxHeaderCount,
+		MaxSize:        t.server.MaxHeaderSize,
+		Strict:         t.server.StrictParsing,
+	}
+	err = t.headerParser.ParseHttpHeader(t.br, header)
 	if err != nil {
+		switch err {
+		case web.ErrLineTooLong, web.ErrHeaderTooLong, web.ErrHeadersTooLong, web.ErrHeaderSizeExceeded:
+			t.parseErrorStatus = web.StatusRequestHeaderFieldsTooLarge
+		case web.ErrBadHeaderLine:
+			t.parseErrorStatus = web.StatusBadRequest
+		}
+		t.parseErrorBody = true
 		return err
 	}
 
-	u, err := url.Parse(urlStr)
+	if values, found := header[web.HeaderContentLength]; found {
+		s, err := checkContentLength(values)
+		if err != nil {
+			t.parseErrorStatus = web.StatusBadRequest
+			t.parseErrorBody = true
+			return err
+		}
+		header[web.HeaderContentLength] = []string{s}
+	}
+
+	// Reject requests that a proxy might frame differently from this server.
+	chunked := false
+	if te := header.GetList(web.HeaderTransferEncoding); len(te) > 0 {
+		if len(te) != 1 {
+			err = errBadTransferEncoding
+		} else {
+			switch strings.ToLower(te[0]) {
+			case "chunked":
+				chunked = true
+			case "identity":
+			default:
+				err = errBadTransferEncoding
+			}
+		}
+		if _, found := header[web.HeaderContentLength]; found {
+			err = errLengthAndTransferEncoding
+		}
+		if err != nil {
+			t.parseErrorStatus = web.StatusBadRequest
+			t.parseErrorBody = true
+			return err
+		}
+	}
+
+	// Reject GET and HEAD requests with a body. An intermediary that ignores
+	// the body would forward the body bytes as the next request.
+	if method == "GET" || method == "HEAD" {
+		_, te := header[web.HeaderTransferEncoding]
+		if cl, found := header[web.HeaderContentLength]; te || (found && cl[0] != "0") {
+			t.parseErrorStatus = web.StatusBadRequest
+			t.parseErrorBody = true
+			return errUnexpectedBody
+		}
+	}
+
+	var u *url.URL
+	switch {
+	case method == "CONNECT":
+		if !t.server.AllowConnect {
+			t.parseErrorStatus = web.StatusMethodNotAllowed
+			t.parseErrorBody = true
+			return errConnectNotAllowed
+		}
+		// The authority-form request target is the host and port of the
+		// tunnel destination.
+		if _, _, err = net.SplitHostPort(urlStr); err == nil {
+			u = &url.URL{Host: urlStr}
+		}
+	case urlStr == "*":
+		// The asterisk-form request target is used only with OPTIONS.
+		if method == "OPTIONS" {
+			u = &url.URL{Path: "*", RawPath: "*"}
+		} else {
+			err = errBadRequestTarget
+		}
+	default:
+		u, err = url.ParseRequest(urlStr)
+	}
+	if err == nil && u.Scheme != "" && (u.Host == "" || (u.Scheme != "http" && u.Scheme != "https")) {
+		err = errBadRequestTarget
+	}
 	if err != nil {
+		t.parseErrorStatus = web.StatusBadRequest
+		t.parseErrorBody = true
 		return err
 	}
 
-	if u.Host == "" {
+	if u.Host != "" {
+		// The host in an absolute-form or authority-form request target
+		// takes precedence over the Host header.
+		header.Set(web.HeaderHost, u.Host)
+	} else {
+		_, found := header[web.HeaderHost]
 		u.Host = header.Get(web.HeaderHost)
-		if u.Host == "" {
+		switch {
+		case !found && version >= web.ProtocolVersion(1, 1):
+			err = errMissingHost
+		case !validHost(u.Host):
+			err = errBadHost
+		case u.Host == "":
 			u.Host = t.server.DefaultHost
 		}
+		if err != nil {
+			t.parseErrorStatus = web.StatusBadRequest
+			t.parseErrorBody = true
+			return err
+		}
 	}
 
-	if t.server.Secure {
-		u.Scheme = "https"
-	} else {
-		u.Scheme = "http"
+	if u.Scheme == "" {
+		if t.secure {
+			u.Scheme = "https"
+		} else {
+			u.Scheme = "http"
+		}
 	}
 
-	req, err := web.NewRequest(t.conn.RemoteAddr().String(), method, u, version, header)
+	req, err := web.NewRequest(t.remoteAddr, method, u, version, header)
 	if err != nil {
 		return
 	}
 	t.req = req
 
-	if s := req.Header.Get(web.HeaderExpect); s != "" {
+	if s := req.Header.Get(web.HeaderExpect); s != "" && version >= web.ProtocolVersion(1, 1) {
 		t.write100Continue = strings.ToLower(s) == "100-continue"
 	}
 
-	connection := strings.ToLower(req.Header.Get(web.HeaderConnection))
 	if version >= web.ProtocolVersion(1, 1) {
-		t.closeAfterResponse = connection == "close"
+		t.closeAfterResponse = req.Header.HasToken(web.HeaderConnection, "close")
 	} else if version == web.ProtocolVersion(1, 0) && req.ContentLength >= 0 {
-		t.closeAfterResponse = connection != "keep-alive"
+		t.closeAfterResponse = !req.Header.HasToken(web.HeaderConnection, "keep-alive")
 	} else {
 		t.closeAfterResponse = true
 	}
 
 	req.Responder = t
 
-	te := header.GetList(web.HeaderTransferEncoding)
-	chunked := len(te) > 0 && te[0] == "chunked"
+	t.requestLimit = -1
+	if t.server.MaxRequestBodySize > 0 {
+		t.requestLimit = t.server.MaxRequestBodySize
+	}
 
 	switch {
 	case req.Method == "GET" || req.Method == "HEAD":
+		// The request does not have a body. See the check above.
 		req.Body = identityReader{t}
 		t.requestConsumed = true
 	case chunked:
 		req.Body = chunkedReader{t}
+		t.chunkedRequest = true
 	case req.ContentLength >= 0:
 		req.Body = identityReader{t}
 		t.requestAvail = req.ContentLength
 		t.requestConsumed = req.ContentLength == 0
+		if t.requestLimit >= 0 && req.ContentLength > t.requestLimit {
+			t.requestErr = web.ErrRequestEntityTooLarge
+		}
 	default:
 		req.Body = identityReader{t}
 		t.closeAfterResponse = true
@@ -257,7 +707,7 @@ func (t *transaction) prepare() (err os.Error) {
 func (t *transaction) checkRead() os.Error {
 	if t.requestErr != nil {
 		if t.requestErr == web.ErrInvalidState {
-			log.Println("twister: Request Read after response started.")
+			t.logf("request read after response started")
 		}
 		return t.requestErr
 	}
@@ -281,13 +731,24 @@ func (t identityReader) Read(p []byte) (int, os.Error) {
 	if len(p) > t.requestAvail {
 		p = p[:t.requestAvail]
 	}
-	var n int
-	n, t.requestErr = t.br.Read(p)
+	n, err := t.br.Read(p)
 	t.requestAvail -= n
 	if t.requestAvail == 0 {
-		t.requestConsumed = true
+		t.setRequestConsumed()
 	}
-	return n, t.requestErr
+	switch {
+	case err == os.EOF && t.requestAvail > 0:
+		err = io.ErrUnexpectedEOF
+	case err == os.EOF:
+		// Return os.EOF on the next call.
+		err = nil
+	}
+	t.requestErr = err
+	if n > 0 {
+		// Return the error, if any, on the next call.
+		return n, nil
+	}
+	return n, err
 }
 
 type chunkedReader struct{ *transaction }
@@ -299,132 +760,323 @@ func (t chunkedReader) Read(p []byte) (n int, err os.Error) {
 	if t.requestAvail == 0 {
 		// We delay reading the first chunk length to this point to ensure that
 		// we don't read the body until 100-continue is send (if needed).
-		t.requestAvail, t.requestErr = readChunkFraming(t.br, true)
+		t.requestAvail, t.requestErr = t.readChunkFraming(true)
+		if t.requestErr == nil {
+			t.requestErr = t.checkLimit()
+		}
 		if t.requestErr != nil {
-			return 0, t.requestErr
 			if t.requestErr == os.EOF {
-				t.requestConsumed = true
+				t.setRequestConsumed()
 			}
+			return 0, t.requestErr
 		}
 	}
 	if len(p) > t.requestAvail {
 		p = p[:t.requestAvail]
 	}
 	n, err = t.br.Read(p)
+	if err == os.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	t.requestErr = err
 	t.requestAvail -= n
 	if err == nil && t.requestAvail == 0 {
 		// We read the next chunk length here to ensure that the entire request
 		// body encoding is consumed in case where the application reads
 		// exactly the number of bytes in the decoded body.
-		t.requestAvail, t.requestErr = readChunkFraming(t.br, false)
+		t.requestAvail, t.requestErr = t.readChunkFraming(false)
+		if t.requestErr == nil {
+			t.requestErr = t.checkLimit()
+		}
 		if t.requestErr == os.EOF {
-			t.requestConsumed = true
+			t.setRequestConsumed()
+		}
+	}
+	if n > 0 {
+		// Return the error, if any, on the next call.
+		return n, nil
+	}
+	return n, err
+}
+
+// readChunkFraming reads the chunk framing and adds the declared trailers to
+// the request at the end of the body.
+func (t chunkedReader) readChunkFraming(first bool) (int, os.Error) {
+	trailer := web.Header{}
+	n, err := readChunkFraming(t.br, first, &t.headerParser, trailer)
+	if err == os.EOF {
+		for _, name := range t.req.Header.GetList(web.HeaderTrailer) {
+			name = web.HeaderName(name)
+			if values, found := trailer[name]; found {
+				t.req.Trailer[name] = values
+			}
 		}
 	}
 	return n, err
 }
 
-func readChunkFraming(br *bufio.Reader, first bool) (int, os.Error) {
+// checkLimit charges the current chunk against the request body size limit.
+func (t chunkedReader) checkLimit() os.Error {
+	if t.requestLimit < 0 {
+		return nil
+	}
+	if t.requestAvail > t.requestLimit {
+		return web.ErrRequestEntityTooLarge
+	}
+	t.requestLimit -= t.requestAvail
+	return nil
+}
+
+var errBadChunkedFormat = os.NewError("twister.server: bad chunked format")
+
+// Maximum size of chunk size line including extensions.
+const maxChunkLineSize = 4096
+
+// readChunkLine reads a line of chunked encoding framing.
+func readChunkLine(br *bufio.Reader) ([]byte, os.Error) {
+	line, isPrefix, err := br.ReadLine()
+	switch {
+	case err == os.EOF:
+		return nil, io.ErrUnexpectedEOF
+	case err != nil:
+		return nil, err
+	case isPrefix || len(line) > maxChunkLineSize:
+		return nil, errBadChunkedFormat
+	}
+	return line, nil
+}
+
+// readChunkFraming reads the framing before a chunk and returns the size of
+// the chunk. If the chunk is the last chunk, then the trailer is parsed to
+// trailer using hp and os.EOF is returned.
+func readChunkFraming(br *bufio.Reader, first bool, hp *web.HeaderParser, trailer web.Header) (int, os.Error) {
 	if !first {
-		// trailer from previous chunk
+		// CRLF following data in previous chunk.
 		p := make([]byte, 2)
 		if _, err := io.ReadFull(br, p); err != nil {
+			if err == os.EOF {
+				err = io.ErrUnexpectedEOF
+			}
 			return 0, err
 		}
-		if p[0] != '\r' && p[1] != '\n' {
-			return 0, os.NewError("twister: bad chunked format")
+		if p[0] != '\r' || p[1] != '\n' {
+			return 0, errBadChunkedFormat
 		}
 	}
 
-	line, isPrefix, err := br.ReadLine()
+	line, err := readChunkLine(br)
 	if err != nil {
 		return 0, err
 	}
-	if isPrefix {
-		return 0, os.NewError("twister: bad chunked format")
+
+	// Ignore chunk extensions.
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return 0, errBadChunkedFormat
 	}
+
 	n, err := strconv.Btoui64(string(line), 16)
-	if err != nil {
-		return 0, err
+	if err != nil || n > math.MaxInt32 {
+		return 0, errBadChunkedFormat
 	}
+
 	if n == 0 {
-		for {
-			line, isPrefix, err = br.ReadLine()
-			if err != nil {
-				return 0, err
-			}
-			if isPrefix {
-				return 0, os.NewError("twister: bad chunked format")
-			}
-			if len(line) == 0 {
-				return 0, os.EOF
-			}
+		if err := hp.ParseHttpHeader(br, trailer); err != nil {
+			return 0, err
 		}
+		return 0, os.EOF
 	}
 	return int(n), nil
 }
 
 func (t *transaction) Respond(status int, header web.Header) (body io.Writer) {
 	if t.hijacked {
-		log.Println("twister: Respond called on hijacked connection")
+		t.logf("Respond called on hijacked connection")
 		return &nullResponseBody{err: web.ErrInvalidState}
 	}
 	if t.respondCalled {
-		log.Println("twister: Multiple calls to Respond")
+		t.logf("multiple calls to Respond")
 		return &nullResponseBody{err: web.ErrInvalidState}
 	}
 	t.respondCalled = true
+	if status < web.StatusOK || status > 599 {
+		// The server owns interim responses.
+		t.logf("invalid response status %d", status)
+		status = web.StatusInternalServerError
+	}
+	for key := range header {
+		if !web.IsToken(key) {
+			t.logf("invalid response header name %q", key)
+			header[key] = nil, false
+		}
+	}
+	if !t.requestConsumed {
+		t.drainRequest = t.canDrain()
+	}
+	// Never send 100 Continue after the response starts. If the interim
+	// response was not sent, then canDrain returned false above and the
+	// connection is closed after the response.
+	t.write100Continue = false
 	t.requestErr = web.ErrInvalidState
 	t.status = status
 	t.header = header
 
 	if te := header.Get(web.HeaderTransferEncoding); te != "" {
-		log.Println("twister: transfer encoding not allowed")
+		t.logf("transfer encoding not allowed")
 		header[web.HeaderTransferEncoding] = nil, false
 	}
 
-	if !t.requestConsumed {
+	if !t.requestConsumed && !t.drainRequest {
 		t.closeAfterResponse = true
 	}
 
-	if header.Get(web.HeaderConnection) == "close" {
+	if header.HasToken(web.HeaderConnection, "close") || t.server.shuttingDown() {
 		t.closeAfterResponse = true
 	}
 
-	t.chunkedResponse = true
-	contentLength := -1
-
-	if status == web.StatusNotModified {
-		header[web.HeaderContentType] = nil, false
-		header[web.HeaderContentLength] = nil, false
-		t.chunkedResponse = false
-	} else if s := header.Get(web.HeaderContentLength); s != "" {
-		contentLength, _ = strconv.Atoi(s)
-		t.chunkedResponse = false
-	} else if t.req.ProtocolVersion < web.ProtocolVersion(1, 1) {
-		t.closeAfterResponse = true
-	}
+	var framing, contentLength int
+	framing, contentLength, t.closeAfterResponse = responseFraming(t.req.Method, t.req.ProtocolVersion, status, header, t.closeAfterResponse)
+	t.chunkedResponse = framing == framingChunked
 
 	if t.closeAfterResponse {
 		header.Set(web.HeaderConnection, "close")
-		t.chunkedResponse = false
 	}
 
-	if t.req.Method == "HEAD" {
-		t.chunkedResponse = false
+	if names := header.GetList(web.HeaderTrailer); len(names) > 0 && t.req.ResponseTrailer == nil {
+		// The handler declared trailers with the Trailer header. Create
+		// the trailer for the handler to set values before returning.
+		t.req.ResponseTrailer = make(web.Header)
+		for _, name := range names {
+			t.req.ResponseTrailer[web.HeaderName(name)] = []string{""}
+		}
+	}
+
+	var trailer web.Header
+	if len(t.req.ResponseTrailer) > 0 {
+		if t.chunkedResponse {
+			trailer = t.req.ResponseTrailer
+			names := make([]string, 0, len(trailer))
+			for name := range trailer {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			header.Set(web.HeaderTrailer, strings.Join(names, ", "))
+		} else {
+			t.logf("response trailers dropped from response that is not chunked")
+			header[web.HeaderTrailer] = nil, false
+		}
+	}
+
+	if _, found := header[web.HeaderDate]; !found {
+		header.Set(web.HeaderDate, httpDate())
+	}
+
+	if t.server.ServerHeader != "" {
+		if _, found := header[web.HeaderServer]; !found {
+			header.Set(web.HeaderServer, t.server.ServerHeader)
+		}
 	}
 
-	if t.chunkedResponse {
+	// Buffer the response to find the content length when the response
+	// would otherwise be chunked.
+	maxBuffered := t.server.maxBufferedResponseSize()
+	bufferResponse := t.chunkedResponse && trailer == nil && maxBuffered > 0
+
+	if t.chunkedResponse && !bufferResponse {
 		header.Set(web.HeaderTransferEncoding, "chunked")
 	}
 
+	const bufferSize = 4096
+	switch {
+	case framing == framingNone:
+		t.responseBody, _ = newNullResponseBody(t.conn, t.formatHeader())
+	case bufferResponse:
+		// The response to a HEAD request is buffered to find the same
+		// Content-Length as the response to a GET, but the body is
+		// discarded. If the handler writes no body for a HEAD request,
+		// then the length of the GET response is not known and the
+		// Content-Length header is omitted.
+		head := t.req.Method == "HEAD"
+		t.responseBody = newBufferedResponseBody(t.conn, bufferSize, maxBuffered, head, func(chunked bool, contentLength int) []byte {
+			switch {
+			case chunked:
+				header.Set(web.HeaderTransferEncoding, "chunked")
+			case !head || contentLength > 0:
+				header.Set(web.HeaderContentLength, strconv.Itoa(contentLength))
+			}
+			return t.formatHeader()
+		})
+	case t.req.Method == "HEAD":
+		// The response to a HEAD request has the same headers as the
+		// response to a GET, but the body is discarded.
+		t.responseBody, _ = newNullResponseBody(t.conn, t.formatHeader())
+	case framing == framingChunked:
+		t.responseBody, _ = newChunkedResponseBody(t.conn, t.formatHeader(), bufferSize, trailer)
+	default:
+		// framingLength or framingClose
+		t.responseBody, _ = newIdentityResponseBody(t.conn, t.formatHeader(), bufferSize, contentLength)
+	}
+	return t.responseBody
+}
+
+// Response body framing returned by responseFraming.
+const (
+	framingNone    = iota // the response does not have a body
+	framingLength         // the body is delimited by Content-Length
+	framingChunked        // the body is delimited by chunked encoding
+	framingClose          // the body is delimited by closing the connection
+)
+
+// responseFraming decides how the response body is delimited. The decision
+// is made in the following order:
+//
+//  status is 1xx, 204 or 304     no body
+//  Content-Length set            Content-Length
+//  HEAD request                  chunked for HTTP/1.1 keep-alive, no body otherwise
+//  HTTP/1.1 keep-alive           chunked
+//  otherwise                     close connection after body
+//
+// Content-Length is removed from the header when the status does not allow a
+// body and Content-Type is removed for status 304. The returned close value
+// is closeAfterResponse updated for the framing.
+func responseFraming(method string, version int, status int, header web.Header, closeAfterResponse bool) (framing int, contentLength int, close bool) {
+	switch {
+	case status < web.StatusOK || status == web.StatusNoContent:
+		header[web.HeaderContentLength] = nil, false
+		return framingNone, 0, closeAfterResponse
+	case status == web.StatusNotModified:
+		header[web.HeaderContentType] = nil, false
+		header[web.HeaderContentLength] = nil, false
+		return framingNone, 0, closeAfterResponse
+	}
+	if s := header.Get(web.HeaderContentLength); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			return framingLength, n, closeAfterResponse
+		}
+		header[web.HeaderContentLength] = nil, false
+	}
+	chunked := version >= web.ProtocolVersion(1, 1) && !closeAfterResponse
+	switch {
+	case method == "HEAD" && !chunked:
+		// No body to delimit.
+		return framingNone, 0, closeAfterResponse
+	case chunked:
+		return framingChunked, -1, closeAfterResponse
+	}
+	return framingClose, -1, true
+}
+
+// formatHeader returns the status line and header for the response.
+func (t *transaction) formatHeader() []byte {
 	proto := "HTTP/1.0"
 	if t.req.ProtocolVersion >= web.ProtocolVersion(1, 1) {
 		proto = "HTTP/1.1"
 	}
-	statusString := strconv.Itoa(status)
-	text := web.StatusText(status)
+	statusString := strconv.Itoa(t.status)
+	text := web.StatusText(t.status)
 
 	var b bytes.Buffer
 	b.WriteString(proto)
@@ -433,25 +1085,23 @@ func (t *transaction) Respond(status int, header web.Header) (body io.Writer) {
 	b.WriteString(" ")
 	b.WriteString(text)
 	b.WriteString("\r\n")
-	header.WriteHttpHeader(&b)
+	t.header.WriteHttpHeader(&b)
 	t.headerSize = b.Len()
-
-	const bufferSize = 4096
-	switch {
-	case t.req.Method == "HEAD":
-		t.responseBody, _ = newNullResponseBody(t.conn, b.Bytes())
-	case t.chunkedResponse:
-		t.responseBody, _ = newChunkedResponseBody(t.conn, b.Bytes(), bufferSize)
-	default:
-		t.responseBody, _ = newIdentityResponseBody(t.conn, b.Bytes(), bufferSize, contentLength)
-	}
-	return t.responseBody
+	return b.Bytes()
 }
 
+// The transaction is the request's responder.
+var (
+	_ web.Responder         = (*transaction)(nil)
+	_ web.DoneNotifier      = (*transaction)(nil)
+	_ web.RespondedReporter = (*transaction)(nil)
+)
+
 func (t *transaction) Hijack() (conn net.Conn, br *bufio.Reader, err os.Error) {
 	if t.respondCalled {
 		return nil, nil, web.ErrInvalidState
 	}
+	t.stopWatch()
 
 	conn = t.conn
 	br = t.br
@@ -461,6 +1111,7 @@ func (t *transaction) Hijack() (conn net.Conn, br *bufio.Reader, err os.Error) {
 			Request:  t.req,
 			Header:   t.header,
 			Hijacked: true,
+			Elapsed:  time.Nanoseconds() - t.start,
 		})
 	}
 
@@ -474,7 +1125,90 @@ func (t *transaction) Hijack() (conn net.Conn, br *bufio.Reader, err os.Error) {
 	return
 }
 
+func (t *transaction) Responded() bool {
+	return t.respondCalled || t.hijacked
+}
+
+// watchInterval is the read timeout in nanoseconds used by the goroutine
+// watching for the client to close the connection. The goroutine checks for
+// a request to stop after each timeout.
+const watchInterval = 1e8
+
+// Done returns a channel that is closed when the client closes the
+// connection. The server watches the connection after the request body is
+// read to EOF. The server stops watching the connection when the handler
+// returns or when the client sends more data on the connection. Errors
+// writing to the client are returned from the response body Write and Flush
+// methods.
+func (t *transaction) Done() <-chan bool {
+	if t.done == nil {
+		t.done = make(chan bool)
+		if t.requestConsumed {
+			t.startWatch()
+		}
+	}
+	return t.done
+}
+
+// setRequestConsumed records that the request body was read to EOF.
+func (t *transaction) setRequestConsumed() {
+	t.requestConsumed = true
+	if t.done != nil {
+		t.startWatch()
+	}
+}
+
+// startWatch starts a goroutine that closes t.done when a read on the
+// connection fails. The goroutine uses a short read timeout so that it can
+// be stopped by stopWatch.
+func (t *transaction) startWatch() {
+	if t.watchStop != nil || t.hijacked || t.conn == nil {
+		return
+	}
+	conn, br, done := t.conn, t.br, t.done
+	stop := make(chan bool, 1)
+	exit := make(chan bool)
+	t.watchStop, t.watchExit = stop, exit
+	conn.SetReadTimeout(watchInterval)
+	go func() {
+		defer close(exit)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, err := br.Peek(1)
+			switch {
+			case err == nil:
+				// The client sent the next request.
+				return
+			case isTimeout(err):
+				// Check for stop and read again.
+			default:
+				close(done)
+				return
+			}
+		}
+	}()
+}
+
+// stopWatch stops the goroutine started by startWatch and restores the
+// connection read timeout. The short read timeout set here wakes the
+// goroutine without waiting for the watch interval.
+func (t *transaction) stopWatch() {
+	if t.watchStop == nil {
+		return
+	}
+	t.watchStop <- true
+	t.conn.SetReadTimeout(1)
+	<-t.watchExit
+	t.watchStop, t.watchExit = nil, nil
+	t.conn.SetReadTimeout(t.server.ReadTimeout)
+}
+
 func (t *transaction) invokeHandler() {
+	defer t.req.Finish()
 	if !t.server.NoRecoverHandlers {
 		defer func() {
 			if r := recover(); r != nil {
@@ -483,17 +1217,138 @@ func (t *transaction) invokeHandler() {
 					urlStr = t.req.URL.String()
 				}
 				stack := string(debug.Stack())
-				log.Printf("Panic while serving \"%s\": %v\n%s", urlStr, r, stack)
+				t.logf("panic while serving %q: %v\n%s", urlStr, r, stack)
 				t.closeAfterResponse = true
+				if b, ok := t.responseBody.(*bufferedResponseBody); ok && b.reset() {
+					// Nothing was sent to the client. Replace the
+					// partial response with an error response.
+					t.respondCalled = false
+					t.responseBody = nil
+					t.req.ResponseTrailer = nil
+				}
+				if !t.respondCalled && !t.hijacked {
+					t.respondInternalServerError()
+				}
 			}
 		}()
 	}
+	if t.server.OptionsAllow != "" && t.req.Method == "OPTIONS" && t.req.URL.Path == "*" {
+		t.req.Respond(web.StatusOK, web.HeaderAllow, t.server.OptionsAllow, web.HeaderContentLength, "0")
+		return
+	}
 	t.server.Handler.ServeWeb(t.req)
 }
 
-// Finish the HTTP request
+// respondInternalServerError responds to the request with status 500 and
+// closes the connection after the response.
+func (t *transaction) respondInternalServerError() {
+	text := web.StatusText(web.StatusInternalServerError)
+	w := t.Respond(web.StatusInternalServerError, web.NewHeader(
+		web.HeaderContentType, "text/plain; charset=utf-8",
+		web.HeaderContentLength, strconv.Itoa(len(text)),
+		web.HeaderConnection, "close"))
+	io.WriteString(w, text)
+}
+
+// allow returns the Allow header value for responses to methods rejected by
+// the server.
+func (s *Server) allow() string {
+	if s.OptionsAllow != "" {
+		return s.OptionsAllow
+	}
+	return DefaultAllow
+}
+
+// maxDrainSize returns the maximum number of request body bytes to discard.
+func (s *Server) maxDrainSize() int {
+	if s.MaxDrainSize == 0 {
+		return DefaultMaxDrainSize
+	}
+	return s.MaxDrainSize
+}
+
+// maxBufferedResponseSize returns the maximum size of a buffered response
+// body.
+func (s *Server) maxBufferedResponseSize() int {
+	if s.MaxBufferedResponseSize == 0 {
+		return DefaultMaxBufferedResponseSize
+	}
+	return s.MaxBufferedResponseSize
+}
+
+// canDrain returns true if the unread request body can be discarded after the
+// response to keep the connection open.
+func (t *transaction) canDrain() bool {
+	max := t.server.maxDrainSize()
+	switch {
+	case max < 0:
+		return false
+	case t.write100Continue:
+		// The client is waiting for permission to send the body.
+		return false
+	case t.requestErr != nil:
+		return false
+	case t.chunkedRequest:
+		return true
+	}
+	return t.requestAvail <= max
+}
+
+// drainRequestBody discards the unread request body. It returns false if the
+// body could not be discarded.
+func (t *transaction) drainRequestBody() bool {
+	max := t.server.maxDrainSize()
+	if t.requestLimit < 0 || t.requestLimit > max {
+		t.requestLimit = max
+	}
+	t.requestErr = nil
+	var r io.Reader = identityReader{t}
+	if t.chunkedRequest {
+		r = chunkedReader{t}
+	}
+	_, err := io.Copy(ioutil.Discard, r)
+	t.requestErr = web.ErrInvalidState
+	return err == nil && t.requestConsumed
+}
+
+// writeParseError writes a minimal error response for a request that could
+// not be parsed.
+func (t *transaction) writeParseError() {
+	text := web.StatusText(t.parseErrorStatus)
+	var b bytes.Buffer
+	b.WriteString("HTTP/1.0 ")
+	b.WriteString(strconv.Itoa(t.parseErrorStatus))
+	b.WriteString(" ")
+	b.WriteString(text)
+	b.WriteString("\r\nConnection: close\r\nDate: ")
+	b.WriteString(httpDate())
+	b.WriteString("\r\n")
+	if t.server.ServerHeader != "" {
+		b.WriteString("Server: ")
+		b.WriteString(t.server.ServerHeader)
+		b.WriteString("\r\n")
+	}
+	if t.parseErrorStatus == web.StatusMethodNotAllowed {
+		b.WriteString("Allow: ")
+		b.WriteString(t.server.allow())
+		b.WriteString("\r\n")
+	}
+	if t.parseErrorBody {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Length: ")
+		b.WriteString(strconv.Itoa(len(text)))
+		b.WriteString("\r\n\r\n")
+		b.WriteString(text)
+	} else {
+		b.WriteString("\r\n")
+	}
+	t.conn.Write(b.Bytes())
+}
+
+// finish completes the response and logs the request. It returns the first
+// error encountered while writing the response.
 func (t *transaction) finish() os.Error {
 	if !t.respondCalled {
+		t.stopWatch()
 		urlStr := "unknown"
 		if t.req != nil && t.req.URL != nil {
 			urlStr = t.req.URL.String()
@@ -501,20 +1356,28 @@ func (t *transaction) finish() os.Error {
 		return os.NewError("twister: handler did not call respond while serving " + urlStr)
 	}
 	var written int
+	var err os.Error
 	if t.responseErr == nil {
-		written, t.responseErr = t.responseBody.finish()
+		written, err = t.responseBody.finish()
+		t.responseErr = err
 	}
+	// Stop watching the connection after the response is written so that
+	// the client does not wait for the watching goroutine.
+	t.stopWatch()
 	if t.responseErr != nil {
 		t.closeAfterResponse = true
 	} else {
 		t.responseErr = web.ErrInvalidState
 	}
+	if !t.closeAfterResponse && !t.requestConsumed && !t.drainRequestBody() {
+		t.closeAfterResponse = true
+	}
 	if t.server.Logger != nil {
-		err := t.responseErr
-		if err == web.ErrInvalidState {
-			err = t.requestErr
-			if err == web.ErrInvalidState {
-				err = nil
+		logErr := t.responseErr
+		if logErr == web.ErrInvalidState {
+			logErr = t.requestErr
+			if logErr == web.ErrInvalidState {
+				logErr = nil
 			}
 		}
 		t.server.Logger.Log(&LogRecord{
@@ -523,15 +1386,191 @@ func (t *transaction) finish() os.Error {
 			Header:     t.header,
 			HeaderSize: t.headerSize,
 			Status:     t.status,
-			Error:      err})
+			Error:      logErr,
+			Elapsed:    time.Nanoseconds() - t.start})
 	}
 	t.conn = nil
 	t.br = nil
 	t.responseBody = nil
-	return nil
+	return err
+}
+
+var dateCache struct {
+	mu  sync.Mutex
+	sec int64
+	s   string
 }
 
-func (s *Server) serveConnection(conn net.Conn) {
+// httpDate returns the current time formatted for the Date header. The
+// formatted value is cached for up to one second.
+func httpDate() string {
+	sec := time.Seconds()
+	dateCache.mu.Lock()
+	defer dateCache.mu.Unlock()
+	if sec != dateCache.sec {
+		dateCache.sec = sec
+		dateCache.s = time.SecondsToUTC(sec).Format(web.TimeLayout)
+	}
+	return dateCache.s
+}
+
+// logf logs an error encountered by the server.
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// logf logs an error encountered while serving the transaction.
+func (t *transaction) logf(format string, args ...interface{}) {
+	t.server.logf("twister: %s: "+format, append([]interface{}{t.remoteAddr}, args...)...)
+}
+
+// headerTimeoutError is returned from reads when the request line and header
+// are not read before the header deadline.
+type headerTimeoutError struct{}
+
+func (e headerTimeoutError) String() string  { return "twister.server: header read timeout" }
+func (e headerTimeoutError) Timeout() bool   { return true }
+func (e headerTimeoutError) Temporary() bool { return false }
+
+// deadlineReader reads from a connection. When a deadline is set, each read
+// uses a timeout for the time remaining before the deadline.
+type deadlineReader struct {
+	conn     net.Conn
+	deadline int64 // absolute time in nanoseconds or zero if not set
+	timeout  int64 // read timeout for the connection, zero if none
+}
+
+// setDeadline sets the deadline and the read timeout for the connection.
+// Clear the deadline by setting it to zero.
+func (r *deadlineReader) setDeadline(deadline int64, timeout int64) {
+	r.deadline = deadline
+	r.timeout = timeout
+	if deadline == 0 {
+		r.conn.SetReadTimeout(timeout)
+	}
+}
+
+func (r *deadlineReader) Read(p []byte) (int, os.Error) {
+	if r.deadline != 0 {
+		remaining := r.deadline - time.Nanoseconds()
+		if remaining <= 0 {
+			return 0, headerTimeoutError{}
+		}
+		if r.timeout != 0 && r.timeout < remaining {
+			remaining = r.timeout
+		}
+		r.conn.SetReadTimeout(remaining)
+		n, err := r.conn.Read(p)
+		if err != nil && isTimeout(err) && time.Nanoseconds() >= r.deadline {
+			err = headerTimeoutError{}
+		}
+		return n, err
+	}
+	return r.conn.Read(p)
+}
+
+// isTimeout returns true if err is a network timeout.
+func isTimeout(err os.Error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// addConn adds conn to the set of active connections. If the server is
+// shutting down, then addConn returns false.
+func (s *Server) addConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+	// The connection is idle until the client sends a request.
+	s.conns[conn] = true
+	s.wg.Add(1)
+	atomic.AddInt64(&s.Stats.Active, 1)
+	return true
+}
+
+// setIdle records whether conn is waiting for a request. If the server is
+// shutting down, then setIdle returns false.
+func (s *Server) setIdle(conn net.Conn, idle bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = idle
+	return !s.shutdown
+}
+
+// removeConn removes conn from the set of active connections.
+func (s *Server) removeConn(conn net.Conn) {
+	s.mu.Lock()
+	s.conns[conn] = false, false
+	s.mu.Unlock()
+	atomic.AddInt64(&s.Stats.Active, -1)
+	s.wg.Done()
+}
+
+// shuttingDown returns true if Shutdown has been called.
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdown
+}
+
+// Shutdown stops the server. Shutdown closes the listener, closes
+// connections waiting for a request and waits for active connections to
+// complete the current request. If timeout is greater than zero and
+// connections are still active after timeout nanoseconds, then Shutdown
+// closes the remaining connections. Responses written during shutdown
+// include the header "Connection: close".
+func (s *Server) Shutdown(timeout int64) os.Error {
+	s.mu.Lock()
+	s.shutdown = true
+	for conn, idle := range s.conns {
+		if idle {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	var err os.Error
+	for _, l := range s.allListeners() {
+		if e := l.listener.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	done := make(chan bool, 1)
+	go func() {
+		s.wg.Wait()
+		done <- true
+	}()
+
+	if timeout > 0 {
+		select {
+		case <-done:
+			return err
+		case <-time.After(timeout):
+		}
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+	}
+
+	<-done
+	return err
+}
+
+func (s *Server) serveConnection(conn net.Conn, secure bool) {
+	defer s.releaseSlot()
+	defer s.removeConn(conn)
 	defer conn.Close()
 	if s.ReadTimeout != 0 {
 		conn.SetReadTimeout(s.ReadTimeout)
@@ -539,25 +1578,115 @@ func (s *Server) serveConnection(conn net.Conn) {
 	if s.WriteTimeout != 0 {
 		conn.SetWriteTimeout(s.WriteTimeout)
 	}
-	br := bufio.NewReader(conn)
-	for {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// Complete the handshake here so that clients that do not speak
+		// TLS are disconnected without attempting to read a request.
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+	}
+	remoteAddr := conn.RemoteAddr().String()
+
+	// The reader must hold a complete header line including CRLF.
+	bufferSize := 4096
+	if s.MaxHeaderLineSize+2 > bufferSize {
+		bufferSize = s.MaxHeaderLineSize + 2
+	}
+	dr := &deadlineReader{conn: conn}
+	br, err := bufio.NewReaderSize(dr, bufferSize)
+	if err != nil {
+		s.logf("twister: %s: reader allocation failed: %v", remoteAddr, err)
+		return
+	}
+	if s.AcceptProxyProtocol {
+		addr, err := readProxyLine(br)
+		if err != nil {
+			if err != os.EOF && !isTimeout(err) {
+				s.logf("twister: %s: %v", remoteAddr, err)
+			}
+			return
+		}
+		if addr != "" {
+			remoteAddr = addr
+		}
+	}
+	for n := 1; ; n++ {
+		// Mark the connection idle while waiting for the request so that
+		// Shutdown closes connections where the client does not send a
+		// request.
+		if !s.setIdle(conn, true) {
+			break
+		}
+		first := n == 1
+		if !first && s.IdleTimeout != 0 {
+			// Wait for the next request using the idle timeout.
+			conn.SetReadTimeout(s.IdleTimeout)
+			if _, err := br.Peek(1); err != nil {
+				break
+			}
+			conn.SetReadTimeout(s.ReadTimeout)
+		} else if s.ReadTimeout != 0 {
+			// Rearm timeouts for each request on the connection.
+			conn.SetReadTimeout(s.ReadTimeout)
+		}
+		if s.HeaderReadTimeout != 0 {
+			// Start the header deadline when the first byte of the request
+			// arrives.
+			if _, err := br.Peek(1); err != nil {
+				break
+			}
+			dr.setDeadline(time.Nanoseconds()+s.HeaderReadTimeout, s.ReadTimeout)
+		}
 		t := &transaction{
-			server: s,
-			conn:   conn,
-			br:     br}
-		if err := t.prepare(); err != nil {
-			if err != os.EOF {
-				log.Println("twister: prepare failed", err)
+			server:     s,
+			conn:       conn,
+			remoteAddr: remoteAddr,
+			secure:     secure,
+			br:         br}
+		err := t.prepare()
+		if deadline := dr.deadline; deadline != 0 {
+			dr.setDeadline(0, s.ReadTimeout)
+			if err != nil && time.Nanoseconds() >= deadline {
+				t.parseErrorStatus = web.StatusRequestTimeout
+			}
+		}
+		if err != nil {
+			if err != os.EOF && !s.shuttingDown() {
+				atomic.AddInt64(&s.Stats.ReadErrors, 1)
+				if !isTimeout(err) {
+					t.logf("prepare failed: %v", err)
+				}
+			}
+			if t.parseErrorStatus != 0 {
+				t.writeParseError()
 			}
 			break
 		}
+		s.setIdle(conn, false)
+		atomic.AddInt64(&s.Stats.Requests, 1)
+		if s.MaxRequestsPerConn > 0 && n >= s.MaxRequestsPerConn {
+			t.closeAfterResponse = true
+		}
 
+		if s.WriteTimeout != 0 {
+			conn.SetWriteTimeout(s.WriteTimeout)
+		}
+		if t.requestErr == web.ErrRequestEntityTooLarge {
+			// The declared Content-Length exceeds the limit. Reject the
+			// request without calling the handler.
+			t.Respond(web.StatusRequestEntityTooLarge,
+				web.NewHeader(web.HeaderContentLength, "0", web.HeaderConnection, "close"))
+			t.finish()
+			break
+		}
 		t.invokeHandler()
 		if t.hijacked {
+			atomic.AddInt64(&s.Stats.Hijacked, 1)
 			return
 		}
 		if err := t.finish(); err != nil {
-			log.Println("twister: finish failed", err)
+			atomic.AddInt64(&s.Stats.WriteErrors, 1)
+			t.logf("finish failed: %v", err)
 			break
 		}
 		if t.closeAfterResponse {
@@ -566,9 +1695,11 @@ func (s *Server) serveConnection(conn net.Conn) {
 	}
 }
 
-// Serve accepts incoming HTTP connections on s.Listener, creating a new
-// goroutine for each. The goroutines read requests and then call s.Handler to
-// respond to the request.
+// Serve accepts incoming HTTP connections on s.Listener and the listeners
+// added with AddListener, creating a new goroutine for each connection. The
+// goroutines read requests and then call s.Handler to respond to the request.
+// Serve returns nil after a call to s.Shutdown(). If accepting on a listener
+// fails, then Serve closes all listeners and returns the error.
 //
 // The "Hello World" server using Serve() is:
 //
@@ -600,29 +1731,246 @@ func (s *Server) serveConnection(conn net.Conn) {
 //      }
 //  }
 func (s *Server) Serve() os.Error {
+	if s.MaxConcurrentConnections > 0 {
+		s.sem = make(chan bool, s.MaxConcurrentConnections)
+	}
+	listeners := s.allListeners()
+	if len(listeners) == 0 {
+		return os.NewError("twister.server: no listener")
+	}
+	if len(listeners) == 1 {
+		return s.acceptConnections(listeners[0])
+	}
+	errs := make(chan os.Error, len(listeners))
+	for _, l := range listeners {
+		go func(l serverListener) {
+			errs <- s.acceptConnections(l)
+		}(l)
+	}
+	var err os.Error
+	for _ = range listeners {
+		if e := <-errs; e != nil && err == nil {
+			// Stop accepting on the other listeners.
+			err = e
+			for _, l := range listeners {
+				l.listener.Close()
+			}
+		}
+	}
+	return err
+}
+
+// AddListener adds a listener to the server. The server accepts connections
+// on the listener in addition to s.Listener. If secure is true, then the
+// request URL protocol is set to HTTPS for requests on the listener. Use
+// TLSListener to create a secure listener that sets the server's TCP
+// options. AddListener must be called before Serve.
+func (s *Server) AddListener(l net.Listener, secure bool) {
+	s.listeners = append(s.listeners, serverListener{l, secure})
+}
+
+// allListeners returns s.Listener and the listeners added with AddListener.
+func (s *Server) allListeners() []serverListener {
+	var listeners []serverListener
+	if s.Listener != nil {
+		listeners = append(listeners, serverListener{s.Listener, s.Secure})
+	}
+	return append(listeners, s.listeners...)
+}
+
+// acceptConnections accepts connections on l until the listener is closed or
+// an error is encountered. The connection slot is acquired after Accept
+// returns so that an idle listener does not hold a slot needed by another
+// listener.
+func (s *Server) acceptConnections(l serverListener) os.Error {
 	for {
-		conn, e := s.Listener.Accept()
+		conn, e := l.listener.Accept()
 		if e != nil {
+			if s.shuttingDown() {
+				return nil
+			}
 			if e, ok := e.(net.Error); ok && e.Temporary() {
-				log.Printf("twister.server: accept error %v", e)
+				s.logf("twister: accept error: %v", e)
 				continue
 			}
 			return e
 		}
-		go s.serveConnection(conn)
+		atomic.AddInt64(&s.Stats.Accepted, 1)
+		s.setTCPOptions(conn)
+		if s.sem != nil {
+			if s.RejectExcessConnections {
+				select {
+				case s.sem <- true:
+				default:
+					if s.addConn(conn) {
+						go s.rejectConnection(conn)
+					} else {
+						conn.Close()
+					}
+					continue
+				}
+			} else {
+				// Apply backpressure by not accepting more connections on
+				// this listener until a slot is available.
+				s.sem <- true
+			}
+		}
+		if !s.addConn(conn) {
+			s.releaseSlot()
+			conn.Close()
+			continue
+		}
+		go s.serveConnection(conn, l.secure)
 	}
 	return nil
 }
 
-// Run is a convenience function for running an HTTP server. Run listens on the
-// TCP address addr, initializes a server object and calls the server's Serve()
-// method to handle HTTP requests. Run logs a fatal error if it encounters an
+// tcpOptionSetter is implemented by *net.TCPConn.
+type tcpOptionSetter interface {
+	SetKeepAlive(keepalive bool) os.Error
+	SetNoDelay(noDelay bool) os.Error
+}
+
+// setTCPOptions sets the keep-alive and no-delay options on TCP connections.
+// Other connection types are not modified.
+func (s *Server) setTCPOptions(conn net.Conn) {
+	switch conn := conn.(type) {
+	case tcpOptionSetter:
+		if !s.NoTCPKeepAlive {
+			if err := conn.SetKeepAlive(true); err != nil {
+				s.logf("twister: set keep-alive: %v", err)
+			}
+		}
+		if !s.NoTCPNoDelay {
+			if err := conn.SetNoDelay(true); err != nil {
+				s.logf("twister: set no delay: %v", err)
+			}
+		}
+	}
+}
+
+// releaseSlot releases a connection slot acquired in Serve.
+func (s *Server) releaseSlot() {
+	if s.sem != nil {
+		<-s.sem
+	}
+}
+
+const (
+	// Maximum time in nanoseconds to read from a rejected connection before
+	// closing the connection.
+	rejectLingerTime = 1e9
+
+	// Maximum number of bytes to read from a rejected connection before
+	// closing the connection.
+	maxRejectLingerSize = 64 * 1024
+)
+
+// rejectConnection responds with status 503 and closes the connection. The
+// connection was added with addConn so that Shutdown waits for the response.
+// Before closing the connection, rejectConnection reads and discards the
+// request for a short time. Closing a connection with unread data can reset
+// the connection before the client reads the response.
+func (s *Server) rejectConnection(conn net.Conn) {
+	defer s.removeConn(conn)
+	defer conn.Close()
+	if s.WriteTimeout != 0 {
+		conn.SetWriteTimeout(s.WriteTimeout)
+	}
+	var server string
+	if s.ServerHeader != "" {
+		server = "Server: " + s.ServerHeader + "\r\n"
+	}
+	_, err := io.WriteString(conn, "HTTP/1.0 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 0\r\nDate: "+httpDate()+"\r\n"+server+"\r\n")
+	if err != nil {
+		return
+	}
+	if cw, ok := conn.(interface {
+		CloseWrite() os.Error
+	}); ok {
+		cw.CloseWrite()
+	}
+	deadline := time.Nanoseconds() + rejectLingerTime
+	conn.SetReadTimeout(rejectLingerTime)
+	var p [512]byte
+	for n := 0; n < maxRejectLingerSize && time.Nanoseconds() < deadline; {
+		m, err := conn.Read(p[:])
+		if err != nil {
+			break
+		}
+		n += m
+	}
+}
+
+// ListenAndServe listens on the TCP network address addr, sets s.Listener to
+// the new listener and calls s.Serve() to handle requests. The listener is
+// closed when Serve returns.
+func (s *Server) ListenAndServe(addr string) os.Error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	s.Listener = listener
+	return s.Serve()
+}
+
+// tcpOptionsListener sets the server's TCP options on accepted connections.
+type tcpOptionsListener struct {
+	net.Listener
+	s *Server
+}
+
+func (l tcpOptionsListener) Accept() (net.Conn, os.Error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.s.setTCPOptions(conn)
+	}
+	return conn, err
+}
+
+// TLSListener returns a TLS listener wrapping l. The server's TCP options are
+// set on the connections accepted from l before the TLS connections are
+// created.
+func (s *Server) TLSListener(l net.Listener, config *tls.Config) net.Listener {
+	return tls.NewListener(tcpOptionsListener{l, s}, config)
+}
+
+// ServeTLS sets s.Listener to a TLS listener wrapping s.Listener, sets
+// s.Secure to true and calls s.Serve() to handle requests.
+func (s *Server) ServeTLS(config *tls.Config) os.Error {
+	s.Listener = s.TLSListener(s.Listener, config)
+	s.Secure = true
+	return s.Serve()
+}
+
+// ListenAndServeTLS listens on the TCP network address addr and calls
+// s.ServeTLS() with a configuration using the certificate and private key in
+// certFile and keyFile. The listener is closed when Serve returns.
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) os.Error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return os.NewError("twister.server: could not load certificate and key: " + err.String())
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	s.Listener = listener
+	return s.ServeTLS(config)
+}
+
+// Run is a convenience function for running an HTTP server. Run initializes a
+// server object and calls the server's ListenAndServe() method to handle HTTP
+// requests on the TCP address addr. Run logs a fatal error if it encounters an
 // error.
 //
-// The Server object is initialized with the handler argument and listener. If
-// the application needs to set any other Server fields or if the application
+// The Server object is initialized with the handler argument. If the
+// application needs to set any other Server fields or if the application
 // needs to create the listener, then the application should directly create
-// the Server object and call the Serve() method.
+// the Server object and call the ListenAndServe() or Serve() method.
 //
 // The "Hello World" server using Run() is:
 //
@@ -644,13 +1992,17 @@ func (s *Server) Serve() os.Error {
 //  }
 //
 func Run(addr string, handler web.Handler) {
-	listener, err := net.Listen("tcp", addr)
+	err := (&Server{Logger: LoggerFunc(ShortLogger), Handler: handler, ServerHeader: DefaultServerHeader}).ListenAndServe(addr)
 	if err != nil {
-		log.Fatal("Listen", err)
-		return
+		log.Fatal("Server", err)
 	}
-	defer listener.Close()
-	err = (&Server{Logger: LoggerFunc(ShortLogger), Listener: listener, Handler: handler}).Serve()
+}
+
+// RunTLS is a convenience function for running an HTTPS server. RunTLS is
+// identical to Run except that RunTLS calls the server's ListenAndServeTLS()
+// method with the certificate and private key in certFile and keyFile.
+func RunTLS(addr, certFile, keyFile string, handler web.Handler) {
+	err := (&Server{Logger: LoggerFunc(ShortLogger), Handler: handler, ServerHeader: DefaultServerHeader}).ListenAndServeTLS(addr, certFile, keyFile)
 	if err != nil {
 		log.Fatal("Server", err)
 	}
@@ -0,0 +1,85 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"github.com/garyburd/twister/web"
+	"json"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// Stats counts server activity. The server updates the fields atomically.
+// Use Snapshot to read the fields. The fields must be 64-bit aligned on
+// 32-bit platforms: allocate a Stats value separately or place it first in a
+// struct.
+type Stats struct {
+	// Number of connections accepted.
+	Accepted int64
+
+	// Number of open connections.
+	Active int64
+
+	// Number of requests read.
+	Requests int64
+
+	// Number of requests that could not be read or parsed.
+	ReadErrors int64
+
+	// Number of responses that could not be written.
+	WriteErrors int64
+
+	// Number of connections hijacked by handlers.
+	Hijacked int64
+}
+
+// Snapshot returns a copy of the counters.
+func (s *Stats) Snapshot() Stats {
+	return Stats{
+		Accepted:    atomic.AddInt64(&s.Accepted, 0),
+		Active:      atomic.AddInt64(&s.Active, 0),
+		Requests:    atomic.AddInt64(&s.Requests, 0),
+		ReadErrors:  atomic.AddInt64(&s.ReadErrors, 0),
+		WriteErrors: atomic.AddInt64(&s.WriteErrors, 0),
+		Hijacked:    atomic.AddInt64(&s.Hijacked, 0),
+	}
+}
+
+// MarshalJSON returns the JSON encoding of a snapshot of the counters. The
+// method allows the counters to be published with the expvar package.
+func (s *Stats) MarshalJSON() ([]byte, os.Error) {
+	return json.Marshal(s.Snapshot())
+}
+
+// StatsHandler returns a handler that responds with the JSON encoding of a
+// snapshot of the counters. The application should wrap the handler with
+// appropriate access control.
+//
+//  s := &server.Server{...}
+//  router.Register("/debug/stats", "GET", server.StatsHandler(&s.Stats))
+func StatsHandler(stats *Stats) web.Handler {
+	return web.HandlerFunc(func(req *web.Request) {
+		p, err := stats.MarshalJSON()
+		if err != nil {
+			req.Error(web.StatusInternalServerError, err)
+			return
+		}
+		w := req.Respond(web.StatusOK,
+			web.HeaderContentType, "application/json; charset=utf-8",
+			web.HeaderContentLength, strconv.Itoa(len(p)))
+		w.Write(p)
+	})
+}
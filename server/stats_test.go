@@ -0,0 +1,50 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"github.com/garyburd/twister/web"
+	"json"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	log.SetOutput(silentLogger{t})
+	defer log.SetOutput(os.Stdout)
+	s := &Server{Handler: web.HandlerFunc(testHandler)}
+	serveTest(t, s, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\nGET / HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\nHost\r\n\r\n")
+	stats := s.Stats.Snapshot()
+	if stats.Accepted != 1 || stats.Requests != 2 || stats.ReadErrors != 1 || stats.WriteErrors != 0 || stats.Hijacked != 0 {
+		t.Errorf("stats = %+v, want Accepted: 1, Requests: 2, ReadErrors: 1", stats)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	stats := &Stats{Accepted: 3, Active: 1, Requests: 10}
+	status, header, body := web.RunHandler("/debug/stats", "GET", nil, nil, StatsHandler(stats))
+	if status != web.StatusOK || header.Get(web.HeaderContentType) != "application/json; charset=utf-8" {
+		t.Fatalf("status = %d, header = %v", status, header)
+	}
+	var got Stats
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("json.Unmarshal(%q) = %v", body, err)
+	}
+	if !reflect.DeepEqual(got, *stats) {
+		t.Errorf("got %+v, want %+v", got, *stats)
+	}
+}
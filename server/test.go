@@ -0,0 +1,182 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"io/ioutil"
+	"net"
+	"os"
+)
+
+type runListener struct {
+	in, out  bytes.Buffer
+	accepted bool
+	done     chan bool
+}
+
+func (l *runListener) Accept() (net.Conn, os.Error) {
+	if l.accepted {
+		return nil, os.EOF
+	}
+	l.accepted = true
+	return runConn{l}, nil
+}
+
+func (l *runListener) Close() os.Error {
+	return nil
+}
+
+func (l *runListener) Addr() net.Addr {
+	return runAddr("127.0.0.1:8080")
+}
+
+type runConn struct {
+	*runListener
+}
+
+func (c runConn) Read(b []byte) (int, os.Error) {
+	return c.in.Read(b)
+}
+
+func (c runConn) Write(b []byte) (int, os.Error) {
+	return c.out.Write(b)
+}
+
+func (c runConn) Close() os.Error {
+	c.done <- true
+	return nil
+}
+
+func (c runConn) LocalAddr() net.Addr {
+	return runAddr("127.0.0.1:8080")
+}
+
+func (c runConn) RemoteAddr() net.Addr {
+	return runAddr("1.2.3.4:1234")
+}
+
+func (c runConn) SetTimeout(nsec int64) os.Error {
+	return nil
+}
+
+func (c runConn) SetReadTimeout(nsec int64) os.Error {
+	return nil
+}
+
+func (c runConn) SetWriteTimeout(nsec int64) os.Error {
+	return nil
+}
+
+type runAddr string
+
+func (a runAddr) Network() string {
+	return "tcp"
+}
+
+func (a runAddr) String() string {
+	return string(a)
+}
+
+// RunRequest serves the raw HTTP request data in with server s and returns
+// the raw data written by the server. The request data is parsed by the
+// server, so the data can contain malformed requests and more than one
+// request. RunRequest sets s.Listener to a listener that accepts a single
+// connection and returns after the server closes the connection. This
+// function is intended to be used in tests.
+func RunRequest(s *Server, in []byte) []byte {
+	l := &runListener{done: make(chan bool, 1)}
+	l.in.Write(in)
+	s.Listener = l
+	s.Serve()
+	<-l.done
+	return l.out.Bytes()
+}
+
+// TestServer is an HTTP server listening on a loopback address. TestServer
+// is intended to be used in integration tests.
+type TestServer struct {
+	// Base URL of the server in the form http://ipaddr:port with no trailing
+	// slash.
+	URL string
+
+	// The server. To configure the server, create the test server with
+	// NewUnstartedTestServer and set fields on the server before calling
+	// Start.
+	Server *Server
+
+	done chan bool
+}
+
+// NewTestServer starts and returns a new TestServer serving handler. The
+// caller should call Close when done to shut down the server. NewTestServer
+// panics if it cannot listen on a loopback address.
+func NewTestServer(handler web.Handler) *TestServer {
+	ts := NewUnstartedTestServer(handler)
+	ts.Start()
+	return ts
+}
+
+// NewUnstartedTestServer returns a new TestServer serving handler, but does
+// not start the server. The caller should call Start after configuring the
+// server and Close when done. NewUnstartedTestServer panics if it cannot
+// listen on a loopback address.
+func NewUnstartedTestServer(handler web.Handler) *TestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("twister.server: failed to listen on a loopback address: " + err.String())
+	}
+	return &TestServer{
+		URL:    "http://" + l.Addr().String(),
+		Server: &Server{Listener: l, Handler: handler},
+		done:   make(chan bool, 1),
+	}
+}
+
+// Start starts the server returned from NewUnstartedTestServer.
+func (ts *TestServer) Start() {
+	go func() {
+		ts.Server.Serve()
+		ts.done <- true
+	}()
+}
+
+// Close closes the listener and waits for active connections to complete.
+func (ts *TestServer) Close() {
+	ts.Server.Shutdown(0)
+	<-ts.done
+}
+
+// Addr returns the network address of the server.
+func (ts *TestServer) Addr() string {
+	return ts.Server.Listener.Addr().String()
+}
+
+// RawRequest opens a connection to the server, writes the raw HTTP request
+// data b and returns the data read from the connection until the server
+// closes the connection. The request data is parsed by the server, so the
+// data can contain malformed requests and more than one request.
+func (ts *TestServer) RawRequest(b []byte) ([]byte, os.Error) {
+	c, err := net.Dial("tcp", ts.Addr())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(c)
+}
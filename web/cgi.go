@@ -0,0 +1,217 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"url"
+)
+
+// NewCGIRequest returns a request initialized from the CGI meta-variables in
+// env. The meta-variables are defined in RFC 3875. The request method, URL,
+// protocol version, remote address and header are set from the variables.
+// The caller sets the request Body and Responder. This function is intended
+// to be used by adapters for CGI and related protocols such as FastCGI and
+// SCGI.
+func NewCGIRequest(env map[string]string) (*Request, os.Error) {
+	method := env["REQUEST_METHOD"]
+	if method == "" {
+		return nil, os.NewError("twister: missing REQUEST_METHOD")
+	}
+
+	header := make(Header)
+	for name, value := range env {
+		// HTTP_PROXY is set by some clients to change the proxy used by the
+		// application. It is never a request header.
+		if strings.HasPrefix(name, "HTTP_") && name != "HTTP_PROXY" {
+			header.Add(HeaderName(strings.Replace(name[len("HTTP_"):], "_", "-", -1)), value)
+		}
+	}
+	if s := env["CONTENT_TYPE"]; s != "" {
+		header.Set(HeaderContentType, s)
+	}
+	if s := env["CONTENT_LENGTH"]; s != "" {
+		header.Set(HeaderContentLength, s)
+	}
+
+	version := ProtocolVersion10
+	if s := env["SERVER_PROTOCOL"]; strings.HasPrefix(s, "HTTP/") {
+		if i := strings.Index(s, "."); i > 0 {
+			major, err1 := strconv.Atoi(s[len("HTTP/"):i])
+			minor, err2 := strconv.Atoi(s[i+1:])
+			if err1 == nil && err2 == nil {
+				version = ProtocolVersion(major, minor)
+			}
+		}
+	}
+
+	uri := env["REQUEST_URI"]
+	if uri == "" {
+		uri = escapeCGIPath(env["SCRIPT_NAME"] + env["PATH_INFO"])
+		if q := env["QUERY_STRING"]; q != "" {
+			uri += "?" + q
+		}
+	}
+	u, err := url.ParseRequest(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Scheme = "http"
+	defaultPort := "80"
+	if s := strings.ToLower(env["HTTPS"]); s == "on" || s == "1" {
+		u.Scheme = "https"
+		defaultPort = "443"
+	}
+
+	u.Host = header.Get(HeaderHost)
+	if u.Host == "" {
+		u.Host = env["SERVER_NAME"]
+		if port := env["SERVER_PORT"]; port != "" && port != defaultPort {
+			u.Host = net.JoinHostPort(u.Host, port)
+		}
+	}
+
+	remoteAddr := env["REMOTE_ADDR"]
+	if port := env["REMOTE_PORT"]; port != "" && remoteAddr != "" {
+		remoteAddr = net.JoinHostPort(remoteAddr, port)
+	}
+
+	return NewRequest(remoteAddr, method, u, version, header)
+}
+
+// escapeCGIPath escapes the decoded path from the SCRIPT_NAME and PATH_INFO
+// variables for use in a request URI.
+func escapeCGIPath(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			b = append(b, c)
+		case strings.IndexRune("-_.~/!$&'()*+,;=:@", int(c)) >= 0:
+			b = append(b, c)
+		default:
+			b = append(b, '%', hex[c>>4], hex[c&0xf])
+		}
+	}
+	return string(b)
+}
+
+var errCGIHijack = os.NewError("twister: hijack not supported by CGI responder")
+
+// CGIResponder is a responder that writes the response in the CGI format
+// defined in RFC 3875. The response status is written as the Status header
+// field in place of the HTTP status line. This type is intended to be used by
+// adapters for CGI and related protocols such as FastCGI and SCGI.
+type CGIResponder struct {
+	bw            *bufio.Writer
+	respondCalled bool
+}
+
+var (
+	_ Responder         = (*CGIResponder)(nil)
+	_ RespondedReporter = (*CGIResponder)(nil)
+)
+
+// NewCGIResponder returns a responder that writes the response to bw. The
+// caller flushes bw after the handler returns.
+func NewCGIResponder(bw *bufio.Writer) *CGIResponder {
+	return &CGIResponder{bw: bw}
+}
+
+// cgiResponseBody is the writer returned from CGIResponder.Respond.
+type cgiResponseBody struct {
+	bw *bufio.Writer
+}
+
+func (b cgiResponseBody) Write(p []byte) (int, os.Error) {
+	return b.bw.Write(p)
+}
+
+func (b cgiResponseBody) Flush() os.Error {
+	return b.bw.Flush()
+}
+
+// nullResponseBody is returned from Respond when the response cannot be
+// written.
+type nullResponseBody struct {
+	err os.Error
+}
+
+func (b nullResponseBody) Write(p []byte) (int, os.Error) {
+	return 0, b.err
+}
+
+func (r *CGIResponder) Respond(status int, header Header) io.Writer {
+	if r.respondCalled {
+		log.Println("twister: multiple calls to Respond")
+		return nullResponseBody{ErrInvalidState}
+	}
+	r.respondCalled = true
+	r.bw.WriteString("Status: " + strconv.Itoa(status) + " " + StatusText(status) + "\r\n")
+	header.WriteHttpHeader(r.bw)
+	return cgiResponseBody{r.bw}
+}
+
+func (r *CGIResponder) Hijack() (net.Conn, *bufio.Reader, os.Error) {
+	return nil, nil, errCGIHijack
+}
+
+func (r *CGIResponder) Responded() bool {
+	return r.respondCalled
+}
+
+// InvokeHandler calls handler with req and then finishes the request. If the
+// handler panics before responding or returns without responding, then
+// InvokeHandler responds with status 500. The caller sets req.Responder to r
+// or to a responder that forwards to r.
+func (r *CGIResponder) InvokeHandler(req *Request, handler Handler) {
+	r.invokeHandler(req, handler)
+	if !r.respondCalled {
+		log.Println("twister: handler did not call respond while serving", req.URL)
+		r.respondInternalServerError()
+	}
+}
+
+func (r *CGIResponder) invokeHandler(req *Request, handler Handler) {
+	defer req.Finish()
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("twister: panic while serving %q: %v\n%s", req.URL.String(), v, debug.Stack())
+			if !r.respondCalled {
+				r.respondInternalServerError()
+			}
+		}
+	}()
+	handler.ServeWeb(req)
+}
+
+// respondInternalServerError responds to the request with status 500.
+func (r *CGIResponder) respondInternalServerError() {
+	text := StatusText(StatusInternalServerError)
+	w := r.Respond(StatusInternalServerError, NewHeader(
+		HeaderContentType, "text/plain; charset=utf-8",
+		HeaderContentLength, strconv.Itoa(len(text))))
+	io.WriteString(w, text)
+}
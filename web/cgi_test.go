@@ -0,0 +1,168 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+var newCGIRequestTests = []struct {
+	env        map[string]string
+	scheme     string
+	host       string
+	path       string
+	query      string
+	remoteAddr string
+	version    int
+	header     Header
+}{
+	{
+		map[string]string{
+			"REQUEST_METHOD":  "GET",
+			"SERVER_PROTOCOL": "HTTP/1.1",
+			"REQUEST_URI":     "/a%20b?x=1",
+			"HTTP_HOST":       "example.com",
+			"HTTP_USER_AGENT": "test",
+			"REMOTE_ADDR":     "1.2.3.4",
+			"REMOTE_PORT":     "1234",
+		},
+		"http", "example.com", "/a b", "x=1", "1.2.3.4:1234", ProtocolVersion11,
+		Header{HeaderHost: []string{"example.com"}, HeaderUserAgent: []string{"test"}},
+	},
+	{
+		map[string]string{
+			"REQUEST_METHOD": "POST",
+			"SCRIPT_NAME":    "/app",
+			"PATH_INFO":      "/a b",
+			"QUERY_STRING":   "x=1",
+			"SERVER_NAME":    "example.com",
+			"SERVER_PORT":    "8443",
+			"HTTPS":          "on",
+			"CONTENT_TYPE":   "text/plain",
+			"CONTENT_LENGTH": "5",
+			"HTTP_PROXY":     "evil.example.com",
+		},
+		"https", "example.com:8443", "/app/a b", "x=1", "", ProtocolVersion10,
+		Header{HeaderContentType: []string{"text/plain"}, HeaderContentLength: []string{"5"}},
+	},
+	{
+		map[string]string{
+			"REQUEST_METHOD":  "GET",
+			"SERVER_PROTOCOL": "HTTP/1.0",
+			"SCRIPT_NAME":     "/",
+			"SERVER_NAME":     "example.com",
+			"SERVER_PORT":     "80",
+		},
+		"http", "example.com", "/", "", "", ProtocolVersion10,
+		Header{},
+	},
+}
+
+func TestNewCGIRequest(t *testing.T) {
+	for _, tt := range newCGIRequestTests {
+		req, err := NewCGIRequest(tt.env)
+		if err != nil {
+			t.Errorf("%v, error %v", tt.env, err)
+			continue
+		}
+		if req.Method != tt.env["REQUEST_METHOD"] {
+			t.Errorf("%v, method = %q, want %q", tt.env, req.Method, tt.env["REQUEST_METHOD"])
+		}
+		if req.URL.Scheme != tt.scheme || req.URL.Host != tt.host || req.URL.Path != tt.path || req.URL.RawQuery != tt.query {
+			t.Errorf("%v, URL = %q %q %q %q, want %q %q %q %q", tt.env,
+				req.URL.Scheme, req.URL.Host, req.URL.Path, req.URL.RawQuery,
+				tt.scheme, tt.host, tt.path, tt.query)
+		}
+		if req.RemoteAddr != tt.remoteAddr {
+			t.Errorf("%v, RemoteAddr = %q, want %q", tt.env, req.RemoteAddr, tt.remoteAddr)
+		}
+		if req.ProtocolVersion != tt.version {
+			t.Errorf("%v, ProtocolVersion = %d, want %d", tt.env, req.ProtocolVersion, tt.version)
+		}
+		if len(req.Header) != len(tt.header) {
+			t.Errorf("%v, header = %v, want %v", tt.env, req.Header, tt.header)
+		}
+		for name, values := range tt.header {
+			if req.Header.Get(name) != values[0] {
+				t.Errorf("%v, header %s = %q, want %q", tt.env, name, req.Header.Get(name), values[0])
+			}
+		}
+	}
+	if _, err := NewCGIRequest(map[string]string{}); err == nil {
+		t.Error("expected error for missing REQUEST_METHOD")
+	}
+}
+
+type silentLogger struct{}
+
+func (silentLogger) Write(p []byte) (int, os.Error) {
+	return len(p), nil
+}
+
+var cgiResponderTests = []struct {
+	handler HandlerFunc
+	out     string
+}{
+	{
+		func(req *Request) {
+			io.WriteString(req.Respond(StatusOK, HeaderContentType, "text/plain"), "Hello")
+		},
+		"Status: 200 OK\r\nContent-Type: text/plain\r\n\r\nHello",
+	},
+	{
+		func(req *Request) {},
+		"Status: 500 Internal Server Error\r\nContent-Length: 21\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nInternal Server Error",
+	},
+	{
+		func(req *Request) { panic("before") },
+		"Status: 500 Internal Server Error\r\nContent-Length: 21\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nInternal Server Error",
+	},
+	{
+		func(req *Request) {
+			req.Respond(StatusNoContent)
+			req.Respond(StatusOK)
+			panic("after")
+		},
+		"Status: 204 No Content\r\n\r\n",
+	},
+}
+
+func TestCGIResponder(t *testing.T) {
+	log.SetOutput(silentLogger{})
+	defer log.SetOutput(os.Stdout)
+	for i, tt := range cgiResponderTests {
+		var buf bytes.Buffer
+		bw := bufio.NewWriter(&buf)
+		r := NewCGIResponder(bw)
+		req, err := NewCGIRequest(map[string]string{"REQUEST_METHOD": "GET", "REQUEST_URI": "/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Responder = r
+		r.InvokeHandler(req, tt.handler)
+		bw.Flush()
+		if buf.String() != tt.out {
+			t.Errorf("%d: got %q, want %q", i, buf.String(), tt.out)
+		}
+		if !r.Responded() {
+			t.Errorf("%d: Responded() = false", i)
+		}
+	}
+}
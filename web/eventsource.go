@@ -0,0 +1,86 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+)
+
+// EventSource sends server-sent events to the client. See
+// http://dev.w3.org/html5/eventsource/ for information on server-sent events.
+//
+// The following example sends the time to the client every second:
+//
+//  func timeHandler(req *web.Request) {
+//      es := web.NewEventSource(req)
+//      for {
+//          if err := es.SendEvent("time", time.LocalTime().String()); err != nil {
+//              return
+//          }
+//          time.Sleep(1e9)
+//      }
+//  }
+type EventSource struct {
+	w   io.Writer
+	err os.Error
+}
+
+// NewEventSource responds to the request with content type text/event-stream
+// and returns an EventSource for sending events to the client. The response
+// headers are flushed to the client immediately.
+func NewEventSource(req *Request) *EventSource {
+	es := &EventSource{w: req.Respond(StatusOK,
+		HeaderContentType, "text/event-stream",
+		HeaderCacheControl, "no-cache")}
+	es.flush()
+	return es
+}
+
+func (es *EventSource) flush() os.Error {
+	if f, ok := es.w.(Flusher); ok && es.err == nil {
+		es.err = f.Flush()
+	}
+	return es.err
+}
+
+// SendEvent sends an event with the given name and data to the client and
+// flushes the response. If name is "", then the event name is omitted and
+// the client dispatches a message event. SendEvent returns an error if the
+// event could not be written to the client. Once an error is returned, all
+// subsequent calls return the same error.
+func (es *EventSource) SendEvent(name, data string) os.Error {
+	if es.err != nil {
+		return es.err
+	}
+	var b bytes.Buffer
+	if name != "" {
+		b.WriteString("event: ")
+		b.WriteString(name)
+		b.WriteByte('\n')
+	}
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: ")
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	if _, es.err = es.w.Write(b.Bytes()); es.err != nil {
+		return es.err
+	}
+	return es.flush()
+}
@@ -0,0 +1,37 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"testing"
+)
+
+func TestEventSource(t *testing.T) {
+	status, header, body := RunHandler("http://example.com/", "GET", nil, nil, HandlerFunc(func(req *Request) {
+		es := NewEventSource(req)
+		es.SendEvent("", "hello")
+		es.SendEvent("update", "a\nb")
+	}))
+	if status != StatusOK {
+		t.Errorf("status = %d, want %d", status, StatusOK)
+	}
+	if ct := header.Get(HeaderContentType); ct != "text/event-stream" {
+		t.Errorf("content type = %q, want text/event-stream", ct)
+	}
+	const want = "data: hello\n\nevent: update\ndata: a\ndata: b\n\n"
+	if string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
@@ -23,6 +23,80 @@ import (
 	"strings"
 )
 
+// Range specifies a byte range of an entity.
+type Range struct {
+	Start  int64
+	Length int64
+}
+
+// ErrUnsatisfiableRange is returned by ParseRange when none of the ranges
+// overlap the entity.
+var ErrUnsatisfiableRange = os.NewError("twister: requested range not satisfiable")
+
+// ParseRange parses a Range header value for an entity with the given size.
+// Suffix ranges and ranges extending past the end of the entity are
+// converted to ranges within the entity.
+func ParseRange(s string, size int64) ([]Range, os.Error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return nil, ErrBadFormat
+	}
+	var ranges []Range
+	for _, spec := range strings.Split(s[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, ErrBadFormat
+		}
+		first := strings.TrimSpace(spec[:i])
+		last := strings.TrimSpace(spec[i+1:])
+		var r Range
+		if first == "" {
+			// Suffix range.
+			n, err := strconv.Atoi64(last)
+			if err != nil || n < 0 {
+				return nil, ErrBadFormat
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r.Start = size - n
+			r.Length = n
+		} else {
+			start, err := strconv.Atoi64(first)
+			if err != nil || start < 0 {
+				return nil, ErrBadFormat
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.Atoi64(last)
+				if err != nil || end < start {
+					return nil, ErrBadFormat
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			r.Start = start
+			r.Length = end - start + 1
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, ErrUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
 type ServeFileOptions struct {
 	// Map file extension to mime type.
 	MimeType map[string]string
@@ -37,6 +111,10 @@ var defaultServeFileOptions ServeFileOptions
 //
 // If the "v" request parameter is set, then ServeFile sets the expires header
 // and the cache control maximum age parameter to ten years in the future.
+//
+// ServeFile responds to a request for a single byte range with status 206 and
+// to a request for unsatisfiable ranges with status 416. The entire file is
+// served for requests with multiple ranges.
 func ServeFile(req *Request, fname string, options *ServeFileOptions) {
 	if options == nil {
 		options = &defaultServeFileOptions
@@ -64,14 +142,15 @@ func ServeFile(req *Request, fname string, options *ServeFileOptions) {
 		}
 	}
 
-	etag := strconv.Itob64(info.Mtime_ns, 36)
-	header.Set(HeaderETag, QuoteHeaderValue(etag))
+	rangeStart := int64(0)
+	rangeLength := info.Size
 
-	for _, qetag := range req.Header.GetList(HeaderIfNoneMatch) {
-		if etag == UnquoteHeaderValue(qetag) {
-			status = StatusNotModified
-			break
-		}
+	etag := QuoteHeaderValue(strconv.Itob64(info.Mtime_ns, 36))
+	// Call both checks so that the ETag and Last-Modified headers are set.
+	etagMatch := CheckETag(req, header, etag)
+	notModified := CheckLastModified(req, header, info.Mtime_ns/1e9)
+	if etagMatch || notModified {
+		status = StatusNotModified
 	}
 
 	if status == StatusNotModified {
@@ -83,7 +162,25 @@ func ServeFile(req *Request, fname string, options *ServeFileOptions) {
 		}
 	} else {
 		// Set entity headers
-		header.Set(HeaderContentLength, strconv.Itoa64(info.Size))
+		header.Set(HeaderAcceptRanges, "bytes")
+		if s := req.Header.Get(HeaderRange); s != "" && checkIfRange(req, etag) {
+			ranges, err := ParseRange(s, info.Size)
+			switch {
+			case err == ErrUnsatisfiableRange:
+				req.Error(StatusRequestedRangeNotSatisfiable, nil,
+					HeaderContentRange, "bytes */"+strconv.Itoa64(info.Size))
+				return
+			case err == nil && len(ranges) == 1:
+				status = StatusPartialContent
+				rangeStart = ranges[0].Start
+				rangeLength = ranges[0].Length
+				header.Set(HeaderContentRange, "bytes "+
+					strconv.Itoa64(rangeStart)+"-"+
+					strconv.Itoa64(rangeStart+rangeLength-1)+"/"+
+					strconv.Itoa64(info.Size))
+			}
+		}
+		header.Set(HeaderContentLength, strconv.Itoa64(rangeLength))
 		if _, found := header[HeaderContentType]; !found {
 			ext := path.Ext(fname)
 			contentType := ""
@@ -121,10 +218,21 @@ func ServeFile(req *Request, fname string, options *ServeFileOptions) {
 
 	w := req.Responder.Respond(status, header)
 	if req.Method != "HEAD" && status != StatusNotModified {
-		io.Copy(w, f)
+		if rangeStart != 0 {
+			if _, err := f.Seek(rangeStart, 0); err != nil {
+				return
+			}
+		}
+		io.CopyN(w, f, rangeLength)
 	}
 }
 
+// checkIfRange returns true if the request Range header should be used.
+func checkIfRange(req *Request, etag string) bool {
+	ifRange := req.Header.Get(HeaderIfRange)
+	return ifRange == "" || ifRange == etag
+}
+
 // DirectoryHandler returns a request handler that serves static files from
 // root using using the URL parameter "path". The "path" parameter is typically
 // set using a Router pattern match:
@@ -15,20 +15,28 @@
 package web
 
 import (
+	"io/ioutil"
 	"os"
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 )
 
 var testEtag = computeTestEtag()
 var testContentLength = computeTestContentLength()
+var testLastModified = computeTestLastModified()
 
 func computeTestEtag() string {
 	info, _ := os.Stat("fs_test.go")
 	return QuoteHeaderValue(strconv.Itob64(info.Mtime_ns, 36))
 }
 
+func computeTestLastModified() string {
+	info, _ := os.Stat("fs_test.go")
+	return time.SecondsToUTC(info.Mtime_ns / 1e9).Format(TimeLayout)
+}
+
 func computeTestContentLength() string {
 	info, _ := os.Stat("fs_test.go")
 	return strconv.Itoa64(info.Size)
@@ -49,6 +57,8 @@ var fileHandlerTests = []struct {
 		status: StatusOK,
 		responseHeader: NewHeader(
 			HeaderEtag, testEtag,
+			HeaderLastModified, testLastModified,
+			HeaderAcceptRanges, "bytes",
 			HeaderContentLength, testContentLength),
 	},
 	{
@@ -57,7 +67,9 @@ var fileHandlerTests = []struct {
 		status: StatusOK,
 		responseHeader: NewHeader(
 			HeaderEtag, testEtag,
+			HeaderLastModified, testLastModified,
 			HeaderCacheControl, "max-age=315360000",
+			HeaderAcceptRanges, "bytes",
 			HeaderContentLength, testContentLength),
 		url: "http://example.com/?v=10",
 	},
@@ -68,7 +80,9 @@ var fileHandlerTests = []struct {
 		options: &ServeFileOptions{Header: NewHeader(HeaderCacheControl, "foo, max-age=2, bar")},
 		responseHeader: NewHeader(
 			HeaderEtag, testEtag,
+			HeaderLastModified, testLastModified,
 			HeaderCacheControl, "foo, bar, max-age=315360000",
+			HeaderAcceptRanges, "bytes",
 			HeaderContentLength, testContentLength),
 		url: "http://example.com/?v=10",
 	},
@@ -78,6 +92,8 @@ var fileHandlerTests = []struct {
 		status: StatusOK,
 		responseHeader: NewHeader(
 			HeaderEtag, testEtag,
+			HeaderLastModified, testLastModified,
+			HeaderAcceptRanges, "bytes",
 			HeaderContentLength, testContentLength),
 		noBody: true,
 	},
@@ -88,7 +104,8 @@ var fileHandlerTests = []struct {
 		requestHeader: NewHeader(
 			HeaderIfNoneMatch, testEtag),
 		responseHeader: NewHeader(
-			HeaderEtag, testEtag),
+			HeaderEtag, testEtag,
+			HeaderLastModified, testLastModified),
 		noBody: true,
 	},
 	{
@@ -99,7 +116,8 @@ var fileHandlerTests = []struct {
 		requestHeader: NewHeader(
 			HeaderIfNoneMatch, testEtag),
 		responseHeader: NewHeader(
-			HeaderEtag, testEtag),
+			HeaderEtag, testEtag,
+			HeaderLastModified, testLastModified),
 		noBody: true,
 	},
 	{
@@ -109,7 +127,54 @@ var fileHandlerTests = []struct {
 		requestHeader: NewHeader(
 			HeaderIfNoneMatch, "random, "+testEtag+", junk"),
 		responseHeader: NewHeader(
-			HeaderEtag, testEtag),
+			HeaderEtag, testEtag,
+			HeaderLastModified, testLastModified),
+		noBody: true,
+	},
+	{
+		// If-Modified-Since
+		method: "GET",
+		status: StatusNotModified,
+		requestHeader: NewHeader(
+			HeaderIfModifiedSince, testLastModified),
+		responseHeader: NewHeader(
+			HeaderEtag, testEtag,
+			HeaderLastModified, testLastModified),
+		noBody: true,
+	},
+	{
+		// If-None-Match takes precedence over If-Modified-Since
+		method: "GET",
+		status: StatusOK,
+		requestHeader: NewHeader(
+			HeaderIfNoneMatch, "\"other\"",
+			HeaderIfModifiedSince, testLastModified),
+		responseHeader: NewHeader(
+			HeaderEtag, testEtag,
+			HeaderLastModified, testLastModified,
+			HeaderAcceptRanges, "bytes",
+			HeaderContentLength, testContentLength),
+	},
+	{
+		// If-None-Match with weak validator
+		method: "GET",
+		status: StatusNotModified,
+		requestHeader: NewHeader(
+			HeaderIfNoneMatch, "W/"+testEtag),
+		responseHeader: NewHeader(
+			HeaderEtag, testEtag,
+			HeaderLastModified, testLastModified),
+		noBody: true,
+	},
+	{
+		// If-None-Match: *
+		method: "GET",
+		status: StatusNotModified,
+		requestHeader: NewHeader(
+			HeaderIfNoneMatch, "*"),
+		responseHeader: NewHeader(
+			HeaderEtag, testEtag,
+			HeaderLastModified, testLastModified),
 		noBody: true,
 	},
 }
@@ -140,3 +205,58 @@ func TestFileHandler(t *testing.T) {
 		}
 	}
 }
+
+var parseRangeTests = []struct {
+	s      string
+	size   int64
+	ranges []Range
+	err    os.Error
+}{
+	{"bytes=0-499", 1000, []Range{{0, 500}}, nil},
+	{"bytes=500-", 1000, []Range{{500, 500}}, nil},
+	{"bytes=-500", 1000, []Range{{500, 500}}, nil},
+	{"bytes=-5000", 1000, []Range{{0, 1000}}, nil},
+	{"bytes=900-2000", 1000, []Range{{900, 100}}, nil},
+	{"bytes=0-0, -1", 1000, []Range{{0, 1}, {999, 1}}, nil},
+	{"bytes=1000-", 1000, nil, ErrUnsatisfiableRange},
+	{"bytes=-0", 1000, nil, ErrUnsatisfiableRange},
+	{"bytes=5-4", 1000, nil, ErrBadFormat},
+	{"bytes=x-", 1000, nil, ErrBadFormat},
+	{"items=0-1", 1000, nil, ErrBadFormat},
+}
+
+func TestParseRange(t *testing.T) {
+	for _, tt := range parseRangeTests {
+		ranges, err := ParseRange(tt.s, tt.size)
+		if err != tt.err || !reflect.DeepEqual(ranges, tt.ranges) {
+			t.Errorf("ParseRange(%q, %d) = %v, %v, want %v, %v", tt.s, tt.size, ranges, err, tt.ranges, tt.err)
+		}
+	}
+}
+
+func TestFileHandlerRange(t *testing.T) {
+	data, err := ioutil.ReadFile("fs_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := strconv.Itoa(len(data))
+	fh := FileHandler("fs_test.go", nil)
+
+	status, header, body := RunHandler("/", "GET", NewHeader(HeaderRange, "bytes=10-19"), nil, fh)
+	if status != StatusPartialContent || string(body) != string(data[10:20]) {
+		t.Errorf("range status=%d body=%q, want %d %q", status, body, StatusPartialContent, data[10:20])
+	}
+	if cr := header.Get(HeaderContentRange); cr != "bytes 10-19/"+size {
+		t.Errorf("range Content-Range=%q", cr)
+	}
+
+	status, header, _ = RunHandler("/", "GET", NewHeader(HeaderRange, "bytes="+size+"-"), nil, fh)
+	if status != StatusRequestedRangeNotSatisfiable || header.Get(HeaderContentRange) != "bytes */"+size {
+		t.Errorf("unsatisfiable range status=%d Content-Range=%q", status, header.Get(HeaderContentRange))
+	}
+
+	status, _, body = RunHandler("/", "GET", NewHeader(HeaderRange, "bytes=10-19", HeaderIfRange, "\"other\""), nil, fh)
+	if status != StatusOK || len(body) != len(data) {
+		t.Errorf("If-Range mismatch status=%d len(body)=%d", status, len(body))
+	}
+}
@@ -94,9 +94,19 @@ func (m Header) Set(key string, value string) {
 	m[key] = []string{value}
 }
 
+// values returns the values for the given key. If the key is not found, then
+// the values for the canonical format of the key are returned.
+func (m Header) values(key string) []string {
+	if values, found := m[key]; found {
+		return values
+	}
+	return m[HeaderName(key)]
+}
+
 // Get returns the first value for given key or "" if the key is not found.
+// The key is not case sensitive.
 func (m Header) Get(key string) string {
-	values := m[key]
+	values := m.values(key)
 	if len(values) == 0 {
 		return ""
 	}
@@ -114,10 +124,11 @@ func (m Header) GetValueParam(key string) (value string, param map[string]string
 
 // GetList returns list of comma separated values over multiple header values
 // for the given key. Commas are ignored in quoted strings. Quoted values are
-// not unescaped or unquoted. Whitespace is trimmed.
+// not unescaped or unquoted. Whitespace is trimmed. The key is not case
+// sensitive.
 func (m Header) GetList(key string) []string {
 	var result []string
-	for _, s := range m[key] {
+	for _, s := range m.values(key) {
 		begin := 0
 		end := 0
 		escape := false
@@ -161,6 +172,28 @@ func (m Header) GetList(key string) []string {
 	return result
 }
 
+// HasToken returns true if the comma separated list of values for the given
+// key contains token. Tokens are compared without regard to case.
+func (m Header) HasToken(key, token string) bool {
+	token = strings.ToLower(token)
+	for _, s := range m.GetList(key) {
+		if strings.ToLower(s) == token {
+			return true
+		}
+	}
+	return false
+}
+
+// SetList sets the header for the given key to the comma separated list of
+// values. If values is empty, then the header is removed.
+func (m Header) SetList(key string, values []string) {
+	if len(values) == 0 {
+		m[key] = nil, false
+		return
+	}
+	m.Set(key, strings.Join(values, ", "))
+}
+
 // ValueParams represents a value with parameters.
 type ValueParams struct {
 	Value string
@@ -196,9 +229,34 @@ func (m Header) GetAccept(key string) []ValueParams {
 	return result
 }
 
-// WriteHttpHeader writes the map in HTTP header format.
+// cleanHeaderValue returns s with \r, \n and other control characters
+// converted to space to prevent response splitting attacks.
+func cleanHeaderValue(s string) string {
+	for i := 0; i < len(s); i++ {
+		if isCtl[s[i]] {
+			p := []byte(s)
+			for j := i; j < len(p); j++ {
+				if isCtl[p[j]] {
+					p[j] = ' '
+				}
+			}
+			return string(p)
+		}
+	}
+	return s
+}
+
+// WriteHttpHeader writes the map in HTTP header format. The header fields
+// are written in sorted key order so that the output is deterministic.
+// Multiple values for a key are written in order.
 func (m Header) WriteHttpHeader(w io.Writer) os.Error {
-	for key, values := range m {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values := m[key]
 		keyBytes := []byte(key)
 		for _, value := range values {
 			if _, err := w.Write(keyBytes); err != nil {
@@ -207,15 +265,7 @@ func (m Header) WriteHttpHeader(w io.Writer) os.Error {
 			if _, err := w.Write(colonSpaceBytes); err != nil {
 				return err
 			}
-			valueBytes := []byte(value)
-			// Convert \r, \n and other control characters to space to 
-			// prevent response splitting attacks.
-			for i, c := range valueBytes {
-				if isCtl[c] {
-					valueBytes[i] = ' '
-				}
-			}
-			if _, err := w.Write(valueBytes); err != nil {
+			if _, err := io.WriteString(w, cleanHeaderValue(value)); err != nil {
 				return err
 			}
 			if _, err := w.Write(crlfBytes); err != nil {
@@ -227,55 +277,130 @@ func (m Header) WriteHttpHeader(w io.Writer) os.Error {
 	return err
 }
 
+// Default limits used by HeaderParser.
+const (
+	DefaultMaxHeaderLineSize  = 4096
+	DefaultMaxHeaderValueSize = 4096
+	DefaultMaxHeaderCount     = 256
+)
+
+// HeaderParser parses HTTP headers with configurable limits. A zero value for
+// a limit selects the corresponding default.
+type HeaderParser struct {
+	// Maximum size of a header line.
+	MaxLineSize int
+
+	// Maximum size of a header value including continuation lines.
+	MaxValueSize int
+
+	// Maximum number of headers.
+	MaxHeaderCount int
+
+	// Maximum total size of the header lines. If zero, then the total size
+	// is not limited.
+	MaxSize int
+
+	// If true, reject lines not terminated by CRLF, whitespace between the
+	// header name and colon, and folded continuation lines. Otherwise, these
+	// forms are accepted and continuation lines are joined to the previous
+	// value with a single space.
+	Strict bool
+}
+
+// readLine reads a header line and returns the line without the line
+// terminator.
+func (p *HeaderParser) readLine(br *bufio.Reader) ([]byte, os.Error) {
+	if !p.Strict {
+		line, isPrefix, err := br.ReadLine()
+		if err == nil && isPrefix {
+			err = ErrLineTooLong
+		}
+		return line, err
+	}
+	line, err := br.ReadSlice('\n')
+	switch {
+	case err == bufio.ErrBufferFull:
+		return nil, ErrLineTooLong
+	case err != nil:
+		return nil, err
+	case len(line) < 2 || line[len(line)-2] != '\r':
+		return nil, ErrBadHeaderLine
+	}
+	return line[:len(line)-2], nil
+}
+
+// ErrHeaderSizeExceeded is returned when the total size of the headers
+// exceeds HeaderParser.MaxSize.
+var ErrHeaderSizeExceeded = os.NewError("HTTP headers too large")
+
 // ParseHttpHeader parses the HTTP headers and appends the values to the
 // supplied map. Header names are converted to canonical format.
-func (m Header) ParseHttpHeader(br *bufio.Reader) (err os.Error) {
+func (m Header) ParseHttpHeader(br *bufio.Reader) os.Error {
+	var p HeaderParser
+	return p.ParseHttpHeader(br, m)
+}
 
-	const (
-		// Max size for header line
-		maxLineSize = 4096
-		// Max size for header value
-		maxValueSize = 4096
-		// Maximum number of headers 
-		maxHeaderCount = 256
-	)
+// ParseHttpHeader parses the HTTP headers and appends the values to the
+// supplied map. Header names are converted to canonical format.
+func (p *HeaderParser) ParseHttpHeader(br *bufio.Reader, m Header) (err os.Error) {
+
+	maxLineSize := p.MaxLineSize
+	if maxLineSize <= 0 {
+		maxLineSize = DefaultMaxHeaderLineSize
+	}
+	maxValueSize := p.MaxValueSize
+	if maxValueSize <= 0 {
+		maxValueSize = DefaultMaxHeaderValueSize
+	}
+	maxHeaderCount := p.MaxHeaderCount
+	if maxHeaderCount <= 0 {
+		maxHeaderCount = DefaultMaxHeaderCount
+	}
 
 	lastKey := ""
 	headerCount := 0
+	size := 0
 
 	for {
-		p, isPrefix, err := br.ReadLine()
+		line, err := p.readLine(br)
 		switch {
 		case err == os.EOF:
 			return io.ErrUnexpectedEOF
 		case err != nil:
 			return err
-		case isPrefix:
-			return ErrLineTooLong
 		}
 
 		// End of headers?
-		if len(p) == 0 {
+		if len(line) == 0 {
 			break
 		}
 
 		// Don't allow huge header lines.
-		if len(p) > maxLineSize {
+		if len(line) > maxLineSize {
 			return ErrLineTooLong
 		}
 
-		if isSpace[p[0]] {
+		size += len(line)
+		if p.MaxSize > 0 && size > p.MaxSize {
+			return ErrHeaderSizeExceeded
+		}
+
+		if isSpace[line[0]] {
 
-			if lastKey == "" {
+			if lastKey == "" || p.Strict {
 				return ErrBadHeaderLine
 			}
 
-			p = trimBytes(p)
+			line = trimBytes(line)
 
-			if len(p) > 0 {
+			if len(line) > 0 {
 				values := m[lastKey]
 				value := values[len(values)-1]
-				value = value + " " + string(p)
+				if value == "" {
+					value = string(line)
+				} else {
+					value = value + " " + string(line)
+				}
 				if len(value) > maxValueSize {
 					return ErrHeaderTooLong
 				}
@@ -292,26 +417,31 @@ func (m Header) ParseHttpHeader(br *bufio.Reader) (err os.Error) {
 
 			// Key
 			i := 0
-			for i < len(p) && isToken[p[i]] {
+			for i < len(line) && isToken[line[i]] {
 				i += 1
 			}
 			if i < 1 {
 				return ErrBadHeaderLine
 			}
-			key := HeaderNameBytes(p[:i])
-			p = p[i:]
+			key := HeaderNameBytes(line[:i])
+			line = line[i:]
 			lastKey = key
 
-			p = trimBytesLeft(p)
+			if !p.Strict {
+				line = trimBytesLeft(line)
+			}
 
 			// Colon
-			if p[0] != ':' {
+			if len(line) == 0 || line[0] != ':' {
 				return ErrBadHeaderLine
 			}
-			p = p[1:]
+			line = line[1:]
 
 			// Value 
-			value := string(trimBytes(p))
+			value := string(trimBytes(line))
+			if len(value) > maxValueSize {
+				return ErrHeaderTooLong
+			}
 			m.Add(key, value)
 		}
 	}
@@ -393,6 +523,8 @@ const (
 	HeaderVia                = "Via"
 	HeaderWWWAuthenticate    = "Www-Authenticate"
 	HeaderWarning            = "Warning"
+	HeaderXForwardedFor      = "X-Forwarded-For"
+	HeaderXForwardedProto    = "X-Forwarded-Proto"
 	HeaderXXSRFToken         = "X-Xsrftoken"
 )
 
@@ -436,6 +568,20 @@ func QuoteHeaderValue(s string) string {
 	return b.String()
 }
 
+// IsToken returns true if s is a non-empty token per RFC 2616. Header field
+// names must be tokens.
+func IsToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isToken[s[i]] {
+			return false
+		}
+	}
+	return true
+}
+
 // QuoteHeaderValueOrToken quotes s if s is not a valid token per RFC 2616.
 func QuoteHeaderValueOrToken(s string) string {
 	for i := 0; i < len(s); i++ {
@@ -84,6 +84,44 @@ func TestGetHeaderList(t *testing.T) {
 	}
 }
 
+func TestGetHeaderListMultipleValues(t *testing.T) {
+	header := NewHeader(HeaderCacheControl, "no-cache, private", HeaderCacheControl, " max-age=0 ")
+	want := []string{"no-cache", "private", "max-age=0"}
+	if l := header.GetList(HeaderCacheControl); !reflect.DeepEqual(l, want) {
+		t.Errorf("GetList = %q, want %q", l, want)
+	}
+}
+
+func TestSetHeaderList(t *testing.T) {
+	header := NewHeader(HeaderVary, "Cookie")
+	header.SetList(HeaderVary, []string{"Accept-Encoding", "Cookie"})
+	if v := header[HeaderVary]; !reflect.DeepEqual(v, []string{"Accept-Encoding, Cookie"}) {
+		t.Errorf("SetList set %q", v)
+	}
+	if l := header.GetList(HeaderVary); !reflect.DeepEqual(l, []string{"Accept-Encoding", "Cookie"}) {
+		t.Errorf("GetList after SetList = %q", l)
+	}
+	header.SetList(HeaderVary, nil)
+	if _, found := header[HeaderVary]; found {
+		t.Errorf("SetList with no values did not remove header")
+	}
+}
+
+func TestGetCaseInsensitive(t *testing.T) {
+	header := Header{HeaderContentType: {"text/html"}, HeaderAcceptEncoding: {"gzip, deflate"}}
+	for _, key := range []string{"Content-Type", "content-type", "CONTENT-TYPE", "cOnTeNt-TyPe"} {
+		if v := header.Get(key); v != "text/html" {
+			t.Errorf("Get(%q) = %q, want %q", key, v, "text/html")
+		}
+	}
+	if l := header.GetList("accept-encoding"); !reflect.DeepEqual(l, []string{"gzip", "deflate"}) {
+		t.Errorf("GetList(%q) = %q", "accept-encoding", l)
+	}
+	if v := header.Get("content-length"); v != "" {
+		t.Errorf("Get(%q) = %q, want empty", "content-length", v)
+	}
+}
+
 var parseHTTPHeaderTests = []struct {
 	name   string
 	header Header
@@ -122,6 +160,45 @@ func TestParseHttpHeader(t *testing.T) {
 	}
 }
 
+var headerParserModeTests = []struct {
+	name    string
+	s       string
+	lenient Header // nil if lenient parse fails
+	strict  Header // nil if strict parse fails
+}{
+	{"crlf", "A: 1\r\nB: 2\r\n\r\n", NewHeader("A", "1", "B", "2"), NewHeader("A", "1", "B", "2")},
+	{"bare lf", "A: 1\nB: 2\n\n", NewHeader("A", "1", "B", "2"), nil},
+	{"mixed", "A: 1\r\nB: 2\n\r\n", NewHeader("A", "1", "B", "2"), nil},
+	{"space before colon", "A : 1\r\n\r\n", NewHeader("A", "1"), nil},
+	{"tab before colon", "A\t: 1\r\n\r\n", NewHeader("A", "1"), nil},
+	{"folded", "A: 1\r\n 2\r\n\t3\r\n\r\n", NewHeader("A", "1 2 3"), nil},
+	{"folded empty", "A:\r\n  1\r\n\r\n", NewHeader("A", "1"), nil},
+	{"leading fold", " A: 1\r\n\r\n", nil, nil},
+	{"no colon", "A 1\r\n\r\n", nil, nil},
+}
+
+func TestHeaderParserModes(t *testing.T) {
+	for _, tt := range headerParserModeTests {
+		for _, strict := range []bool{false, true} {
+			want := tt.lenient
+			if strict {
+				want = tt.strict
+			}
+			p := HeaderParser{Strict: strict}
+			header := Header{}
+			err := p.ParseHttpHeader(bufio.NewReader(bytes.NewBufferString(tt.s)), header)
+			switch {
+			case want == nil && err == nil:
+				t.Errorf("%s, strict=%v, expected error", tt.name, strict)
+			case want != nil && err != nil:
+				t.Errorf("%s, strict=%v, error %v", tt.name, strict, err)
+			case want != nil && !reflect.DeepEqual(header, want):
+				t.Errorf("%s, strict=%v, header = %q, want %q", tt.name, strict, header, want)
+			}
+		}
+	}
+}
+
 var getValueParamTests = []struct {
 	s     string
 	value string
@@ -184,3 +261,66 @@ func TestGetAccept(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteHttpHeader(t *testing.T) {
+	h := NewHeader(
+		HeaderSetCookie, "a=1",
+		HeaderContentType, "text/html",
+		HeaderSetCookie, "b=2",
+		HeaderCacheControl, "no-cache",
+		"X-Injected", "a\r\nb")
+	want := "Cache-Control: no-cache\r\nContent-Type: text/html\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\nX-Injected: a  b\r\n\r\n"
+	for i := 0; i < 10; i++ {
+		var b bytes.Buffer
+		if err := h.WriteHttpHeader(&b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != want {
+			t.Fatalf("got %q, want %q", b.String(), want)
+		}
+	}
+}
+
+var isTokenTests = []struct {
+	s  string
+	ok bool
+}{
+	{"Content-Type", true},
+	{"X-Foo_Bar.1", true},
+	{"", false},
+	{"Bad Name", false},
+	{"Bad:Name", false},
+	{"Bad\r\nName", false},
+}
+
+func TestIsToken(t *testing.T) {
+	for _, tt := range isTokenTests {
+		if ok := IsToken(tt.s); ok != tt.ok {
+			t.Errorf("IsToken(%q) = %v, want %v", tt.s, ok, tt.ok)
+		}
+	}
+}
+
+var hasTokenTests = []struct {
+	values []string
+	token  string
+	ok     bool
+}{
+	{[]string{"close"}, "close", true},
+	{[]string{"Close"}, "close", true},
+	{[]string{"keep-alive, Upgrade"}, "upgrade", true},
+	{[]string{"TE, close"}, "close", true},
+	{[]string{"TE", "close"}, "close", true},
+	{[]string{"closed"}, "close", false},
+	{[]string{"keep-alive"}, "close", false},
+	{nil, "close", false},
+}
+
+func TestHasToken(t *testing.T) {
+	for _, tt := range hasTokenTests {
+		header := Header{HeaderConnection: tt.values}
+		if ok := header.HasToken(HeaderConnection, tt.token); ok != tt.ok {
+			t.Errorf("HasToken(%q, %q) = %v, want %v", tt.values, tt.token, ok, tt.ok)
+		}
+	}
+}
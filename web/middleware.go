@@ -15,10 +15,33 @@
 package web
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
 	"io"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Middleware is a function that wraps a handler with additional behavior.
+type Middleware func(Handler) Handler
+
+// Chain returns middleware that wraps a handler with each of the given
+// middleware. The first middleware is the outermost wrapper and sees the
+// request first. For example, Chain(a, b)(h) is equivalent to a(b(h)).
+func Chain(mw ...Middleware) Middleware {
+	return func(h Handler) Handler {
+		for i := len(mw) - 1; i >= 0; i-- {
+			h = mw[i](h)
+		}
+		return h
+	}
+}
+
 type filterResponder struct {
 	Responder
 	filter func(status int, header Header) (int, Header)
@@ -28,6 +51,14 @@ func (rf *filterResponder) Respond(status int, header Header) io.Writer {
 	return rf.Responder.Respond(rf.filter(status, header))
 }
 
+func (rf *filterResponder) Done() <-chan bool {
+	return responderDone(rf.Responder)
+}
+
+func (rf *filterResponder) Responded() bool {
+	return responded(rf.Responder)
+}
+
 // FilterRespond replaces the request's responder with one that filters the
 // arguments to Respond through the supplied filter. This function is intended
 // to be used by middleware.
@@ -119,6 +150,129 @@ func (h proxyHeaderHandler) ServeWeb(req *Request) {
 	h.h.ServeWeb(req)
 }
 
+// ForwardedHandler returns a handler that sets the Request.RemoteAddr field
+// from the X-Forwarded-For header and the Request.URL.Scheme field from the
+// X-Forwarded-Proto header when the request is from a trusted proxy. The
+// headers are ignored for requests from other peers.
+//
+// The trustedProxies argument is a list of IP addresses and CIDR ranges such
+// as "10.0.0.0/8". The remote address is set to the right-most address in
+// X-Forwarded-For that is not a trusted proxy. The remote address keeps the
+// host:port form with port 0 because the header does not include the
+// client's port. ForwardedHandler panics if a trusted proxy is not valid.
+//
+// The original values are added to the request Env with the keys
+// "twister.web.OriginalRemoteAddr" and "twister.web.OriginalScheme".
+func ForwardedHandler(trustedProxies []string, h Handler) Handler {
+	fh := &forwardedHandler{h: h}
+	for _, s := range trustedProxies {
+		n, ok := parseIPNet(s)
+		if !ok {
+			panic("twister: bad trusted proxy " + s)
+		}
+		fh.trusted = append(fh.trusted, n)
+	}
+	return fh
+}
+
+// ipNet is an IP network.
+type ipNet struct {
+	ip   net.IP // 4 byte IPv4 or 16 byte IPv6 network address
+	bits int    // number of bits in the prefix
+}
+
+// parseIPNet parses an IP address or CIDR range.
+func parseIPNet(s string) (ipNet, bool) {
+	addr, bits := s, -1
+	if i := strings.Index(s, "/"); i >= 0 {
+		var err os.Error
+		addr = s[:i]
+		bits, err = strconv.Atoi(s[i+1:])
+		if err != nil || bits < 0 {
+			return ipNet{}, false
+		}
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ipNet{}, false
+	}
+	if ip4 := ip.To4(); ip4 != nil && !strings.Contains(addr, ":") {
+		ip = ip4
+	}
+	if bits < 0 {
+		bits = len(ip) * 8
+	}
+	if bits > len(ip)*8 {
+		return ipNet{}, false
+	}
+	return ipNet{ip, bits}, true
+}
+
+// contains returns true if the network contains ip. IPv4 networks do not
+// contain IPv6 addresses and IPv6 networks do not contain IPv4 addresses.
+func (n ipNet) contains(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if len(ip) != len(n.ip) {
+		return false
+	}
+	for i := 0; i < n.bits; i++ {
+		mask := byte(0x80) >> uint(i%8)
+		if ip[i/8]&mask != n.ip[i/8]&mask {
+			return false
+		}
+	}
+	return true
+}
+
+type forwardedHandler struct {
+	trusted []ipNet
+	h       Handler
+}
+
+func (h *forwardedHandler) isTrusted(s string) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+	for _, n := range h.trusted {
+		if n.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *forwardedHandler) ServeWeb(req *Request) {
+	peer, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		peer = req.RemoteAddr
+	}
+	if h.isTrusted(peer) {
+		forwardedFor := req.Header.GetList(HeaderXForwardedFor)
+		for i := len(forwardedFor) - 1; i >= 0; i-- {
+			addr := forwardedFor[i]
+			if net.ParseIP(addr) == nil {
+				break
+			}
+			if i == 0 || !h.isTrusted(addr) {
+				req.Env["twister.web.OriginalRemoteAddr"] = req.RemoteAddr
+				req.RemoteAddr = net.JoinHostPort(addr, "0")
+				break
+			}
+		}
+		if protos := req.Header.GetList(HeaderXForwardedProto); len(protos) > 0 {
+			proto := strings.ToLower(protos[len(protos)-1])
+			if proto == "http" || proto == "https" {
+				req.Env["twister.web.OriginalScheme"] = req.URL.Scheme
+				req.URL.Scheme = proto
+			}
+		}
+	}
+	h.h.ServeWeb(req)
+}
+
 // Name of XSRF cookie and request parameter.
 const (
 	XSRFCookieName = "xsrf"
@@ -167,3 +321,293 @@ func (h formHandler) ServeWeb(req *Request) {
 
 	h.h.ServeWeb(req)
 }
+
+// GzipHandler returns a handler that compresses response bodies using the gzip
+// content coding when the request Accept-Encoding header allows it. The
+// handler removes the Content-Length header from compressed responses.
+// Responses that cannot have a body, partial content responses, responses
+// with a Content-Encoding header, event streams and responses with a content
+// type that is already compressed (images, audio, video and archives) are not
+// modified. The compressed response body implements Flusher.
+func GzipHandler(h Handler) Handler {
+	return gzipHandler{h}
+}
+
+type gzipHandler struct {
+	h Handler
+}
+
+func (h gzipHandler) ServeWeb(req *Request) {
+	r := &gzipResponder{Responder: req.Responder, accept: acceptsGzip(req)}
+	req.Responder = r
+	h.h.ServeWeb(req)
+	if r.w != nil {
+		r.w.Close()
+	}
+}
+
+// acceptsGzip returns true if the request accepts the gzip content coding.
+func acceptsGzip(req *Request) bool {
+	for _, a := range req.Header.GetAccept(HeaderAcceptEncoding) {
+		if a.Value != "gzip" && a.Value != "x-gzip" {
+			continue
+		}
+		if s, found := a.Param["q"]; found {
+			q, err := strconv.Atof64(s)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+var compressedContentTypes = []string{"image/", "audio/", "video/", "application/zip", "application/x-gzip"}
+
+type gzipResponder struct {
+	Responder
+	accept bool
+	w      io.WriteCloser
+}
+
+func (r *gzipResponder) Respond(status int, header Header) io.Writer {
+	if status < StatusOK || status == StatusNoContent || status == StatusNotModified ||
+		status == StatusPartialContent || header.Get(HeaderContentEncoding) != "" {
+		// Byte ranges apply to the uncompressed representation.
+		return r.Responder.Respond(status, header)
+	}
+	contentType, _ := header.GetValueParam(HeaderContentType)
+	if contentType == "text/event-stream" {
+		// Events must be flushed to the client as they are sent.
+		return r.Responder.Respond(status, header)
+	}
+	for _, prefix := range compressedContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return r.Responder.Respond(status, header)
+		}
+	}
+	header.Add(HeaderVary, HeaderAcceptEncoding)
+	if !r.accept {
+		return r.Responder.Respond(status, header)
+	}
+	header[HeaderContentLength] = nil, false
+	header.Set(HeaderContentEncoding, "gzip")
+	w := r.Responder.Respond(status, header)
+	gz, err := gzip.NewWriter(w)
+	if err != nil {
+		return w
+	}
+	r.w = gz
+	return &gzipResponseBody{gz, w}
+}
+
+// gzipResponseBody is the response body returned from gzipResponder.Respond.
+type gzipResponseBody struct {
+	gz io.Writer // compresses to w
+	w  io.Writer
+}
+
+func (b *gzipResponseBody) Write(p []byte) (int, os.Error) {
+	return b.gz.Write(p)
+}
+
+// Flush flushes compressed data to the wrapped response body and then flushes
+// the wrapped response body.
+func (b *gzipResponseBody) Flush() os.Error {
+	if f, ok := b.gz.(Flusher); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	if f, ok := b.w.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (r *gzipResponder) Done() <-chan bool {
+	return responderDone(r.Responder)
+}
+
+func (r *gzipResponder) Responded() bool {
+	return responded(r.Responder)
+}
+
+// LogLine is an access log line in Apache Common Log Format or Combined Log
+// Format. The elapsed time in microseconds is appended to the line. Values
+// from the request are escaped so that a client cannot forge log lines.
+type LogLine struct {
+	Request *Request
+
+	// Response status.
+	Status int
+
+	// Number of response body bytes written.
+	Written int
+
+	// Time in nanoseconds to handle the request.
+	Elapsed int64
+
+	// If true, then the Referer and User-Agent are included as in the
+	// Combined Log Format.
+	Combined bool
+}
+
+const commonLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// WriteTo writes the line including the terminating newline to w.
+func (l *LogLine) WriteTo(w io.Writer) (int64, os.Error) {
+	req := l.Request
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	uri := req.URL.RawPath
+	if uri == "" {
+		uri = req.URL.Path
+		if req.URL.RawQuery != "" {
+			uri += "?" + req.URL.RawQuery
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s - - [%s] \"%s %s HTTP/%d.%d\" %d %d",
+		escapeLogField(host), time.LocalTime().Format(commonLogTimeFormat),
+		escapeLogField(req.Method), escapeLogField(uri), req.ProtocolVersion/1000, req.ProtocolVersion%1000,
+		l.Status, l.Written)
+	if l.Combined {
+		fmt.Fprintf(&b, " \"%s\" \"%s\"",
+			escapeLogField(req.Header.Get(HeaderReferer)),
+			escapeLogField(req.Header.Get(HeaderUserAgent)))
+	}
+	fmt.Fprintf(&b, " %d\n", l.Elapsed/1e3)
+	n, err := w.Write(b.Bytes())
+	return int64(n), err
+}
+
+// escapeLogField escapes quotes, backslashes, control characters and bytes
+// outside of ASCII in s. The escaping follows Apache's access log format.
+func escapeLogField(s string) string {
+	i := 0
+	for ; i < len(s); i++ {
+		if c := s[i]; c == '"' || c == '\\' || c < ' ' || c >= 0x7f {
+			break
+		}
+	}
+	if i == len(s) {
+		return s
+	}
+	b := bytes.NewBufferString(s[:i])
+	for ; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// LogHandler returns a handler that writes a line in Apache Common Log Format
+// to w for each request handled by h. The response status and the number of
+// body bytes written by h are recorded. The elapsed time in microseconds is
+// appended to each line. See LogLine for details on the format.
+func LogHandler(w io.Writer, h Handler) Handler {
+	return &logHandler{w: w, h: h}
+}
+
+// CombinedLogHandler returns a handler that writes a line in Apache Combined
+// Log Format to w for each request handled by h. The elapsed time in
+// microseconds is appended to each line.
+func CombinedLogHandler(w io.Writer, h Handler) Handler {
+	return &logHandler{w: w, h: h, combined: true}
+}
+
+type logHandler struct {
+	mu       sync.Mutex
+	w        io.Writer
+	h        Handler
+	combined bool
+}
+
+func (h *logHandler) ServeWeb(req *Request) {
+	start := time.Nanoseconds()
+	r := RecordResponse(req)
+	h.h.ServeWeb(req)
+	elapsed := time.Nanoseconds() - start
+
+	line := &LogLine{Request: req, Status: r.Status, Written: r.Written, Elapsed: elapsed, Combined: h.combined}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	line.WriteTo(h.w)
+}
+
+// ResponseRecorder is a Responder that records the response status and the
+// number of body bytes written by a handler. Calls to Respond and Hijack are
+// forwarded to the wrapped Responder.
+type ResponseRecorder struct {
+	Responder
+
+	// Status is the response status or zero if Respond was not called.
+	Status int
+
+	// Written is the number of response body bytes written.
+	Written int
+}
+
+// RecordResponse replaces the request's responder with a ResponseRecorder
+// wrapping the request's current responder and returns the recorder. This
+// function is intended to be used by middleware.
+func RecordResponse(req *Request) *ResponseRecorder {
+	r := &ResponseRecorder{Responder: req.Responder}
+	req.Responder = r
+	return r
+}
+
+// Done implements the DoneNotifier interface.
+func (r *ResponseRecorder) Done() <-chan bool {
+	return responderDone(r.Responder)
+}
+
+// Responded implements the RespondedReporter interface.
+func (r *ResponseRecorder) Responded() bool {
+	return responded(r.Responder)
+}
+
+func (r *ResponseRecorder) Respond(status int, header Header) io.Writer {
+	r.Status = status
+	return &recordedResponseBody{r.Responder.Respond(status, header), r}
+}
+
+type recordedResponseBody struct {
+	w io.Writer
+	r *ResponseRecorder
+}
+
+func (b *recordedResponseBody) Write(p []byte) (int, os.Error) {
+	n, err := b.w.Write(p)
+	b.r.Written += n
+	return n, err
+}
+
+// ReadFrom copies src using the wrapped writer's ReadFrom method when
+// available.
+func (b *recordedResponseBody) ReadFrom(src io.Reader) (n int64, err os.Error) {
+	if rf, ok := b.w.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(b.w, src)
+	}
+	b.r.Written += int(n)
+	return n, err
+}
+
+func (b *recordedResponseBody) Flush() os.Error {
+	if f, ok := b.w.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
@@ -15,8 +15,13 @@
 package web
 
 import (
+	"bytes"
+	"compress/gzip"
 	"io"
+	"io/ioutil"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -110,3 +115,200 @@ func TestXSRF(t *testing.T) {
 		}
 	}
 }
+
+var gzipTests = []struct {
+	acceptEncoding string
+	contentType    string
+	status         int
+	gzip           bool
+}{
+	{"", "text/plain", StatusOK, false},
+	{"gzip", "text/plain", StatusOK, true},
+	{"deflate, gzip", "text/plain", StatusOK, true},
+	{"gzip;q=0", "text/plain", StatusOK, false},
+	{"gzip", "image/png", StatusOK, false},
+	{"gzip", "text/event-stream", StatusOK, false},
+	{"gzip", "text/plain", StatusPartialContent, false},
+}
+
+func TestGzipHandler(t *testing.T) {
+	const body = "Hello World! Hello World! Hello World!"
+	h := GzipHandler(HandlerFunc(func(req *Request) {
+		status, _ := strconv.Atoi(req.Param.Get("st"))
+		w := req.Respond(status,
+			HeaderContentType, req.Param.Get("ct"),
+			HeaderContentLength, strconv.Itoa(len(body)))
+		if _, ok := w.(Flusher); !ok {
+			t.Errorf("%q, response body does not implement Flusher", req.URL)
+		}
+		io.WriteString(w, body)
+	}))
+	for _, tt := range gzipTests {
+		reqHeader := NewHeader()
+		if tt.acceptEncoding != "" {
+			reqHeader.Set(HeaderAcceptEncoding, tt.acceptEncoding)
+		}
+		_, header, p := RunHandler("/?ct="+tt.contentType+"&st="+strconv.Itoa(tt.status), "GET", reqHeader, nil, h)
+		if gz := header.Get(HeaderContentEncoding) == "gzip"; gz != tt.gzip {
+			t.Errorf("%q %q, gzip = %v, want %v", tt.acceptEncoding, tt.contentType, gz, tt.gzip)
+			continue
+		}
+		if !tt.gzip {
+			if string(p) != body {
+				t.Errorf("%q %q, body = %q, want %q", tt.acceptEncoding, tt.contentType, p, body)
+			}
+			continue
+		}
+		if header.Get(HeaderContentLength) != "" {
+			t.Errorf("%q %q, Content-Length not removed", tt.acceptEncoding, tt.contentType)
+		}
+		r, err := gzip.NewReader(strings.NewReader(string(p)))
+		if err != nil {
+			t.Errorf("%q %q, gzip.NewReader returned %v", tt.acceptEncoding, tt.contentType, err)
+			continue
+		}
+		p, err = ioutil.ReadAll(r)
+		if err != nil || string(p) != body {
+			t.Errorf("%q %q, body = %q, %v, want %q", tt.acceptEncoding, tt.contentType, p, err, body)
+		}
+	}
+}
+
+func TestGzipHandlerContentEncoding(t *testing.T) {
+	h := GzipHandler(HandlerFunc(func(req *Request) {
+		io.WriteString(req.Respond(StatusOK, HeaderContentType, "text/plain", HeaderContentEncoding, "br"), "x")
+	}))
+	_, header, p := RunHandler("/", "GET", NewHeader(HeaderAcceptEncoding, "gzip"), nil, h)
+	if ce := header.Get(HeaderContentEncoding); ce != "br" || string(p) != "x" {
+		t.Errorf("got Content-Encoding %q, body %q, want %q, %q", ce, p, "br", "x")
+	}
+}
+
+func traceMiddleware(name string) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(req *Request) {
+			req.Env["trace"] = req.Env["trace"].(string) + name
+			h.ServeWeb(req)
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	var trace string
+	var h Handler = HandlerFunc(func(req *Request) {
+		trace = req.Env["trace"].(string)
+		req.Respond(StatusOK)
+	})
+	h = Chain(traceMiddleware("a"), traceMiddleware("b"), traceMiddleware("c"))(h)
+	RunHandler("/", "GET", nil, nil, HandlerFunc(func(req *Request) {
+		req.Env["trace"] = ""
+		h.ServeWeb(req)
+	}))
+	if trace != "abc" {
+		t.Errorf("trace = %q, want %q", trace, "abc")
+	}
+}
+
+var logHandlerPattern = regexp.MustCompile(`^1\.2\.3\.4 - - \[[^\]]+\] "GET /a\?b=c HTTP/1\.1" 200 5 ("http://example\.com/" "agent" )?[0-9]+\n$`)
+
+func TestLogHandler(t *testing.T) {
+	h := HandlerFunc(func(req *Request) {
+		io.WriteString(req.Respond(StatusOK), "Hello")
+	})
+	for _, combined := range []bool{false, true} {
+		var b bytes.Buffer
+		lh := LogHandler(&b, h)
+		if combined {
+			lh = CombinedLogHandler(&b, h)
+		}
+		header := NewHeader(HeaderReferer, "http://example.com/", HeaderUserAgent, "agent")
+		RunHandler("/a?b=c", "GET", header, nil, lh)
+		line := b.String()
+		if !logHandlerPattern.MatchString(line) || combined != strings.Contains(line, "agent") {
+			t.Errorf("combined=%v, line %q", combined, line)
+		}
+	}
+}
+
+var escapeLogFieldTests = []struct {
+	s, want string
+}{
+	{"agent", "agent"},
+	{`a"b`, `a\"b`},
+	{`a\b`, `a\\b`},
+	{"a\nb\r\x00", `a\x0ab\x0d\x00`},
+	{"\xe2\x82\xac\x7f", `\xe2\x82\xac\x7f`},
+}
+
+func TestEscapeLogField(t *testing.T) {
+	for _, tt := range escapeLogFieldTests {
+		if got := escapeLogField(tt.s); got != tt.want {
+			t.Errorf("escapeLogField(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestLogHandlerEscape(t *testing.T) {
+	var b bytes.Buffer
+	h := CombinedLogHandler(&b, HandlerFunc(func(req *Request) { req.Respond(StatusOK) }))
+	header := NewHeader(HeaderUserAgent, "x\" 200 5 \"-\" \"-\" 1\n1.2.3.4 - - [x] \"GET /forged")
+	RunHandler("/", "GET", header, nil, h)
+	line := b.String()
+	if strings.Count(line, "\n") != 1 || !strings.Contains(line, `"x\" 200 5 \"-\" \"-\" 1\x0a1.2.3.4`) {
+		t.Errorf("line %q", line)
+	}
+}
+
+func TestResponseRecorder(t *testing.T) {
+	var r *ResponseRecorder
+	var hijackErr os.Error
+	RunHandler("/", "GET", nil, nil, HandlerFunc(func(req *Request) {
+		r = RecordResponse(req)
+		w := req.Respond(StatusNotFound)
+		io.WriteString(w, "Not")
+		io.WriteString(w, " Found")
+		io.Copy(w, strings.NewReader("!!!"))
+		_, _, hijackErr = req.Responder.Hijack()
+	}))
+	if r.Status != StatusNotFound || r.Written != 12 {
+		t.Errorf("Status, Written = %d, %d, want %d, %d", r.Status, r.Written, StatusNotFound, 12)
+	}
+	if hijackErr != nil {
+		t.Errorf("Hijack() returned error %v", hijackErr)
+	}
+}
+
+var forwardedTests = []struct {
+	trusted []string
+	header  Header
+	want    string
+}{
+	// Peer not trusted.
+	{[]string{"10.0.0.1"}, NewHeader(HeaderXForwardedFor, "5.6.7.8", HeaderXForwardedProto, "https"), "1.2.3.4 "},
+	// Peer trusted by address and range.
+	{[]string{"1.2.3.4"}, NewHeader(HeaderXForwardedFor, "5.6.7.8", HeaderXForwardedProto, "https"), "5.6.7.8:0 https"},
+	{[]string{"1.2.0.0/16"}, NewHeader(HeaderXForwardedFor, "5.6.7.8"), "5.6.7.8:0 "},
+	// Right-most untrusted address is used.
+	{[]string{"1.2.3.4", "10.0.0.0/8"}, NewHeader(HeaderXForwardedFor, "9.9.9.9, 5.6.7.8, 10.1.1.1"), "5.6.7.8:0 "},
+	{[]string{"1.2.3.4"}, NewHeader(HeaderXForwardedFor, "9.9.9.9, 5.6.7.8, 10.1.1.1"), "10.1.1.1:0 "},
+	// All addresses trusted.
+	{[]string{"1.2.3.4", "10.0.0.0/8"}, NewHeader(HeaderXForwardedFor, "10.2.2.2, 10.1.1.1"), "10.2.2.2:0 "},
+	// IPv6 client address.
+	{[]string{"1.2.3.4"}, NewHeader(HeaderXForwardedFor, "2001:db8::1"), "[2001:db8::1]:0 "},
+	// Bad values are ignored.
+	{[]string{"1.2.3.4"}, NewHeader(HeaderXForwardedFor, "unknown", HeaderXForwardedProto, "ftp"), "1.2.3.4 "},
+	// IPv6 range does not match IPv4 peer.
+	{[]string{"::/0"}, NewHeader(HeaderXForwardedFor, "5.6.7.8"), "1.2.3.4 "},
+}
+
+func TestForwardedHandler(t *testing.T) {
+	h := HandlerFunc(func(req *Request) {
+		io.WriteString(req.Respond(StatusOK), req.RemoteAddr+" "+req.URL.Scheme)
+	})
+	for _, tt := range forwardedTests {
+		_, _, body := RunHandler("/", "GET", tt.header, nil, ForwardedHandler(tt.trusted, h))
+		if string(body) != tt.want {
+			t.Errorf("trusted=%q, header=%v, got %q, want %q", tt.trusted, tt.header, body, tt.want)
+		}
+	}
+}
@@ -85,6 +85,7 @@ const (
 	StatusUnsupportedMediaType         = 415
 	StatusRequestedRangeNotSatisfiable = 416
 	StatusExpectationFailed            = 417
+	StatusRequestHeaderFieldsTooLarge  = 431
 	StatusInternalServerError          = 500
 	StatusNotImplemented               = 501
 	StatusBadGateway                   = 502
@@ -128,6 +129,7 @@ var statusText = map[int]string{
 	StatusUnsupportedMediaType:         "Unsupported Media Type",
 	StatusRequestedRangeNotSatisfiable: "Requested Range Not Satisfiable",
 	StatusExpectationFailed:            "Expectation Failed",
+	StatusRequestHeaderFieldsTooLarge:  "Request Header Fields Too Large",
 	StatusInternalServerError:          "Internal Server Error",
 	StatusNotImplemented:               "Not Implemented",
 	StatusBadGateway:                   "Bad Gateway",
@@ -187,8 +189,7 @@ func parseCookieValues(values []string, m Values) os.Error {
 				}
 			case ';':
 				if len(key) > 0 && begin < end {
-					value := s[begin:end]
-					m.Add(key, value)
+					m.Add(key, unquoteCookieValue(s[begin:end]))
 				}
 				key = ""
 				begin = i + 1
@@ -198,12 +199,96 @@ func parseCookieValues(values []string, m Values) os.Error {
 			}
 		}
 		if len(key) > 0 && begin < end {
-			m.Add(key, s[begin:end])
+			m.Add(key, unquoteCookieValue(s[begin:end]))
 		}
 	}
 	return nil
 }
 
+// unquoteCookieValue removes the optional double quotes around a cookie value.
+func unquoteCookieValue(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// isCookieOctet returns true if b can appear in a cookie value without
+// escaping (RFC 6265 section 4.1.1).
+func isCookieOctet(b byte) bool {
+	return b == 0x21 || (0x23 <= b && b <= 0x2b) || (0x2d <= b && b <= 0x3a) ||
+		(0x3c <= b && b <= 0x5b) || (0x5d <= b && b <= 0x7e)
+}
+
+// escapeCookieValue replaces '%' and the bytes that are not allowed in a
+// cookie value with %XX escapes. Values containing only allowed bytes other
+// than '%' are not changed.
+func escapeCookieValue(s string) string {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' || !isCookieOctet(s[i]) {
+			n++
+		}
+	}
+	if n == 0 {
+		return s
+	}
+	const hexDigits = "0123456789ABCDEF"
+	p := make([]byte, 0, len(s)+2*n)
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if b == '%' || !isCookieOctet(b) {
+			p = append(p, '%', hexDigits[b>>4], hexDigits[b&0xf])
+		} else {
+			p = append(p, b)
+		}
+	}
+	return string(p)
+}
+
+// UnescapeCookieValue reverses the escaping applied to values by
+// Cookie.String. Values that contain invalid escapes are returned unchanged.
+func UnescapeCookieValue(s string) string {
+	if strings.Index(s, "%") < 0 {
+		return s
+	}
+	p := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			p = append(p, s[i])
+			continue
+		}
+		if i+2 >= len(s) || !ishex(s[i+1]) || !ishex(s[i+2]) {
+			return s
+		}
+		p = append(p, unhex(s[i+1])<<4|unhex(s[i+2]))
+		i += 2
+	}
+	return string(p)
+}
+
+func ishex(b byte) bool {
+	return ('0' <= b && b <= '9') || ('a' <= b && b <= 'f') || ('A' <= b && b <= 'F')
+}
+
+func unhex(b byte) byte {
+	switch {
+	case '0' <= b && b <= '9':
+		return b - '0'
+	case 'a' <= b && b <= 'f':
+		return b - 'a' + 10
+	}
+	return b - 'A' + 10
+}
+
+// CookieValue returns the value of the named request cookie with the escaping
+// applied by Cookie.String removed. Use req.Cookie.Get to get the value as
+// sent by the client. Cookies set by other applications on the same domain
+// may not follow the escaping used by this package.
+func (req *Request) CookieValue(name string) string {
+	return UnescapeCookieValue(req.Cookie.Get(name))
+}
+
 func signature(secret, key, expiration, value string) string {
 	hm := hmac.NewSHA1([]byte(secret))
 	io.WriteString(hm, key)
@@ -316,10 +401,12 @@ func (c *Cookie) Path(path string) *Cookie { c.path = path; return c }
 // attribute is not included in the header value. 
 func (c *Cookie) Domain(domain string) *Cookie { c.domain = domain; return c }
 
-// MaxAge specifies the maximum age for a cookie. The age is converted to an
-// absolute expiration time when the header value is rendered. If the maximum
-// age is 0, then the expiration time is not included in the header value
-// and the browser will handle the cookie as a "session" cookie.
+// MaxAge specifies the maximum age for a cookie. The age is rendered as a
+// max-age attribute and as an absolute expiration time for older browsers. If
+// the maximum age is 0, then the attributes are not included in the header
+// value and the browser will handle the cookie as a "session" cookie. If the
+// maximum age is negative, then max-age is set to 0 and the expiration time is
+// in the past. Browsers delete the cookie in this case.
 func (c *Cookie) MaxAge(seconds int) *Cookie { c.maxAge = seconds; return c }
 
 // MaxAgeDays sets the maximum age for the cookie in days.
@@ -338,13 +425,15 @@ func (c *Cookie) HTTPOnly(httpOnly bool) *Cookie {
 	return c
 }
 
-// String renders the Set-Cookie header value as a string.
+// String renders the Set-Cookie header value as a string. The '%' character
+// and bytes not allowed in a cookie value are escaped as %XX. Use
+// Request.CookieValue to read the value.
 func (c *Cookie) String() string {
 	var buf bytes.Buffer
 
 	buf.WriteString(c.name)
 	buf.WriteByte('=')
-	buf.WriteString(c.value)
+	buf.WriteString(escapeCookieValue(c.value))
 
 	if c.path != "" {
 		buf.WriteString("; path=")
@@ -359,6 +448,12 @@ func (c *Cookie) String() string {
 	if c.maxAge != 0 {
 		buf.WriteString("; expires=")
 		buf.WriteString(FormatDeltaSeconds(c.maxAge))
+		buf.WriteString("; max-age=")
+		if c.maxAge > 0 {
+			buf.WriteString(strconv.Itoa(c.maxAge))
+		} else {
+			buf.WriteString("0")
+		}
 	}
 
 	if c.secure {
@@ -372,6 +467,55 @@ func (c *Cookie) String() string {
 	return buf.String()
 }
 
+// CheckETag sets the ETag response header to etag and returns true if etag
+// matches the request If-None-Match header. If CheckETag returns true, then
+// the application should respond with status StatusNotModified. The etag
+// argument is a quoted entity tag optionally prefixed with "W/" to indicate a
+// weak validator. Weak comparison is used to match the entity tags.
+func CheckETag(req *Request, header Header, etag string) bool {
+	header.Set(HeaderETag, etag)
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	etag = stripWeakPrefix(etag)
+	for _, tag := range req.Header.GetList(HeaderIfNoneMatch) {
+		if tag == "*" || stripWeakPrefix(tag) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func stripWeakPrefix(etag string) string {
+	if strings.HasPrefix(etag, "W/") {
+		return etag[2:]
+	}
+	return etag
+}
+
+// CheckLastModified sets the Last-Modified response header to modtime and
+// returns true if the resource was not modified since the time in the
+// request If-Modified-Since header. If CheckLastModified returns true, then
+// the application should respond with status StatusNotModified. The modtime
+// argument is in seconds since the epoch. If-Modified-Since is ignored when
+// the request has an If-None-Match header.
+func CheckLastModified(req *Request, header Header, modtime int64) bool {
+	header.Set(HeaderLastModified, time.SecondsToUTC(modtime).Format(TimeLayout))
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	if _, found := req.Header[HeaderIfNoneMatch]; found {
+		return false
+	}
+	t, err := time.Parse(TimeLayout, req.Header.Get(HeaderIfModifiedSince))
+	return err == nil && modtime <= t.Seconds()
+}
+
+// SetCookie adds the Set-Cookie header value for c to header.
+func SetCookie(header Header, c *Cookie) {
+	header.Add(HeaderSetCookie, c.String())
+}
+
 // HTMLEscapeString returns s with special HTML characters escaped. 
 func HTMLEscapeString(s string) string {
 	escape := false
@@ -16,6 +16,7 @@ package web
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -33,6 +34,10 @@ var ParseCookieValuesTests = []struct {
 	{[]string{" a=b;c=d "}, Values{"a": []string{"b"}, "c": []string{"d"}}},
 	{[]string{"a=b", "c=d"}, Values{"a": []string{"b"}, "c": []string{"d"}}},
 	{[]string{"a=b", "c=x=y"}, Values{"a": []string{"b"}, "c": []string{"x=y"}}},
+	{[]string{`a="b"; c="d e"`}, Values{"a": []string{"b"}, "c": []string{"d e"}}},
+	{[]string{`a=""`}, Values{"a": []string{""}}},
+	{[]string{"a=b; a=c"}, Values{"a": []string{"b", "c"}}},
+	{[]string{"a=x%3By+z"}, Values{"a": []string{"x%3By+z"}}},
 }
 
 func TestParseCookieValues(t *testing.T) {
@@ -56,3 +61,96 @@ func TestSignValue(t *testing.T) {
 		t.Error("verify failed", err, actualValue)
 	}
 }
+
+var cookieTests = []struct {
+	cookie   *Cookie
+	prefix   string
+	contains []string
+	absent   []string
+}{
+	{
+		NewCookie("a", "b"),
+		"a=b; path=/",
+		[]string{"; HttpOnly"},
+		[]string{"expires=", "max-age="},
+	},
+	{
+		NewCookie("a", "b").Path("").Domain("example.com").MaxAge(3600).Secure(true),
+		"a=b; domain=example.com; expires=",
+		[]string{"; max-age=3600", "; secure"},
+		nil,
+	},
+	{
+		NewCookie("a", "").Delete(),
+		"a=; path=/; expires=",
+		[]string{"; max-age=0"},
+		[]string{"HttpOnly"},
+	},
+}
+
+var cookieValueTests = []struct {
+	value   string
+	encoded string
+}{
+	{"", ""},
+	{"b", "b"},
+	{"a+b/c=", "a+b/c="},
+	{"x;y", "x%3By"},
+	{"x,y", "x%2Cy"},
+	{"x y", "x%20y"},
+	{" ; , =\"%+", "%20%3B%20%2C%20=%22%25+"},
+}
+
+func TestCookieValueRoundTrip(t *testing.T) {
+	for _, tt := range cookieValueTests {
+		header := NewHeader()
+		SetCookie(header, NewCookie("a", tt.value))
+		s := header.Get(HeaderSetCookie)
+		if !strings.HasPrefix(s, "a="+tt.encoded+";") {
+			t.Errorf("value %q, cookie %q, want value %q", tt.value, s, tt.encoded)
+			continue
+		}
+		req, _ := newTestRequest("/", "GET", NewHeader(HeaderCookie, s[:strings.Index(s, ";")]), nil)
+		if v := req.CookieValue("a"); v != tt.value {
+			t.Errorf("value %q, cookie %q, CookieValue returned %q", tt.value, s, v)
+		}
+	}
+}
+
+var unescapeCookieValueTests = []struct {
+	s, value string
+}{
+	{"a+b", "a+b"},
+	{"x%3By", "x;y"},
+	{"100%", "100%"},
+	{"%zz", "%zz"},
+}
+
+func TestUnescapeCookieValue(t *testing.T) {
+	for _, tt := range unescapeCookieValueTests {
+		if v := UnescapeCookieValue(tt.s); v != tt.value {
+			t.Errorf("UnescapeCookieValue(%q) = %q, want %q", tt.s, v, tt.value)
+		}
+	}
+}
+
+func TestCookie(t *testing.T) {
+	for _, tt := range cookieTests {
+		header := NewHeader()
+		SetCookie(header, tt.cookie)
+		s := header.Get(HeaderSetCookie)
+		if !strings.HasPrefix(s, tt.prefix) {
+			t.Errorf("cookie %q does not have prefix %q", s, tt.prefix)
+		}
+		for _, c := range tt.contains {
+			if !strings.Contains(s, c) {
+				t.Errorf("cookie %q does not contain %q", s, c)
+			}
+		}
+		for _, c := range tt.absent {
+			if strings.Contains(s, c) {
+				t.Errorf("cookie %q contains %q", s, c)
+			}
+		}
+	}
+}
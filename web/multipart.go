@@ -95,6 +95,157 @@ func ParseMultipartForm(req *Request, maxRequestBodyLen int) ([]Part, os.Error)
 	return parts, nil
 }
 
+// Default limits used by MultipartFormParser.
+const (
+	DefaultMaxMultipartPartSize   = 32 << 20
+	DefaultMaxMultipartFieldsSize = 10 << 20
+)
+
+// MultipartFormParser parses multipart/form-data request bodies with
+// configurable limits. A zero value for a limit selects the corresponding
+// default.
+type MultipartFormParser struct {
+	// Maximum number of bytes of file data stored in memory. The remaining
+	// files are stored in temporary files.
+	MaxMemory int
+
+	// Maximum size of a part.
+	MaxPartSize int
+
+	// Maximum total size of the form fields. The form fields are stored in
+	// memory.
+	MaxFieldsSize int
+}
+
+// FileHeader describes a file part of a multipart/form-data request body.
+type FileHeader struct {
+	// The filename parameter from the Content-Disposition header.
+	Filename string
+
+	// The part headers.
+	Header Header
+
+	data    []byte
+	tmpfile string
+}
+
+// Open returns a reader for the contents of the file.
+func (fh *FileHeader) Open() (io.ReadCloser, os.Error) {
+	if fh.tmpfile != "" {
+		return os.Open(fh.tmpfile)
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(fh.data)), nil
+}
+
+// ParseMultipartForm parses a multipart/form-data request body using a
+// MultipartFormParser with the default part and field size limits. Up to
+// maxMemory bytes of file data are stored in memory.
+func (req *Request) ParseMultipartForm(maxMemory int) (fields Values, files map[string][]*FileHeader, err os.Error) {
+	p := MultipartFormParser{MaxMemory: maxMemory}
+	return p.Parse(req)
+}
+
+// Parse parses a multipart/form-data request body. Form fields are returned
+// in fields and added to the request Param. File parts are returned in files.
+// Up to p.MaxMemory bytes of file data are stored in memory and the remaining
+// files are stored in temporary files. The temporary files are removed when
+// the request is finished. If a part is larger than p.MaxPartSize or the
+// total size of the form fields is larger than p.MaxFieldsSize, then
+// ErrRequestEntityTooLarge is returned.
+func (p *MultipartFormParser) Parse(req *Request) (fields Values, files map[string][]*FileHeader, err os.Error) {
+	maxMemory := p.MaxMemory
+	maxPartSize := p.MaxPartSize
+	if maxPartSize <= 0 {
+		maxPartSize = DefaultMaxMultipartPartSize
+	}
+	maxFieldsSize := p.MaxFieldsSize
+	if maxFieldsSize <= 0 {
+		maxFieldsSize = DefaultMaxMultipartFieldsSize
+	}
+
+	m, err := NewMultipartReader(req, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields = make(Values)
+	files = make(map[string][]*FileHeader)
+	var buf bytes.Buffer
+	for {
+		header, r, err := m.Next()
+		if err == os.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		disp, dispParam := header.GetValueParam(HeaderContentDisposition)
+		name := dispParam["name"]
+		if disp != "form-data" || name == "" {
+			continue
+		}
+		filename := dispParam["filename"]
+
+		// Read one byte past the limit to detect parts that are too large.
+		limit := maxPartSize
+		if filename == "" && maxFieldsSize < limit {
+			limit = maxFieldsSize
+		} else if filename != "" && maxMemory < limit {
+			limit = maxMemory
+		}
+		buf.Reset()
+		n, err := io.Copy(&buf, io.LimitReader(r, int64(limit)+1))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if n > int64(maxPartSize) || (filename == "" && n > int64(maxFieldsSize)) {
+			return nil, nil, ErrRequestEntityTooLarge
+		}
+
+		if filename == "" {
+			maxFieldsSize -= int(n)
+			fields.Add(name, buf.String())
+			req.Param.Add(name, buf.String())
+			continue
+		}
+
+		fh := &FileHeader{Filename: filename, Header: header}
+		if n <= int64(maxMemory) {
+			fh.data = append([]byte(nil), buf.Bytes()...)
+			maxMemory -= int(n)
+		} else {
+			fh.tmpfile, err = writeTempFile(req, &buf, r, int64(maxPartSize)-n)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		files[name] = append(files[name], fh)
+	}
+	return fields, files, nil
+}
+
+// writeTempFile writes the contents of buf followed by up to max bytes from r
+// to a temporary file. The file is removed when the request is finished.
+func writeTempFile(req *Request, buf *bytes.Buffer, r io.Reader, max int64) (string, os.Error) {
+	f, err := ioutil.TempFile("", "twister-multipart-")
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	req.OnFinish(func() { os.Remove(name) })
+	defer f.Close()
+	if _, err := buf.WriteTo(f); err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, max+1))
+	if err != nil {
+		return "", err
+	}
+	if n > max {
+		return "", ErrRequestEntityTooLarge
+	}
+	return name, nil
+}
+
 // MultipartReader reads a multipart/form-data request body.
 type MultipartReader struct {
 	br       *bufio.Reader
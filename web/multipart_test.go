@@ -15,6 +15,8 @@
 package web
 
 import (
+	"io/ioutil"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -155,3 +157,119 @@ func TestMultiPart(t *testing.T) {
 		}
 	}
 }
+
+func TestMultipartFiles(t *testing.T) {
+	body := "--deadbeef\r\n" +
+		"Content-Disposition: form-data; name=\"name\"\r\n" +
+		"\r\n" +
+		"value" +
+		"\r\n--deadbeef\r\n" +
+		"Content-Disposition: form-data; filename=\"small.txt\"; name=file\r\n" +
+		"\r\n" +
+		"small" +
+		"\r\n--deadbeef\r\n" +
+		"Content-Disposition: form-data; filename=\"large.txt\"; name=file\r\n" +
+		"\r\n" +
+		strings.Repeat("abcd", 1025) +
+		"\r\n--deadbeef--\r\n"
+	req, err := NewRequest(
+		"",
+		"",
+		&url.URL{},
+		ProtocolVersion11,
+		NewHeader(HeaderContentType, "multipart/form-data; boundary=deadbeef"))
+	if err != nil {
+		t.Fatal("error creating request")
+	}
+	req.Body = strings.NewReader(body)
+	fields, files, err := req.ParseMultipartForm(100)
+	if err != nil {
+		t.Fatalf("ParseMultipartForm returned error %v", err)
+	}
+	if v := fields.Get("name"); v != "value" {
+		t.Errorf("field name=%q, want %q", v, "value")
+	}
+	expected := []struct {
+		filename string
+		data     string
+		tmpfile  bool
+	}{
+		{"small.txt", "small", false},
+		{"large.txt", strings.Repeat("abcd", 1025), true},
+	}
+	if len(files["file"]) != len(expected) {
+		t.Fatalf("len(files) = %d, want %d", len(files["file"]), len(expected))
+	}
+	for i, fh := range files["file"] {
+		if fh.Filename != expected[i].filename {
+			t.Errorf("filename=%q, want %q", fh.Filename, expected[i].filename)
+		}
+		if tmpfile := fh.tmpfile != ""; tmpfile != expected[i].tmpfile {
+			t.Errorf("%s tmpfile=%v, want %v", fh.Filename, tmpfile, expected[i].tmpfile)
+		}
+		r, err := fh.Open()
+		if err != nil {
+			t.Errorf("%s open returned error %v", fh.Filename, err)
+			continue
+		}
+		p, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(p) != expected[i].data {
+			t.Errorf("%s data=%q, %v, want %q", fh.Filename, p, err, expected[i].data)
+		}
+	}
+	tmpfile := files["file"][1].tmpfile
+	req.Finish()
+	if _, err := os.Stat(tmpfile); err == nil {
+		t.Errorf("temporary file %s not removed", tmpfile)
+	}
+}
+
+var multipartFormParserTests = []struct {
+	parser MultipartFormParser
+	ok     bool
+}{
+	{MultipartFormParser{}, true},
+	{MultipartFormParser{MaxFieldsSize: 10}, true},
+	{MultipartFormParser{MaxFieldsSize: 9}, false},
+	{MultipartFormParser{MaxPartSize: 8}, true},
+	{MultipartFormParser{MaxPartSize: 7}, false},
+	{MultipartFormParser{MaxPartSize: 7, MaxMemory: 100}, false},
+}
+
+func TestMultipartFormParser(t *testing.T) {
+	body := "--deadbeef\r\n" +
+		"Content-Disposition: form-data; name=\"a\"\r\n" +
+		"\r\n" +
+		"Hello" +
+		"\r\n--deadbeef\r\n" +
+		"Content-Disposition: form-data; name=\"b\"\r\n" +
+		"\r\n" +
+		"World" +
+		"\r\n--deadbeef\r\n" +
+		"Content-Disposition: form-data; filename=\"f.txt\"; name=file\r\n" +
+		"\r\n" +
+		"01234567" +
+		"\r\n--deadbeef--\r\n"
+	for _, tt := range multipartFormParserTests {
+		req, err := NewRequest(
+			"",
+			"",
+			&url.URL{},
+			ProtocolVersion11,
+			NewHeader(HeaderContentType, "multipart/form-data; boundary=deadbeef"))
+		if err != nil {
+			t.Fatal("error creating request")
+		}
+		req.Body = strings.NewReader(body)
+		fields, _, err := tt.parser.Parse(req)
+		req.Finish()
+		if tt.ok {
+			if err != nil || fields.Get("a") != "Hello" || fields.Get("b") != "World" {
+				t.Errorf("%+v: got %v, %v, want fields a and b", tt.parser, fields, err)
+			}
+		} else if err != ErrRequestEntityTooLarge {
+			t.Errorf("%+v: error = %v, want %v", tt.parser, err, ErrRequestEntityTooLarge)
+		}
+	}
+}
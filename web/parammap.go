@@ -108,6 +108,13 @@ func dehex(c byte) byte {
 // ParseFormEncodedBytes parses the URL-encoded form and appends the values to
 // the supplied map. This function modifies the contents of p.
 func (m Values) ParseFormEncodedBytes(p []byte) os.Error {
+	return m.parseFormEncoded(p, true)
+}
+
+// parseFormEncoded parses the URL-encoded form and appends the values to the
+// map. If strict is false, then malformed percent escapes are copied to the
+// result unchanged instead of returning ErrBadFormat.
+func (m Values) parseFormEncoded(p []byte, strict bool) os.Error {
 	key := ""
 	j := 0
 	for i := 0; i < len(p); {
@@ -122,13 +129,19 @@ func (m Values) ParseFormEncodedBytes(p []byte) os.Error {
 			j = 0
 			i += 1
 		case '%':
-			if i+2 >= len(p) {
-				return ErrBadFormat
+			a, b := byte(notHex), byte(notHex)
+			if i+2 < len(p) {
+				a = dehex(p[i+1])
+				b = dehex(p[i+2])
 			}
-			a := dehex(p[i+1])
-			b := dehex(p[i+2])
 			if a == notHex || b == notHex {
-				return ErrBadFormat
+				if strict {
+					return ErrBadFormat
+				}
+				p[j] = p[i]
+				j += 1
+				i += 1
+				break
 			}
 			p[j] = a<<4 | b
 			j += 1
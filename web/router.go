@@ -17,6 +17,7 @@ package web
 import (
 	"bytes"
 	"regexp"
+	"sort"
 	"strings"
 	"url"
 )
@@ -34,14 +35,20 @@ import (
 // If the regular expression is not specified, then the regular expression is
 // set to to [^/]+.
 //
-// The pattern must begin with the character '/'.
+// The pattern must begin with the character '/' or be the pattern "*". The
+// pattern "*" matches the asterisk-form request target in "OPTIONS *"
+// requests.
 //
 // A router dispatches requests by matching the path component of the request
 // URL against the route patterns in the order that the routes were registered.
 // If a matching route is found, then the router searches the route for a
 // handler using the request method, "GET" if the request method is "HEAD" and
-// "*". If a handler is not found, the router responds with HTTP status 405. If
-// a route is not found, then the router responds with HTTP status 404.
+// "*". If a handler is not found, the router responds with HTTP status 405 and
+// an Allow header listing the methods registered for the route. If a route is
+// not found, then the router responds with HTTP status 404.
+//
+// A parameter with the regular expression .* matches the remainder of the
+// path. The pattern "/static/<path:.*>" is useful for serving files.
 //
 // The handler can access the path parameters in the request URLParam field.
 //
@@ -108,7 +115,7 @@ func compilePattern(pattern string, addSlash bool, sep string) (*regexp.Regexp,
 // where method is a string and handler is a Handler or a
 // func(*Request). Use "*" to match all methods.
 func (router *Router) Register(pattern string, handlers ...interface{}) *Router {
-	if pattern == "" || pattern[0] != '/' {
+	if pattern == "" || (pattern[0] != '/' && pattern != "*") {
 		panic("twister: Invalid route pattern " + pattern)
 	}
 	if len(handlers)%2 != 0 || len(handlers) == 0 {
@@ -143,6 +150,26 @@ func (status routerError) ServeWeb(req *Request) {
 	req.Error(int(status), nil)
 }
 
+// methodNotAllowed responds with HTTP status 405 and the allowed methods.
+type methodNotAllowed string
+
+func (allow methodNotAllowed) ServeWeb(req *Request) {
+	req.Error(StatusMethodNotAllowed, nil, HeaderAllow, string(allow))
+}
+
+// allow returns the value of the Allow header for the route.
+func (r *route) allow() string {
+	var methods []string
+	for method := range r.handlers {
+		methods = append(methods, method)
+	}
+	if r.handlers["GET"] != nil && r.handlers["HEAD"] == nil {
+		methods = append(methods, "HEAD")
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
 // addSlash redirects to the request URL with a trailing slash.
 func addSlash(req *Request) {
 	path := req.URL.Path + "/"
@@ -182,7 +209,7 @@ func (router *Router) find(path string, method string) (Handler, []string, []str
 		if handler := r.handlers["*"]; handler != nil {
 			return handler, r.names, values
 		}
-		return routerError(StatusMethodNotAllowed), nil, nil
+		return methodNotAllowed(r.allow()), nil, nil
 	}
 	return routerError(StatusNotFound), nil, nil
 }
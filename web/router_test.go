@@ -42,12 +42,13 @@ var routeTests = []struct {
 	method string
 	status int
 	body   string
+	allow  string
 }{
 	{url: "/Bogus/Path", method: "GET", status: StatusNotFound, body: ""},
 	{url: "/Bogus/Path", method: "POST", status: StatusNotFound, body: ""},
 	{url: "/", method: "GET", status: StatusOK, body: "home-get"},
 	{url: "/", method: "HEAD", status: StatusOK, body: "home-get"},
-	{url: "/", method: "POST", status: StatusMethodNotAllowed, body: ""},
+	{url: "/", method: "POST", status: StatusMethodNotAllowed, body: "", allow: "GET, HEAD"},
 	{url: "/a", method: "GET", status: StatusOK, body: "a-get"},
 	{url: "/a", method: "HEAD", status: StatusOK, body: "a-get"},
 	{url: "/a", method: "POST", status: StatusOK, body: "a-*"},
@@ -55,7 +56,7 @@ var routeTests = []struct {
 	{url: "/b", method: "GET", status: StatusOK, body: "b-get"},
 	{url: "/b", method: "HEAD", status: StatusOK, body: "b-get"},
 	{url: "/b", method: "POST", status: StatusOK, body: "b-post"},
-	{url: "/b", method: "PUT", status: StatusMethodNotAllowed, body: ""},
+	{url: "/b", method: "PUT", status: StatusMethodNotAllowed, body: "", allow: "GET, HEAD, POST"},
 	{url: "/c", method: "GET", status: StatusOK, body: "c-*"},
 	{url: "/c", method: "HEAD", status: StatusOK, body: "c-*"},
 	{url: "/d", method: "GET", status: StatusMovedPermanently, body: ""},
@@ -66,6 +67,9 @@ var routeTests = []struct {
 	{url: "/f/foo/bar/", method: "GET", status: StatusOK, body: "f x:foo y:bar"},
 	{url: "/g/foo", method: "GET", status: StatusNotFound, body: ""},
 	{url: "/g/99", method: "GET", status: StatusOK, body: "g x:99"},
+	{url: "/h/a/b.txt", method: "GET", status: StatusOK, body: "h path:a/b.txt"},
+	{url: "*", method: "OPTIONS", status: StatusOK, body: "options"},
+	{url: "/*", method: "OPTIONS", status: StatusNotFound, body: ""},
 }
 
 func TestRouter(t *testing.T) {
@@ -78,12 +82,17 @@ func TestRouter(t *testing.T) {
 	r.Register("/e/<x>", "GET", routeTestHandler("e"))
 	r.Register("/f/<x>/<y>/", "GET", routeTestHandler("f"))
 	r.Register("/g/<x:[0-9]+>", "GET", routeTestHandler("g"))
+	r.Register("/h/<path:.*>", "GET", routeTestHandler("h"))
+	r.Register("*", "OPTIONS", routeTestHandler("options"))
 
 	for _, rt := range routeTests {
-		status, _, body := RunHandler(rt.url, rt.method, nil, nil, r)
+		status, header, body := RunHandler(rt.url, rt.method, nil, nil, r)
 		if status != rt.status {
 			t.Errorf("url=%s method=%s, status=%d, want %d", rt.url, rt.method, status, rt.status)
 		}
+		if allow := header.Get(HeaderAllow); allow != rt.allow {
+			t.Errorf("url=%s method=%s, allow=%q, want %q", rt.url, rt.method, allow, rt.allow)
+		}
 		if status == StatusOK {
 			if string(body) != rt.body {
 				t.Errorf("url=%s method=%s body=%q, want %q", rt.url, rt.method, string(body), rt.body)
@@ -119,3 +128,18 @@ func TestHostRouter(t *testing.T) {
 		}
 	}
 }
+
+func TestURLParamQuery(t *testing.T) {
+	var year, slug, missing, query string
+	r := NewRouter().Register("/posts/<year>/<slug>", "GET", func(req *Request) {
+		year = req.URLParam["year"]
+		slug = req.URLParam["slug"]
+		missing = req.URLParam["missing"]
+		query = req.Param.Get("year")
+		req.Respond(StatusOK)
+	})
+	RunHandler("/posts/2011/hello?year=query", "GET", nil, nil, r)
+	if year != "2011" || slug != "hello" || missing != "" || query != "query" {
+		t.Errorf("year=%q slug=%q missing=%q query=%q", year, slug, missing, query)
+	}
+}
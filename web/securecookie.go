@@ -0,0 +1,128 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+)
+
+// SecureCookie encodes and decodes tamper-evident cookie values. Values are
+// signed with SignValue and optionally encrypted with AES. The encoded value
+// contains only characters that are safe to use in a cookie.
+//
+// The following example stores a user id in a cookie:
+//
+//  var uidCookie = &web.SecureCookie{Secret: secret, MaxAge: 3600 * 24 * 30}
+//
+//  func login(req *web.Request, uid string) {
+//      c, err := uidCookie.NewCookie("uid", uid)
+//      if err != nil {
+//          req.Error(web.StatusInternalServerError, err)
+//          return
+//      }
+//      req.Redirect("/", false, web.HeaderSetCookie, c.String())
+//  }
+//
+//  func requestUid(req *web.Request) (string, os.Error) {
+//      return uidCookie.Get(req, "uid")
+//  }
+type SecureCookie struct {
+	// Secret used to sign values.
+	Secret string
+
+	// If not nil, values are encrypted with AES using this key. The key
+	// length must be 16, 24 or 32 bytes.
+	EncryptionKey []byte
+
+	// Maximum age of the cookie in seconds. Values older than MaxAge are
+	// rejected by Decode. MaxAge must be greater than zero.
+	MaxAge int
+}
+
+// Encode returns the signed and optionally encrypted value. The cookie name
+// is included in the signature so that a value cannot be moved to a cookie
+// with a different name.
+func (sc *SecureCookie) Encode(name, value string) (string, os.Error) {
+	p := []byte(value)
+	if sc.EncryptionKey != nil {
+		block, err := aes.NewCipher(sc.EncryptionKey)
+		if err != nil {
+			return "", err
+		}
+		iv := make([]byte, block.BlockSize(), block.BlockSize()+len(p))
+		if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+			return "", err
+		}
+		cipher.NewCTR(block, iv).XORKeyStream(p, p)
+		p = append(iv, p...)
+	}
+	b := make([]byte, base64.URLEncoding.EncodedLen(len(p)))
+	base64.URLEncoding.Encode(b, p)
+	return SignValue(sc.Secret, name, sc.MaxAge, string(b)), nil
+}
+
+// Decode returns the value from a string created by Encode. An error is
+// returned if the value has expired or the signature is not correct.
+func (sc *SecureCookie) Decode(name, s string) (string, os.Error) {
+	s, err := VerifyValue(sc.Secret, name, s)
+	if err != nil {
+		return "", err
+	}
+	p := make([]byte, base64.URLEncoding.DecodedLen(len(s)))
+	n, err := base64.URLEncoding.Decode(p, []byte(s))
+	if err != nil {
+		return "", errVerificationFailure
+	}
+	p = p[:n]
+	if sc.EncryptionKey != nil {
+		block, err := aes.NewCipher(sc.EncryptionKey)
+		if err != nil {
+			return "", err
+		}
+		if len(p) < block.BlockSize() {
+			return "", errVerificationFailure
+		}
+		iv := p[:block.BlockSize()]
+		p = p[block.BlockSize():]
+		cipher.NewCTR(block, iv).XORKeyStream(p, p)
+	}
+	return string(p), nil
+}
+
+// NewCookie returns a cookie with the given name and the encoded value. The
+// cookie's maximum age is set to sc.MaxAge.
+func (sc *SecureCookie) NewCookie(name, value string) (*Cookie, os.Error) {
+	s, err := sc.Encode(name, value)
+	if err != nil {
+		return nil, err
+	}
+	return NewCookie(name, s).MaxAge(sc.MaxAge), nil
+}
+
+// Get returns the decoded value of the named request cookie. An error is
+// returned if the cookie is missing, the value has expired or the signature
+// is not correct.
+func (sc *SecureCookie) Get(req *Request, name string) (string, os.Error) {
+	s := req.Cookie.Get(name)
+	if s == "" {
+		return "", errVerificationFailure
+	}
+	return sc.Decode(name, s)
+}
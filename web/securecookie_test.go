@@ -0,0 +1,60 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"strings"
+	"testing"
+)
+
+var secureCookieTests = []*SecureCookie{
+	&SecureCookie{Secret: "secret", MaxAge: 3600},
+	&SecureCookie{Secret: "secret", MaxAge: 3600, EncryptionKey: []byte("0123456789abcdef")},
+}
+
+func TestSecureCookie(t *testing.T) {
+	const value = "uid=1234; role=admin"
+	for _, sc := range secureCookieTests {
+		s, err := sc.Encode("uid", value)
+		if err != nil {
+			t.Errorf("Encode(%q) returned error %v", value, err)
+			continue
+		}
+		if strings.IndexAny(s, " ;,\"=") >= 0 {
+			t.Errorf("Encode(%q) = %q, contains characters not allowed in cookie", value, s)
+		}
+		if sc.EncryptionKey != nil && strings.Contains(s, "1234") {
+			t.Errorf("Encode(%q) = %q, not encrypted", value, s)
+		}
+		if v, err := sc.Decode("uid", s); err != nil || v != value {
+			t.Errorf("Decode(%q) = %q, %v, want %q", s, v, err, value)
+		}
+		if _, err := sc.Decode("other", s); err == nil {
+			t.Errorf("Decode with different name did not return error")
+		}
+		tampered := s[:len(s)-1] + "A"
+		if tampered == s {
+			tampered = s[:len(s)-1] + "B"
+		}
+		if _, err := sc.Decode("uid", tampered); err == nil {
+			t.Errorf("Decode(%q) did not return error for tampered value", tampered)
+		}
+		expired := &SecureCookie{Secret: sc.Secret, EncryptionKey: sc.EncryptionKey, MaxAge: -1}
+		s, _ = expired.Encode("uid", value)
+		if _, err := sc.Decode("uid", s); err == nil {
+			t.Errorf("Decode did not return error for expired value")
+		}
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SessionStore is the interface for session storage backends. Applications
+// can implement the interface to keep sessions in a database, memcached or
+// another shared store.
+type SessionStore interface {
+	// Get returns the values for the session with the given id. Get returns
+	// nil, nil if the session is not found.
+	Get(id string) (map[string]string, os.Error)
+
+	// Save stores the values for the session with the given id.
+	Save(id string, values map[string]string) os.Error
+
+	// Delete removes the session with the given id.
+	Delete(id string) os.Error
+}
+
+// MemorySessionStore is a SessionStore that keeps sessions in memory. The
+// store is intended for development. Sessions are lost when the process
+// exits.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*memorySession
+	maxAge   int64 // nanoseconds
+	ticker   *time.Ticker
+	done     chan bool // closed by Close
+}
+
+type memorySession struct {
+	values   map[string]string
+	accessed int64
+}
+
+// NewMemorySessionStore returns a new in-memory session store. Sessions that
+// are not accessed for maxAgeSeconds are expired and removed from the store
+// by a background goroutine. NewMemorySessionStore panics if maxAgeSeconds
+// is not greater than zero. Call Close to stop the goroutine when the store
+// is no longer used.
+func NewMemorySessionStore(maxAgeSeconds int) *MemorySessionStore {
+	if maxAgeSeconds <= 0 {
+		panic("twister: bad session max age " + strconv.Itoa(maxAgeSeconds))
+	}
+	s := &MemorySessionStore{
+		sessions: make(map[string]*memorySession),
+		maxAge:   int64(maxAgeSeconds) * 1e9,
+		done:     make(chan bool),
+	}
+	s.ticker = time.NewTicker(s.maxAge)
+	go s.collect(s.ticker)
+	return s
+}
+
+// Close stops the goroutine that removes expired sessions. The store can
+// be used after Close, but expired sessions are only removed by Get.
+func (s *MemorySessionStore) Close() os.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ticker != nil {
+		s.ticker.Stop()
+		s.ticker = nil
+		close(s.done)
+	}
+	return nil
+}
+
+// collect removes expired sessions on each tick until the store is closed.
+func (s *MemorySessionStore) collect(ticker *time.Ticker) {
+	for {
+		select {
+		case now := <-ticker.C:
+			s.removeExpired(now)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// removeExpired removes the sessions not accessed since now - maxAge.
+func (s *MemorySessionStore) removeExpired(now int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if session.accessed+s.maxAge < now {
+			s.sessions[id] = nil, false
+		}
+	}
+}
+
+func copySessionValues(values map[string]string) map[string]string {
+	result := make(map[string]string, len(values))
+	for k, v := range values {
+		result[k] = v
+	}
+	return result
+}
+
+// Get implements the SessionStore interface.
+func (s *MemorySessionStore) Get(id string) (map[string]string, os.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, found := s.sessions[id]
+	if !found {
+		return nil, nil
+	}
+	now := time.Nanoseconds()
+	if session.accessed+s.maxAge < now {
+		s.sessions[id] = nil, false
+		return nil, nil
+	}
+	session.accessed = now
+	return copySessionValues(session.values), nil
+}
+
+// Save implements the SessionStore interface.
+func (s *MemorySessionStore) Save(id string, values map[string]string) os.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[id] = &memorySession{values: copySessionValues(values), accessed: time.Nanoseconds()}
+	return nil
+}
+
+// Delete implements the SessionStore interface.
+func (s *MemorySessionStore) Delete(id string) os.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[id] = nil, false
+	return nil
+}
+
+// Session holds values that persist across requests from the same client.
+// Use Request.Session to get the session for a request.
+type Session struct {
+	id       string
+	values   map[string]string
+	isNew    bool
+	modified bool
+	deleted  bool
+}
+
+// Get returns the value for the given key or "" if the key is not found.
+func (s *Session) Get(key string) string {
+	return s.values[key]
+}
+
+// Set sets the value for the given key.
+func (s *Session) Set(key, value string) {
+	s.values[key] = value
+	s.modified = true
+	s.deleted = false
+}
+
+// Del removes the value for the given key.
+func (s *Session) Del(key string) {
+	s.values[key] = "", false
+	s.modified = true
+}
+
+// Clear removes all values from the session and deletes the session from the
+// store.
+func (s *Session) Clear() {
+	s.values = make(map[string]string)
+	s.deleted = true
+	s.modified = true
+}
+
+// sessionEnvKey is the key for the session in the request Env.
+const sessionEnvKey = "twister.web.Session"
+
+// Session returns the session attached to the request by SessionHandler or
+// nil if the request does not have a session.
+func (req *Request) Session() *Session {
+	s, _ := req.Env[sessionEnvKey].(*Session)
+	return s
+}
+
+// SessionHandler returns a handler that attaches a session to the request and
+// then calls h. The session id is stored in the cookie cookieName and signed
+// with sc. Session values are kept in store.
+//
+// The session is saved and a new session cookie is set when the handler calls
+// Respond. Changes to the session after the call to Respond are not saved.
+//
+//  store := web.NewMemorySessionStore(3600 * 24)
+//  sc := &web.SecureCookie{Secret: secret, MaxAge: 3600 * 24}
+//  h = web.SessionHandler(store, sc, "session", h)
+func SessionHandler(store SessionStore, sc *SecureCookie, cookieName string, h Handler) Handler {
+	return &sessionHandler{store: store, sc: sc, cookieName: cookieName, h: h}
+}
+
+type sessionHandler struct {
+	store      SessionStore
+	sc         *SecureCookie
+	cookieName string
+	h          Handler
+}
+
+// newSessionID returns an unguessable session id.
+func newSessionID() (string, os.Error) {
+	p := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, p); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(p), nil
+}
+
+func (h *sessionHandler) ServeWeb(req *Request) {
+	s := &Session{}
+	if id, err := h.sc.Get(req, h.cookieName); err == nil {
+		values, err := h.store.Get(id)
+		if err != nil {
+			req.Error(StatusInternalServerError, err)
+			return
+		}
+		if values != nil {
+			s.id = id
+			s.values = values
+		}
+	}
+	if s.values == nil {
+		id, err := newSessionID()
+		if err != nil {
+			req.Error(StatusInternalServerError, err)
+			return
+		}
+		s.id = id
+		s.values = make(map[string]string)
+		s.isNew = true
+	}
+
+	req.Env[sessionEnvKey] = s
+	FilterRespond(req, func(status int, header Header) (int, Header) {
+		h.save(req, s, header)
+		return status, header
+	})
+	h.h.ServeWeb(req)
+}
+
+// save persists a modified session and adds the session cookie to header.
+// The response is already started when save is called, so errors are logged.
+func (h *sessionHandler) save(req *Request, s *Session, header Header) {
+	if !s.modified {
+		return
+	}
+	s.modified = false
+	if s.deleted {
+		if !s.isNew {
+			if err := h.store.Delete(s.id); err != nil {
+				log.Println("twister: session delete failed for", req.URL, err)
+			}
+		}
+		header.Add(HeaderSetCookie, NewCookie(h.cookieName, "").Delete().String())
+		return
+	}
+	if err := h.store.Save(s.id, s.values); err != nil {
+		log.Println("twister: session save failed for", req.URL, err)
+		return
+	}
+	if s.isNew {
+		c, err := h.sc.NewCookie(h.cookieName, s.id)
+		if err != nil {
+			log.Println("twister: session cookie failed for", req.URL, err)
+			return
+		}
+		header.Add(HeaderSetCookie, c.String())
+		s.isNew = false
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionHandler(t *testing.T) {
+	store := NewMemorySessionStore(3600)
+	defer store.Close()
+	sc := &SecureCookie{Secret: "secret", MaxAge: 3600}
+	h := SessionHandler(store, sc, "session", HandlerFunc(func(req *Request) {
+		s := req.Session()
+		if v := req.Param.Get("set"); v != "" {
+			s.Set("uid", v)
+		}
+		if req.Param.Get("clear") != "" {
+			s.Clear()
+		}
+		w := req.Respond(StatusOK)
+		io.WriteString(w, s.Get("uid"))
+	}))
+
+	// New session without changes does not set a cookie.
+	_, header, body := RunHandler("/", "GET", NewHeader(), nil, h)
+	if c := header.Get(HeaderSetCookie); c != "" || string(body) != "" {
+		t.Fatalf("unmodified session, cookie = %q, body = %q", c, body)
+	}
+
+	_, header, body = RunHandler("/?set=1234", "GET", NewHeader(), nil, h)
+	c := header.Get(HeaderSetCookie)
+	if !strings.HasPrefix(c, "session=") || string(body) != "1234" {
+		t.Fatalf("set session, cookie = %q, body = %q", c, body)
+	}
+	cookie := c[:strings.Index(c, ";")]
+
+	_, header, body = RunHandler("/", "GET", NewHeader(HeaderCookie, cookie), nil, h)
+	if c := header.Get(HeaderSetCookie); c != "" || string(body) != "1234" {
+		t.Errorf("existing session, cookie = %q, body = %q, want body 1234", c, body)
+	}
+
+	_, header, body = RunHandler("/", "GET", NewHeader(HeaderCookie, "session=bad"), nil, h)
+	if string(body) != "" {
+		t.Errorf("bad cookie, body = %q, want empty", body)
+	}
+
+	RunHandler("/?clear=1", "GET", NewHeader(HeaderCookie, cookie), nil, h)
+	_, header, body = RunHandler("/", "GET", NewHeader(HeaderCookie, cookie), nil, h)
+	if string(body) != "" {
+		t.Errorf("cleared session, body = %q, want empty", body)
+	}
+}
+
+func TestMemorySessionStoreExpire(t *testing.T) {
+	store := NewMemorySessionStore(3600)
+	defer store.Close()
+	store.Save("a", map[string]string{"k": "v"})
+	store.Save("b", map[string]string{"k": "v"})
+	store.sessions["a"].accessed -= 2 * store.maxAge
+	if values, _ := store.Get("a"); values != nil {
+		t.Errorf("Get(expired) = %v, want nil", values)
+	}
+	store.sessions["b"].accessed -= 2 * store.maxAge
+	store.removeExpired(time.Nanoseconds())
+	if len(store.sessions) != 0 {
+		t.Errorf("removeExpired left %d sessions, want 0", len(store.sessions))
+	}
+}
+
+func TestMemorySessionStoreClose(t *testing.T) {
+	store := NewMemorySessionStore(3600)
+	stopped := make(chan bool, 1)
+	go func() {
+		store.collect(time.NewTicker(1e7))
+		stopped <- true
+	}()
+	store.Close()
+	select {
+	case <-stopped:
+	case <-time.After(1e9):
+		t.Fatal("collect did not return after Close")
+	}
+	store.Close()
+	store.Save("a", map[string]string{"k": "v"})
+	if values, _ := store.Get("a"); values["k"] != "v" {
+		t.Errorf("Get after Close = %v, want k=v", values)
+	}
+}
+
+type failingSessionStore struct{ *MemorySessionStore }
+
+func (s failingSessionStore) Save(id string, values map[string]string) os.Error {
+	return os.NewError("save failed")
+}
+
+func TestSessionHandlerSaveError(t *testing.T) {
+	store := NewMemorySessionStore(3600)
+	defer store.Close()
+	sc := &SecureCookie{Secret: "secret", MaxAge: 3600}
+	h := SessionHandler(failingSessionStore{store}, sc, "session", HandlerFunc(func(req *Request) {
+		req.Session().Set("uid", "1")
+		req.Respond(StatusOK)
+	}))
+	status, header, _ := RunHandler("/", "GET", NewHeader(), nil, h)
+	if status != StatusOK || header.Get(HeaderSetCookie) != "" {
+		t.Errorf("got %d, Set-Cookie %q, want %d and no cookie", status, header.Get(HeaderSetCookie), StatusOK)
+	}
+}
+
+func TestNewMemorySessionStoreMaxAge(t *testing.T) {
+	for _, maxAge := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewMemorySessionStore(%d) did not panic", maxAge)
+				}
+			}()
+			NewMemorySessionStore(maxAge).Close()
+		}()
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+)
+
+// sniffLen is the maximum number of bytes examined by DetectContentType.
+const sniffLen = 512
+
+// htmlSigs are the tags that identify an HTML document. A tag matches if it
+// is followed by a space or '>'. The tags are matched without regard to case.
+var htmlSigs = []string{
+	"<!DOCTYPE HTML", "<HTML", "<HEAD", "<SCRIPT", "<IFRAME", "<H1", "<DIV",
+	"<FONT", "<TABLE", "<A", "<STYLE", "<TITLE", "<B", "<BODY", "<BR", "<P",
+	"<!--",
+}
+
+// prefixSigs are the byte prefixes that identify binary and encoded text
+// formats.
+var prefixSigs = []struct {
+	prefix      string
+	contentType string
+}{
+	{"%PDF-", "application/pdf"},
+	{"%!PS-Adobe-", "application/postscript"},
+	{"\xFE\xFF", "text/plain; charset=utf-16be"},
+	{"\xFF\xFE", "text/plain; charset=utf-16le"},
+	{"\xEF\xBB\xBF", "text/plain; charset=utf-8"},
+	{"GIF87a", "image/gif"},
+	{"GIF89a", "image/gif"},
+	{"\x89PNG\x0D\x0A\x1A\x0A", "image/png"},
+	{"\xFF\xD8\xFF", "image/jpeg"},
+	{"BM", "image/bmp"},
+	{"\x00\x00\x01\x00", "image/vnd.microsoft.icon"},
+	{"OggS\x00", "application/ogg"},
+	{"PK\x03\x04", "application/zip"},
+	{"\x1F\x8B\x08", "application/x-gzip"},
+}
+
+// isBinary returns true if c does not appear in plain text.
+func isBinary(c byte) bool {
+	return c <= 0x08 || c == 0x0B || (0x0E <= c && c <= 0x1A) || (0x1C <= c && c <= 0x1F)
+}
+
+// DetectContentType returns the content type of the data in p. At most the
+// first 512 bytes of p are examined. The function returns
+// "application/octet-stream" if the data does not match a known format.
+func DetectContentType(p []byte) string {
+	if len(p) > sniffLen {
+		p = p[:sniffLen]
+	}
+
+	// Markup can be preceded by whitespace.
+	q := bytes.TrimLeft(p, "\t\n\x0C\r ")
+	for _, sig := range htmlSigs {
+		if len(q) > len(sig) &&
+			strings.ToUpper(string(q[:len(sig)])) == sig &&
+			(q[len(sig)] == ' ' || q[len(sig)] == '>') {
+			return "text/html; charset=utf-8"
+		}
+	}
+	if bytes.HasPrefix(q, []byte("<?xml")) {
+		return "text/xml; charset=utf-8"
+	}
+
+	for _, sig := range prefixSigs {
+		if bytes.HasPrefix(p, []byte(sig.prefix)) {
+			return sig.contentType
+		}
+	}
+	if len(p) >= 14 && string(p[:4]) == "RIFF" && string(p[8:14]) == "WEBPVP" {
+		return "image/webp"
+	}
+
+	for _, c := range p {
+		if isBinary(c) {
+			return "application/octet-stream"
+		}
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// SniffHandler returns a handler that sets the Content-Type header in
+// responses from h that do not specify a content type. The content type is
+// detected from the first 512 bytes of the response body using
+// DetectContentType. The response is sent when 512 bytes are written, when
+// the handler flushes the response or when the handler returns.
+//
+// To combine with GzipHandler, wrap the sniff handler with the gzip handler
+// so that the content type is detected from the uncompressed data:
+//
+//  h = web.GzipHandler(web.SniffHandler(h))
+func SniffHandler(h Handler) Handler {
+	return sniffHandler{h}
+}
+
+type sniffHandler struct {
+	h Handler
+}
+
+func (h sniffHandler) ServeWeb(req *Request) {
+	r := &sniffResponder{Responder: req.Responder}
+	req.Responder = r
+	h.h.ServeWeb(req)
+	if r.w != nil {
+		r.w.start()
+	}
+}
+
+type sniffResponder struct {
+	Responder
+	w *sniffResponseBody
+}
+
+func (r *sniffResponder) Respond(status int, header Header) io.Writer {
+	if status < StatusOK || status == StatusNoContent || status == StatusNotModified ||
+		header.Get(HeaderContentType) != "" || header.Get(HeaderContentEncoding) != "" {
+		return r.Responder.Respond(status, header)
+	}
+	r.w = &sniffResponseBody{r: r.Responder, status: status, header: header}
+	return r.w
+}
+
+func (r *sniffResponder) Done() <-chan bool {
+	return responderDone(r.Responder)
+}
+
+func (r *sniffResponder) Responded() bool {
+	return r.w != nil || responded(r.Responder)
+}
+
+// sniffResponseBody buffers the start of the response body until the content
+// type is detected.
+type sniffResponseBody struct {
+	r      Responder
+	status int
+	header Header
+	buf    []byte
+	w      io.Writer // set after the response is started
+}
+
+// start detects the content type and calls the wrapped responder with the
+// buffered data.
+func (b *sniffResponseBody) start() os.Error {
+	if b.w != nil {
+		return nil
+	}
+	b.header.Set(HeaderContentType, DetectContentType(b.buf))
+	b.w = b.r.Respond(b.status, b.header)
+	p := b.buf
+	b.buf = nil
+	if len(p) > 0 {
+		if _, err := b.w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *sniffResponseBody) Write(p []byte) (int, os.Error) {
+	if b.w != nil {
+		return b.w.Write(p)
+	}
+	n := sniffLen - len(b.buf)
+	if n > len(p) {
+		n = len(p)
+	}
+	b.buf = append(b.buf, p[:n]...)
+	if len(b.buf) < sniffLen {
+		return n, nil
+	}
+	if err := b.start(); err != nil {
+		return 0, err
+	}
+	if n < len(p) {
+		m, err := b.w.Write(p[n:])
+		return n + m, err
+	}
+	return n, nil
+}
+
+func (b *sniffResponseBody) Flush() os.Error {
+	if err := b.start(); err != nil {
+		return err
+	}
+	if f, ok := b.w.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+var detectContentTypeTests = []struct {
+	data        string
+	contentType string
+}{
+	{"", "text/plain; charset=utf-8"},
+	{"Hello, World!\n", "text/plain; charset=utf-8"},
+	{"<html><body>Hello</body></html>", "text/html; charset=utf-8"},
+	{"\n  <!DOCTYPE html>\n<html>", "text/html; charset=utf-8"},
+	{"<HtMl>", "text/html; charset=utf-8"},
+	{"<p>paragraph</p>", "text/html; charset=utf-8"},
+	{"<pre>", "text/plain; charset=utf-8"},
+	{"<?xml version=\"1.0\"?><a/>", "text/xml; charset=utf-8"},
+	{"%PDF-1.4", "application/pdf"},
+	{"GIF89a...", "image/gif"},
+	{"\x89PNG\x0D\x0A\x1A\x0A....", "image/png"},
+	{"\xFF\xD8\xFF\xE0", "image/jpeg"},
+	{"RIFF\x00\x00\x00\x00WEBPVP8 ", "image/webp"},
+	{"PK\x03\x04", "application/zip"},
+	{"\x1F\x8B\x08\x00", "application/x-gzip"},
+	{"\xEF\xBB\xBFHello", "text/plain; charset=utf-8"},
+	{"\x00\x01\x02\x03", "application/octet-stream"},
+	{strings.Repeat("x", sniffLen) + "\x00", "text/plain; charset=utf-8"},
+}
+
+func TestDetectContentType(t *testing.T) {
+	for _, tt := range detectContentTypeTests {
+		if contentType := DetectContentType([]byte(tt.data)); contentType != tt.contentType {
+			t.Errorf("DetectContentType(%q) = %q, want %q", tt.data, contentType, tt.contentType)
+		}
+	}
+}
+
+var sniffHandlerTests = []struct {
+	writes      []string
+	header      []string
+	contentType string
+}{
+	{nil, nil, "text/plain; charset=utf-8"},
+	{[]string{"<html>", "<body>Hello</body></html>"}, nil, "text/html; charset=utf-8"},
+	{[]string{"Hello"}, []string{HeaderContentType, "image/png"}, "image/png"},
+	{[]string{strings.Repeat("x", sniffLen-1), "\x00" + strings.Repeat("y", 100)}, nil, "application/octet-stream"},
+	{[]string{"Hello", "", "\x00"}, nil, "text/plain; charset=utf-8"},
+}
+
+func TestSniffHandler(t *testing.T) {
+	for _, tt := range sniffHandlerTests {
+		status, header, body := RunHandler("/", "GET", nil, nil, SniffHandler(HandlerFunc(func(req *Request) {
+			w := req.Respond(StatusOK, tt.header...)
+			for _, s := range tt.writes {
+				if s == "" {
+					w.(Flusher).Flush()
+				} else {
+					io.WriteString(w, s)
+				}
+			}
+		})))
+		want := strings.Join(tt.writes, "")
+		if status != StatusOK || string(body) != want || header.Get(HeaderContentType) != tt.contentType {
+			t.Errorf("%q: got %d, %q, %q, want %d, %q, %q", tt.writes,
+				status, header.Get(HeaderContentType), body, StatusOK, tt.contentType, want)
+		}
+	}
+}
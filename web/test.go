@@ -24,16 +24,29 @@ import (
 )
 
 type testTransaction struct {
-	in, out bytes.Buffer
-	status  int
-	header  Header
+	in, out   bytes.Buffer
+	status    int
+	header    Header
+	responded bool
+	err       os.Error
 }
 
 type testResponder struct {
 	t *testTransaction
 }
 
+// testResponder must implement the same Responder interface as the server.
+var (
+	_ Responder         = testResponder{}
+	_ RespondedReporter = testResponder{}
+)
+
 func (r testResponder) Respond(status int, header Header) io.Writer {
+	if r.t.responded {
+		r.t.err = os.NewError("twister: multiple calls to Respond")
+		return &bytes.Buffer{}
+	}
+	r.t.responded = true
 	r.t.status = status
 	r.t.header = header
 	return testResponseBody{r.t}
@@ -43,6 +56,10 @@ func (r testResponder) Hijack() (net.Conn, *bufio.Reader, os.Error) {
 	return testConn{r.t}, bufio.NewReader(&bytes.Buffer{}), nil
 }
 
+func (r testResponder) Responded() bool {
+	return r.t.responded
+}
+
 type testResponseBody struct {
 	t *testTransaction
 }
@@ -101,10 +118,10 @@ func (a testAddr) String() string {
 	return string(a)
 }
 
-// RunHandler runs the handler with a request created from the arguments and
-// returns the response. This function is intended to be used in tests.
-func RunHandler(urlStr string, method string, reqHeader Header, reqBody []byte, handler Handler) (status int, header Header, respBody []byte) {
-	var t testTransaction
+// newTestRequest creates a request and test transaction from the arguments
+// to RunHandler.
+func newTestRequest(urlStr string, method string, reqHeader Header, reqBody []byte) (*Request, *testTransaction) {
+	t := &testTransaction{}
 	if reqBody != nil {
 		t.in.Write(reqBody)
 	}
@@ -122,7 +139,66 @@ func RunHandler(urlStr string, method string, reqHeader Header, reqBody []byte,
 		panic(err)
 	}
 	req.Body = &t.in
-	req.Responder = testResponder{&t}
+	req.Responder = testResponder{t}
+	return req, t
+}
+
+// RunHandler runs the handler with a request created from the arguments and
+// returns the response. This function is intended to be used in tests.
+func RunHandler(urlStr string, method string, reqHeader Header, reqBody []byte, handler Handler) (status int, header Header, respBody []byte) {
+	req, t := newTestRequest(urlStr, method, reqHeader, reqBody)
 	handler.ServeWeb(req)
+	req.Finish()
 	return t.status, t.header, t.out.Bytes()
 }
+
+// TestResponse is the response returned by RunHandlerResponse.
+type TestResponse struct {
+	// Response status or zero if the handler did not respond.
+	Status int
+
+	// Text for the response status.
+	StatusText string
+
+	// Response header.
+	Header Header
+
+	// Response body including all data written or flushed by the handler.
+	// The response body is not encoded with a transfer encoding.
+	Body []byte
+
+	// Error from the handler. The error is set if the handler panics or
+	// calls Respond more than once.
+	Err os.Error
+}
+
+// RunHandlerResponse runs the handler with a request created from the
+// arguments and returns the response. Unlike RunHandler, panics in the
+// handler are recovered and returned in the response Err field. This
+// function is intended to be used in tests.
+func RunHandlerResponse(urlStr string, method string, reqHeader Header, reqBody []byte, handler Handler) *TestResponse {
+	req, t := newTestRequest(urlStr, method, reqHeader, reqBody)
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				switch r := r.(type) {
+				case os.Error:
+					t.err = r
+				case string:
+					t.err = os.NewError(r)
+				default:
+					t.err = os.NewError("twister: handler panic")
+				}
+			}
+		}()
+		defer req.Finish()
+		handler.ServeWeb(req)
+	}()
+	return &TestResponse{
+		Status:     t.status,
+		StatusText: StatusText(t.status),
+		Header:     t.header,
+		Body:       t.out.Bytes(),
+		Err:        t.err,
+	}
+}
@@ -18,6 +18,8 @@ package web
 
 import (
 	"bufio"
+	"encoding/base64"
+	"html"
 	"io"
 	"io/ioutil"
 	"log"
@@ -34,12 +36,15 @@ var (
 	ErrInvalidState          = os.NewError("object in invalid state")
 	ErrBadFormat             = os.NewError("bad data format")
 	ErrRequestEntityTooLarge = os.NewError("HTTP request entity too large")
+	ErrResponseOverflow      = os.NewError("HTTP response body longer than Content-Length")
 )
 
 // Responder represents the response.
 type Responder interface {
 	// Respond commits the status and headers to the network and returns
-	// a writer for the response body.
+	// a writer for the response body. If the writer implements Flusher,
+	// then the handler can call Flush to send buffered data to the client
+	// before the handler returns.
 	Respond(status int, header Header) (responseBody io.Writer)
 
 	// Hijack lets the caller take over the connection from the HTTP server.
@@ -49,6 +54,40 @@ type Responder interface {
 	Hijack() (conn net.Conn, br *bufio.Reader, err os.Error)
 }
 
+// DoneNotifier is implemented by responders that can detect when the client
+// closes the connection. Responders that wrap another responder should
+// implement DoneNotifier by forwarding to the wrapped responder.
+type DoneNotifier interface {
+	// Done returns a channel that is closed when the server detects that the
+	// client closed the connection.
+	Done() <-chan bool
+}
+
+// responderDone returns the Done channel for r or nil if r does not implement
+// DoneNotifier.
+func responderDone(r Responder) <-chan bool {
+	if d, ok := r.(DoneNotifier); ok {
+		return d.Done()
+	}
+	return nil
+}
+
+// RespondedReporter is implemented by responders that report whether the
+// response is started. Responders that wrap another responder should
+// implement RespondedReporter by forwarding to the wrapped responder.
+type RespondedReporter interface {
+	// Responded returns true if Respond or Hijack was called.
+	Responded() bool
+}
+
+// responded returns true if r reports that the response is started.
+func responded(r Responder) bool {
+	if rr, ok := r.(RespondedReporter); ok {
+		return rr.Responded()
+	}
+	return false
+}
+
 // Request represents an HTTP request to the server.
 type Request struct {
 	// The response.
@@ -57,7 +96,8 @@ type Request struct {
 	// Uppercase request method. GET, POST, etc.
 	Method string
 
-	// The request URL with host and scheme set appropriately.
+	// The request URL with host and scheme set appropriately. The URL path is
+	// "*" for the asterisk-form request target in "OPTIONS *" requests.
 	URL *url.URL
 
 	// Protocol version: major version * 1000 + minor version	
@@ -72,10 +112,16 @@ type Request struct {
 	// Request parameters from the query string and post body.
 	Param Values
 
-	// Cookies.
+	// Cookies parsed from the Cookie header. Quotes around values are
+	// removed. Values are otherwise as sent by the client; use CookieValue to
+	// read a value set with Cookie.String. If a cookie name is repeated, then
+	// Cookie.Get returns the first value.
 	Cookie Values
 
-	// Parameters extracted from the request URL by a router.
+	// Parameters extracted from the request URL path by a router. For the
+	// pattern "/posts/<year>/<slug>", the handler reads the captures with
+	// req.URLParam["year"] and req.URLParam["slug"]. A missing name returns
+	// the empty string. Query parameters are in the Param field.
 	URLParam map[string]string
 
 	// Lowercase content type, not including params.
@@ -92,11 +138,33 @@ type Request struct {
 	// length is not known.
 	ContentLength int
 
-	// The request body.
+	// The request body. If the client sent "Expect: 100-continue", then the
+	// server sends the 100 Continue response on the first read of the body. A
+	// handler can reject the request body by responding without reading it.
 	Body io.Reader
 
+	// Trailer headers sent after a chunked request body. The server adds the
+	// trailers declared in the request Trailer header when the application
+	// reads the body to EOF.
+	Trailer Header
+
+	// Trailer headers to send after a chunked response body. To send
+	// trailers, the application sets this field to a header containing the
+	// trailer names before calling Respond and sets the trailer values before
+	// the handler returns. The server adds a Trailer header to the response
+	// listing the names. Alternatively, the application declares the
+	// trailer names in the Trailer header passed to Respond and the server
+	// sets this field to a header containing the declared names. Trailers
+	// are not sent if the response body is not chunked.
+	ResponseTrailer Header
+
 	// Attributes attached to the request by middleware. 
 	Env map[string]interface{}
+
+	finishers []func()
+
+	// Parameters from the query string, parsed on first call to Query.
+	query Values
 }
 
 // ErrorHandler handles request errors.
@@ -127,6 +195,7 @@ func NewRequest(remoteAddr string, method string, u *url.URL, protocolVersion in
 		Param:           make(Values),
 		Header:          header,
 		Cookie:          make(Values),
+		Trailer:         make(Header),
 		Env:             make(map[string]interface{}),
 	}
 
@@ -161,37 +230,191 @@ func (req *Request) Respond(status int, headerKeysAndValues ...string) io.Writer
 	return req.Responder.Respond(status, NewHeader(headerKeysAndValues...))
 }
 
+// Done returns a channel that is closed when the server detects that the
+// client closed the connection. Long running handlers such as long polling
+// and server-sent event handlers can select on the channel to stop work.
+// Done returns nil, a channel that is never ready, if the responder does not
+// implement DoneNotifier.
+//
+//  select {
+//  case msg := <-messages:
+//      ... respond with message
+//  case <-req.Done():
+//      return
+//  }
+func (req *Request) Done() <-chan bool {
+	return responderDone(req.Responder)
+}
+
+// ErrorMessage is an error with a message for the client. The default error
+// handler uses the message as the response body.
+//
+//  req.Error(web.StatusBadRequest, web.ErrorMessage("missing widget id"))
+type ErrorMessage string
+
+func (m ErrorMessage) String() string {
+	return string(m)
+}
+
 func defaultErrorHandler(req *Request, status int, reason os.Error, header Header) {
+	message := StatusText(status)
+	if m, ok := reason.(ErrorMessage); ok && m != "" {
+		message = string(m)
+	}
 	header.Set(HeaderContentType, "text/plain; charset=utf-8")
+	header.Set(HeaderContentLength, strconv.Itoa(len(message)))
 	w := req.Responder.Respond(status, header)
-	io.WriteString(w, StatusText(status))
+	io.WriteString(w, message)
 	if reason != nil || status >= 500 {
 		log.Println("ERROR", req.URL, status, reason)
 	}
 }
 
-// Error responds to the request with an error. 
+// Error responds to the request with an error by calling the request's error
+// handler. The default error handler responds with a plain text body
+// containing the text for the status code or the message from an
+// ErrorMessage reason. If the responder reports that the response is already
+// started, then Error logs the error and returns without calling the error
+// handler.
 func (req *Request) Error(status int, reason os.Error, headerKeysAndValues ...string) {
+	if responded(req.Responder) {
+		log.Println("ERROR", req.URL, status, reason, "(response already started)")
+		return
+	}
 	req.ErrorHandler(req, status, reason, NewHeader(headerKeysAndValues...))
 }
 
-// Redirect responds to the request with a redirect to the specified URL.
+// Redirect responds to the request with a redirect to the specified URL. A
+// relative URL is resolved against the path of the request URL. The response
+// status is 301 if perm is true and 302 otherwise.
 func (req *Request) Redirect(urlStr string, perm bool, headerKeysAndValues ...string) {
 	status := StatusFound
 	if perm {
 		status = StatusMovedPermanently
 	}
 
-	// Make relative path absolute
-	u, err := url.Parse(urlStr)
-	if err != nil && u.Scheme == "" && urlStr[0] != '/' {
-		d, _ := path.Split(req.URL.Path)
-		urlStr = d + urlStr
+	// Make relative path absolute.
+	if u, err := url.Parse(urlStr); err == nil && u.Scheme == "" && u.Host == "" {
+		switch {
+		case urlStr == "" || urlStr[0] == '?' || urlStr[0] == '#':
+			urlStr = req.URL.Path + urlStr
+		case urlStr[0] != '/':
+			d, _ := path.Split(req.URL.Path)
+			urlStr = d + urlStr
+		}
 	}
+	urlStr = cleanHeaderValue(urlStr)
 
 	header := NewHeader(headerKeysAndValues...)
 	header.Set(HeaderLocation, urlStr)
-	req.Responder.Respond(status, header)
+	header.Set(HeaderContentType, "text/html; charset=utf-8")
+	w := req.Responder.Respond(status, header)
+	io.WriteString(w, "<a href=\"")
+	io.WriteString(w, html.EscapeString(urlStr))
+	io.WriteString(w, "\">")
+	io.WriteString(w, StatusText(status))
+	io.WriteString(w, "</a>.\n")
+}
+
+// BasicAuth returns the username and password from the request Authorization
+// header if the header uses the Basic authentication scheme.
+func (req *Request) BasicAuth() (username, password string, ok bool) {
+	s := req.Header.Get(HeaderAuthorization)
+	const scheme = "basic "
+	if len(s) < len(scheme) || strings.ToLower(s[:len(scheme)]) != scheme {
+		return "", "", false
+	}
+	s = strings.TrimSpace(s[len(scheme):])
+	// Tolerate missing padding.
+	for len(s)%4 != 0 {
+		s += "="
+	}
+	p := make([]byte, base64.StdEncoding.DecodedLen(len(s)))
+	n, err := base64.StdEncoding.Decode(p, []byte(s))
+	if err != nil {
+		return "", "", false
+	}
+	credentials := string(p[:n])
+	i := strings.Index(credentials, ":")
+	if i < 0 {
+		return "", "", false
+	}
+	return credentials[:i], credentials[i+1:], true
+}
+
+// BasicAuthChallenge responds to the request with status 401 and a Basic
+// authentication challenge for the given realm.
+func (req *Request) BasicAuthChallenge(realm string) {
+	req.Error(StatusUnauthorized, nil, HeaderWWWAuthenticate, "Basic realm="+QuoteHeaderValue(realm))
+}
+
+// LimitBody limits the size of the request body to n bytes. Reads past the
+// limit return ErrRequestEntityTooLarge. If the request Content-Length is
+// larger than n, then the first read returns the error without reading the
+// body.
+func (req *Request) LimitBody(n int) {
+	b := &limitedBody{r: req.Body, n: n}
+	if req.ContentLength > n {
+		b.err = ErrRequestEntityTooLarge
+	}
+	req.Body = b
+}
+
+type limitedBody struct {
+	r   io.Reader
+	n   int // remaining bytes
+	err os.Error
+}
+
+func (b *limitedBody) Read(p []byte) (int, os.Error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if len(p) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.r.Read(p)
+	if n > b.n {
+		n = b.n
+		err = ErrRequestEntityTooLarge
+	}
+	b.n -= n
+	b.err = err
+	return n, err
+}
+
+// Query returns the parameters parsed from the URL query string. Unlike the
+// Param field, the result does not include parameters from the request body.
+// Malformed percent escapes are copied to the result unchanged. The query
+// string is parsed on the first call and the result is cached.
+func (req *Request) Query() Values {
+	if req.query == nil {
+		req.query = make(Values)
+		if req.URL != nil {
+			req.query.parseFormEncoded([]byte(req.URL.RawQuery), false)
+		}
+	}
+	return req.query
+}
+
+// QueryParam returns the first value for the named query parameter or "" if
+// the parameter is not present.
+func (req *Request) QueryParam(name string) string {
+	return req.Query().Get(name)
+}
+
+// OnFinish registers f to be called when the request is finished.
+func (req *Request) OnFinish(f func()) {
+	req.finishers = append(req.finishers, f)
+}
+
+// Finish calls the functions registered with OnFinish in the reverse order of
+// registration. Protocol adapters call this method after the handler returns.
+func (req *Request) Finish() {
+	for i := len(req.finishers) - 1; i >= 0; i-- {
+		req.finishers[i]()
+	}
+	req.finishers = nil
 }
 
 // BodyBytes returns the request body a slice of bytes. If maxLen is negative,
@@ -0,0 +1,257 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"url"
+)
+
+var limitBodyTests = []struct {
+	body          string
+	contentLength int
+	limit         int
+	out           string
+	err           os.Error
+}{
+	{"Hello", 5, 5, "Hello", nil},
+	{"Hello", -1, 5, "Hello", nil},
+	{"Hello!", -1, 5, "Hello", ErrRequestEntityTooLarge},
+	{"Hello!", 6, 5, "", ErrRequestEntityTooLarge},
+}
+
+func TestLimitBody(t *testing.T) {
+	for _, tt := range limitBodyTests {
+		header := NewHeader()
+		if tt.contentLength >= 0 {
+			header.Set(HeaderContentLength, strconv.Itoa(tt.contentLength))
+		}
+		var (
+			p   []byte
+			err os.Error
+		)
+		RunHandler("/", "POST", header, []byte(tt.body), HandlerFunc(func(req *Request) {
+			req.LimitBody(tt.limit)
+			p, err = ioutil.ReadAll(req.Body)
+			req.Respond(StatusOK)
+		}))
+		if string(p) != tt.out || err != tt.err {
+			t.Errorf("body %q, limit %d: got %q, %v; want %q, %v", tt.body, tt.limit, p, err, tt.out, tt.err)
+		}
+	}
+}
+
+var basicAuthTests = []struct {
+	authorization string
+	username      string
+	password      string
+	ok            bool
+}{
+	{"Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==", "Aladdin", "open sesame", true},
+	{"basic QWxhZGRpbjpvcGVuIHNlc2FtZQ", "Aladdin", "open sesame", true},
+	{"Basic dXNlcjo=", "user", "", true},
+	{"Basic dXNlcg==", "", "", false},
+	{"Basic !!!", "", "", false},
+	{"Digest QWxhZGRpbjpvcGVuIHNlc2FtZQ==", "", "", false},
+	{"", "", "", false},
+}
+
+func TestBasicAuth(t *testing.T) {
+	for _, tt := range basicAuthTests {
+		req, _ := NewRequest("", "GET", &url.URL{}, ProtocolVersion11, NewHeader(HeaderAuthorization, tt.authorization))
+		username, password, ok := req.BasicAuth()
+		if username != tt.username || password != tt.password || ok != tt.ok {
+			t.Errorf("%q: got %q, %q, %v; want %q, %q, %v", tt.authorization, username, password, ok, tt.username, tt.password, tt.ok)
+		}
+	}
+}
+
+func TestBasicAuthChallenge(t *testing.T) {
+	status, header, _ := RunHandler("/", "GET", nil, nil, HandlerFunc(func(req *Request) {
+		req.BasicAuthChallenge("admin")
+	}))
+	if status != StatusUnauthorized || header.Get(HeaderWWWAuthenticate) != `Basic realm="admin"` {
+		t.Errorf("status=%d, WWW-Authenticate=%q", status, header.Get(HeaderWWWAuthenticate))
+	}
+}
+
+var redirectTests = []struct {
+	url      string
+	location string
+	perm     bool
+	status   int
+	want     string
+}{
+	{"/a/b", "c", false, StatusFound, "/a/c"},
+	{"/a/b", "c", true, StatusMovedPermanently, "/a/c"},
+	{"/a/b", "/c", false, StatusFound, "/c"},
+	{"/a/", "c?x=y", false, StatusFound, "/a/c?x=y"},
+	{"/a/b", "?x=y", false, StatusFound, "/a/b?x=y"},
+	{"/a/b", "http://example.com/c", false, StatusFound, "http://example.com/c"},
+	{"/a/b", "/c\r\nSet-Cookie: x=y", false, StatusFound, "/c  Set-Cookie: x=y"},
+}
+
+func TestRedirect(t *testing.T) {
+	for _, tt := range redirectTests {
+		status, header, body := RunHandler(tt.url, "GET", nil, nil, HandlerFunc(func(req *Request) {
+			req.Redirect(tt.location, tt.perm)
+		}))
+		if status != tt.status {
+			t.Errorf("Redirect(%q, %v) from %q status = %d, want %d", tt.location, tt.perm, tt.url, status, tt.status)
+		}
+		if location := header.Get(HeaderLocation); location != tt.want {
+			t.Errorf("Redirect(%q, %v) from %q location = %q, want %q", tt.location, tt.perm, tt.url, location, tt.want)
+		}
+		if !strings.Contains(string(body), "href=") {
+			t.Errorf("Redirect(%q, %v) from %q body = %q, want link", tt.location, tt.perm, tt.url, body)
+		}
+	}
+}
+
+var errorTests = []struct {
+	status int
+	reason os.Error
+	body   string
+}{
+	{StatusNotFound, nil, "Not Found"},
+	{StatusBadRequest, ErrorMessage("bad widget"), "bad widget"},
+	{StatusInternalServerError, os.NewError("internal"), "Internal Server Error"},
+}
+
+func TestError(t *testing.T) {
+	for _, tt := range errorTests {
+		status, header, body := RunHandler("/", "GET", nil, nil, HandlerFunc(func(req *Request) {
+			req.Error(tt.status, tt.reason)
+		}))
+		if status != tt.status || string(body) != tt.body ||
+			header.Get(HeaderContentType) != "text/plain; charset=utf-8" ||
+			header.Get(HeaderContentLength) != strconv.Itoa(len(tt.body)) {
+			t.Errorf("Error(%d, %v) = %d, %v, %q, want %d, %q", tt.status, tt.reason, status, header, body, tt.status, tt.body)
+		}
+	}
+}
+
+type doneResponder struct {
+	Responder
+	done chan bool
+}
+
+func (r doneResponder) Done() <-chan bool {
+	return r.done
+}
+
+func TestRequestDone(t *testing.T) {
+	req, _ := newTestRequest("/", "GET", nil, nil)
+	if req.Done() != nil {
+		t.Errorf("Done() = %v, want nil for responder without Done", req.Done())
+	}
+	done := make(chan bool)
+	req.Responder = doneResponder{req.Responder, done}
+	FilterRespond(req, func(status int, header Header) (int, Header) { return status, header })
+	RecordResponse(req)
+	GzipHandler(SniffHandler(HandlerFunc(func(req *Request) {
+		if req.Done() != done {
+			t.Errorf("Done() through wrappers did not return the responder's channel")
+		}
+	}))).ServeWeb(req)
+}
+
+func TestErrorAfterRespond(t *testing.T) {
+	for _, sniff := range []bool{false, true} {
+		var h Handler = HandlerFunc(func(req *Request) {
+			io.WriteString(req.Respond(StatusOK), "hello")
+			req.Error(StatusInternalServerError, nil)
+		})
+		if sniff {
+			h = SniffHandler(h)
+		}
+		h = GzipHandler(h)
+		resp := RunHandlerResponse("/", "GET", nil, nil, h)
+		if resp.Err != nil || resp.Status != StatusOK || string(resp.Body) != "hello" {
+			t.Errorf("sniff=%v: got %v, %d, %q, want nil, %d, %q", sniff, resp.Err, resp.Status, resp.Body, StatusOK, "hello")
+		}
+	}
+}
+
+var runHandlerResponseTests = []struct {
+	handler func(*Request)
+	status  int
+	body    string
+	ok      bool
+}{
+	{
+		func(req *Request) {
+			w := req.Respond(StatusOK)
+			io.WriteString(w, "Hello")
+			w.(Flusher).Flush()
+			io.WriteString(w, " World")
+		},
+		StatusOK, "Hello World", true,
+	},
+	{
+		func(req *Request) {
+			req.Respond(StatusNotFound)
+			req.Respond(StatusOK)
+		},
+		StatusNotFound, "", false,
+	},
+	{
+		func(req *Request) {
+			panic("boom")
+		},
+		0, "", false,
+	},
+}
+
+func TestRunHandlerResponse(t *testing.T) {
+	for i, tt := range runHandlerResponseTests {
+		resp := RunHandlerResponse("/", "GET", nil, nil, HandlerFunc(tt.handler))
+		if resp.Status != tt.status || string(resp.Body) != tt.body || (resp.Err == nil) != tt.ok {
+			t.Errorf("%d: got %d %q %v, want %d %q ok=%v", i, resp.Status, resp.Body, resp.Err, tt.status, tt.body, tt.ok)
+		}
+		if resp.StatusText != StatusText(tt.status) {
+			t.Errorf("%d: StatusText = %q, want %q", i, resp.StatusText, StatusText(tt.status))
+		}
+	}
+}
+
+var queryTests = []struct {
+	rawQuery string
+	query    Values
+}{
+	{"", Values{}},
+	{"a=b&a=c&d=Hello%20World", Values{"a": []string{"b", "c"}, "d": []string{"Hello World"}}},
+	{"a%3Db=c+d", Values{"a=b": []string{"c d"}}},
+	{"a=100%&b=%zz&c=%4", Values{"a": []string{"100%"}, "b": []string{"%zz"}, "c": []string{"%4"}}},
+}
+
+func TestQuery(t *testing.T) {
+	for _, tt := range queryTests {
+		req := &Request{URL: &url.URL{RawQuery: tt.rawQuery}}
+		query := req.Query()
+		if !reflect.DeepEqual(query, tt.query) {
+			t.Errorf("Query() for %q = %q, want %q", tt.rawQuery, query, tt.query)
+		}
+		if v, want := req.QueryParam("a"), tt.query.Get("a"); v != want {
+			t.Errorf("QueryParam(%q) for %q = %q, want %q", "a", tt.rawQuery, v, want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"github.com/garyburd/twister/web"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"url"
+)
+
+const clientBufferSize = 4096
+
+// Dial opens a WebSocket connection to the server at urlStr using the RFC
+// 6455 protocol. The URL scheme must be "ws" or "wss". If origin is not "",
+// then the Origin header is set to origin. If protocol is not "", then the
+// Sec-WebSocket-Protocol header is set to protocol. The caller is responsible
+// for closing the returned connection.
+func Dial(urlStr string, origin string, protocol string) (*Conn, os.Error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := u.Host
+	var netConn net.Conn
+	switch u.Scheme {
+	case "ws":
+		if !hasPort(addr) {
+			addr += ":80"
+		}
+		netConn, err = net.Dial("tcp", addr)
+	case "wss":
+		if !hasPort(addr) {
+			addr += ":443"
+		}
+		netConn, err = tls.Dial("tcp", addr, nil)
+	default:
+		return nil, os.NewError("twister.websocket: bad scheme " + u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := clientHandshake(netConn, u, origin, protocol)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// hasPort returns true if the host includes a port.
+func hasPort(host string) bool {
+	return strings.LastIndex(host, ":") > strings.LastIndex(host, "]")
+}
+
+// clientHandshake sends the opening handshake on netConn and validates the
+// response from the server.
+func clientHandshake(netConn net.Conn, u *url.URL, origin string, protocol string) (*Conn, os.Error) {
+	p := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, p); err != nil {
+		return nil, err
+	}
+	b := make([]byte, base64.StdEncoding.EncodedLen(len(p)))
+	base64.StdEncoding.Encode(b, p)
+	key := string(b)
+
+	path := u.RawPath
+	if path == "" {
+		path = "/"
+	}
+
+	h := web.NewHeader(
+		web.HeaderHost, u.Host,
+		web.HeaderUpgrade, "websocket",
+		web.HeaderConnection, "Upgrade",
+		headerSecWebSocketKey, key,
+		headerSecWebSocketVersion, "13")
+	if origin != "" {
+		h.Set(web.HeaderOrigin, origin)
+	}
+	if protocol != "" {
+		h.Set(headerSecWebSocketProtocol, protocol)
+	}
+
+	br, err := bufio.NewReaderSize(netConn, clientBufferSize)
+	if err != nil {
+		return nil, err
+	}
+	bw, err := bufio.NewWriterSize(netConn, clientBufferSize)
+	if err != nil {
+		return nil, err
+	}
+
+	bw.WriteString("GET " + path + " HTTP/1.1\r\n")
+	h.WriteHttpHeader(bw)
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if f := strings.Fields(line); len(f) < 2 || f[1] != "101" {
+		return nil, os.NewError("twister.websocket: bad handshake status " + strings.TrimSpace(line))
+	}
+
+	h = make(web.Header)
+	if err := h.ParseHttpHeader(br); err != nil {
+		return nil, err
+	}
+	if strings.ToLower(h.Get(web.HeaderUpgrade)) != "websocket" {
+		return nil, os.NewError("twister.websocket: upgrade header missing or wrong value")
+	}
+	if !h.HasToken(web.HeaderConnection, "upgrade") {
+		return nil, os.NewError("twister.websocket: connection header missing or wrong value")
+	}
+	if h.Get(headerSecWebSocketAccept) != computeAcceptKey(key) {
+		return nil, os.NewError("twister.websocket: bad Sec-WebSocket-Accept value")
+	}
+
+	return &Conn{conn: netConn, br: br, bw: bw, hybi: true, client: true, readBuf: make([]byte, clientBufferSize)}, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"github.com/garyburd/twister/server"
+	"github.com/garyburd/twister/web"
+	"net"
+	"testing"
+)
+
+func TestDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen", err)
+	}
+	defer l.Close()
+	go (&server.Server{Listener: l, Handler: web.HandlerFunc(receiveHandler)}).Serve()
+
+	c, err := Dial("ws://"+l.Addr().String()+"/", "http://example.com", "")
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer c.Close()
+
+	if err := c.WriteMessage([]byte("Hello")); err != nil {
+		t.Fatal("write", err)
+	}
+	messageType, p, err := c.Receive()
+	if err != nil {
+		t.Fatal("receive", err)
+	}
+	if messageType != TextMessage || string(p) != "Hello" {
+		t.Errorf("got %d %q, want %d %q", messageType, p, TextMessage, "Hello")
+	}
+
+	if err := c.WriteBinaryMessage([]byte{0, 1, 2}); err != nil {
+		t.Fatal("write", err)
+	}
+	messageType, p, err = c.Receive()
+	if err != nil {
+		t.Fatal("receive", err)
+	}
+	if messageType != BinaryMessage || string(p) != "\x00\x01\x02" {
+		t.Errorf("got %d %q, want %d %q", messageType, p, BinaryMessage, "\x00\x01\x02")
+	}
+}
+
+func TestDialBadHandshake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen", err)
+	}
+	defer l.Close()
+	h := web.HandlerFunc(func(req *web.Request) {
+		req.Respond(web.StatusNotFound, web.HeaderContentLength, "0")
+	})
+	go (&server.Server{Listener: l, Handler: h}).Serve()
+
+	if _, err := Dial("ws://"+l.Addr().String()+"/", "", ""); err == nil {
+		t.Error("Dial did not return error for 404 response")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen", err)
+	}
+	defer l.Close()
+	go (&server.Server{Listener: l, Handler: web.HandlerFunc(receiveHandler)}).Serve()
+
+	c, err := Dial("ws://"+l.Addr().String()+"/", "", "")
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(1e8)
+	_, _, err = c.Receive()
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Errorf("Receive() returned %v, want timeout error", err)
+	}
+}
@@ -24,6 +24,8 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"url"
 )
 
 const (
@@ -32,17 +34,74 @@ const (
 	headerSecWebSocketProtocol = "Sec-Websocket-Protocol"
 )
 
+// Message types returned by Receive.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+// DefaultMaxMessageSize is the default maximum size of a message returned by
+// Receive.
+const DefaultMaxMessageSize = 1 << 20
+
+// ErrMessageTooLarge is returned by Receive when a message exceeds the
+// maximum message size.
+var ErrMessageTooLarge = os.NewError("twister.websocket: message too large")
+
 type Conn struct {
+	// Maximum size of a message returned by Receive. If zero, then
+	// DefaultMaxMessageSize is used.
+	MaxMessageSize int
+
 	conn    net.Conn
 	br      *bufio.Reader
 	bw      *bufio.Writer
 	hasMore bool
+
+	// True if the connection uses RFC 6455 framing.
+	hybi bool
+
+	// True if the connection was opened with Dial.
+	client bool
+
+	// RFC 6455 read state.
+	readBuf       []byte
+	readRemaining int64   // bytes remaining in current frame
+	readFinal     bool    // true if current frame is the last in the message
+	readMask      [4]byte // mask for current frame
+	readMaskPos   int
+	readOpcode    byte // opcode of first frame in current message
+
+	// The reader writes pong and close frames while the application writes
+	// messages from another goroutine.
+	writeMu   sync.Mutex // protects bw and closeSent
+	closeSent bool       // true if a close frame was sent
 }
 
+// Close closes the connection. If the connection uses RFC 6455 framing and a
+// close frame has not been sent, then Close sends a close frame with status
+// CloseNormalClosure before closing the network connection.
 func (conn *Conn) Close() os.Error {
+	conn.WriteClose(CloseNormalClosure, "")
 	return conn.conn.Close()
 }
 
+// SetReadDeadline sets the timeout in nanoseconds for each read from the
+// underlying network connection. If a read times out, then ReadMessage and
+// Receive return the timeout error from the network connection. A value of
+// zero disables the timeout.
+func (conn *Conn) SetReadDeadline(nsec int64) os.Error {
+	return conn.conn.SetReadTimeout(nsec)
+}
+
+// SetWriteDeadline sets the timeout in nanoseconds for each write to the
+// underlying network connection. If a write times out, then the write method
+// returns the timeout error from the network connection. A value of zero
+// disables the timeout.
+func (conn *Conn) SetWriteDeadline(nsec int64) os.Error {
+	return conn.conn.SetWriteTimeout(nsec)
+}
+
 // ReadMessage reads a message from the client. The message is returned in one
 // or more chunks. hasMore is set to false on the last chunk of the message.
 // If the message fits in the read buffer size specified in the call to
@@ -50,8 +109,9 @@ func (conn *Conn) Close() os.Error {
 // The returned chunk points to the internal state of the connection and is only
 // valid until the next call to ReadMessage.
 func (conn *Conn) ReadMessage() (chunk []byte, hasMore bool, err os.Error) {
-	// Support text framing for now. Revisit after browsers support framing
-	// described in later specs.
+	if conn.hybi {
+		return conn.readHybiMessage()
+	}
 
 	if !conn.hasMore {
 		c, err := conn.br.ReadByte()
@@ -76,11 +136,48 @@ func (conn *Conn) ReadMessage() (chunk []byte, hasMore bool, err os.Error) {
 	return p, conn.hasMore, nil
 }
 
-// WriteMessage write a message to the client. The message cannot contain the
-// bytes with value 0 or 255.
+// Receive reads a complete message from the client. The message type is
+// TextMessage or BinaryMessage. Receive returns ErrMessageTooLarge if the size
+// of the message exceeds conn.MaxMessageSize. Unlike ReadMessage, the returned
+// message is not overwritten by subsequent reads.
+func (conn *Conn) Receive() (messageType int, p []byte, err os.Error) {
+	max := conn.MaxMessageSize
+	if max == 0 {
+		max = DefaultMaxMessageSize
+	}
+	for {
+		chunk, hasMore, err := conn.ReadMessage()
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(p)+len(chunk) > max {
+			conn.WriteClose(CloseMessageTooBig, "")
+			return 0, nil, ErrMessageTooLarge
+		}
+		p = append(p, chunk...)
+		if !hasMore {
+			break
+		}
+	}
+	messageType = TextMessage
+	if conn.hybi && conn.readOpcode == opBinary {
+		messageType = BinaryMessage
+	}
+	if p == nil {
+		p = []byte{}
+	}
+	return messageType, p, nil
+}
+
+// WriteMessage writes a text message to the client. If the connection uses
+// the draft Hixie protocol, then the message cannot contain the bytes with
+// value 0 or 255.
 func (conn *Conn) WriteMessage(p []byte) os.Error {
-	// Support text framing for now. Revisit after browsers support framing
-	// described in later specs.
+	if conn.hybi {
+		return conn.writeFrame(opText, p)
+	}
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
 	conn.bw.WriteByte(0)
 	conn.bw.Write(p)
 	conn.bw.WriteByte(0xff)
@@ -111,8 +208,61 @@ func webSocketKey(req *web.Request, name string) (key []byte, err os.Error) {
 	return key, nil
 }
 
+// webSocketLocation returns the WebSocket URL for a request URL. The scheme is
+// "wss" if the request was received over TLS.
+func webSocketLocation(u *url.URL) string {
+	scheme := "ws://"
+	if u.Scheme == "https" {
+		scheme = "wss://"
+	}
+	path := u.RawPath
+	if path == "" {
+		path = u.Path
+		if path == "" {
+			path = "/"
+		}
+		if u.RawQuery != "" {
+			path += "?" + u.RawQuery
+		}
+	}
+	return scheme + u.Host + path
+}
+
+// hijack takes over the HTTP connection and returns buffered reader and writer
+// for the connection. Data buffered by the server is returned by the reader.
+func hijack(req *web.Request, readBufSize, writeBufSize int) (net.Conn, *bufio.Reader, *bufio.Writer, os.Error) {
+	netConn, br, err := req.Responder.Hijack()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var r io.Reader
+	if br.Buffered() > 0 {
+		buf, _ := br.Peek(br.Buffered())
+		r = io.MultiReader(bytes.NewBuffer(buf), netConn)
+	} else {
+		r = netConn
+	}
+
+	br, err = bufio.NewReaderSize(r, readBufSize)
+	if err != nil {
+		netConn.Close()
+		return nil, nil, nil, err
+	}
+
+	bw, err := bufio.NewWriterSize(netConn, writeBufSize)
+	if err != nil {
+		netConn.Close()
+		return nil, nil, nil, err
+	}
+	return netConn, br, bw, nil
+}
+
 // Upgrade upgrades the HTTP connection to the WebSocket protocol. The 
 // caller is responsible for closing the returned connection.
+//
+// Upgrade uses the RFC 6455 protocol if the request has a
+// Sec-WebSocket-Version header and the draft Hixie-76 protocol otherwise.
 func Upgrade(req *web.Request, readBufSize, writeBufSize int, header web.Header) (conn *Conn, err os.Error) {
 
 	if req.Method != "GET" {
@@ -120,14 +270,7 @@ func Upgrade(req *web.Request, readBufSize, writeBufSize int, header web.Header)
 		return nil, os.NewError("twister.websocket: bad request method")
 	}
 
-	origin := req.Header.Get(web.HeaderOrigin)
-	if origin == "" {
-		req.Respond(web.StatusBadRequest)
-		return nil, os.NewError("twister.websocket: origin missing")
-	}
-
-	connection := strings.ToLower(req.Header.Get(web.HeaderConnection))
-	if connection != "upgrade" {
+	if !req.Header.HasToken(web.HeaderConnection, "upgrade") {
 		req.Respond(web.StatusBadRequest)
 		return nil, os.NewError("twister.websocket: connection header missing or wrong value")
 	}
@@ -138,6 +281,16 @@ func Upgrade(req *web.Request, readBufSize, writeBufSize int, header web.Header)
 		return nil, os.NewError("twister.websocket: upgrade header missing or wrong value")
 	}
 
+	if req.Header.Get(headerSecWebSocketVersion) != "" {
+		return upgradeHybi(req, readBufSize, writeBufSize, header)
+	}
+
+	origin := req.Header.Get(web.HeaderOrigin)
+	if origin == "" {
+		req.Respond(web.StatusBadRequest)
+		return nil, os.NewError("twister.websocket: origin missing")
+	}
+
 	key1, err := webSocketKey(req, headerSecWebSocketKey1)
 	if err != nil {
 		req.Respond(web.StatusBadRequest)
@@ -150,7 +303,7 @@ func Upgrade(req *web.Request, readBufSize, writeBufSize int, header web.Header)
 		return nil, err
 	}
 
-	netConn, br, err := req.Responder.Hijack()
+	netConn, br, bw, err := hijack(req, readBufSize, writeBufSize)
 	if err != nil {
 		return nil, err
 	}
@@ -161,24 +314,6 @@ func Upgrade(req *web.Request, readBufSize, writeBufSize int, header web.Header)
 		}
 	}()
 
-	var r io.Reader
-	if br.Buffered() > 0 {
-		buf, _ := br.Peek(br.Buffered())
-		r = io.MultiReader(bytes.NewBuffer(buf), netConn)
-	} else {
-		r = netConn
-	}
-
-	br, err = bufio.NewReaderSize(r, readBufSize)
-	if err != nil {
-		return nil, err
-	}
-
-	bw, err := bufio.NewWriterSize(netConn, writeBufSize)
-	if err != nil {
-		return nil, err
-	}
-
 	key3 := make([]byte, 8)
 	if _, err := io.ReadFull(br, key3); err != nil {
 		req.Respond(web.StatusBadRequest)
@@ -191,8 +326,7 @@ func Upgrade(req *web.Request, readBufSize, writeBufSize int, header web.Header)
 	hash.Write(key3)
 	response := hash.Sum()
 
-	// TODO: handle tls
-	location := "ws://" + req.URL.Host + req.URL.RawPath
+	location := webSocketLocation(req.URL)
 	protocol := req.Header.Get(headerSecWebSocketProtocol)
 
 	h := make(web.Header)
@@ -223,7 +357,7 @@ func Upgrade(req *web.Request, readBufSize, writeBufSize int, header web.Header)
 		return nil, err
 	}
 
-	conn = &Conn{netConn, br, bw, false}
+	conn = &Conn{conn: netConn, br: br, bw: bw}
 	netConn = nil
 	return conn, nil
 }
@@ -20,6 +20,7 @@ import (
 	"github.com/garyburd/twister/web"
 	"io/ioutil"
 	"testing"
+	"url"
 )
 
 func testHandler(req *web.Request) {
@@ -126,3 +127,24 @@ func TestWebSocket(t *testing.T) {
 		}
 	}
 }
+
+var webSocketLocationTests = []struct {
+	url      string
+	location string
+}{
+	{"http://example.com/chat", "ws://example.com/chat"},
+	{"https://example.com/chat?a=b", "wss://example.com/chat?a=b"},
+	{"https://example.com:8443", "wss://example.com:8443/"},
+}
+
+func TestWebSocketLocation(t *testing.T) {
+	for _, tt := range webSocketLocationTests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if location := webSocketLocation(u); location != tt.location {
+			t.Errorf("webSocketLocation(%q) = %q, want %q", tt.url, location, tt.location)
+		}
+	}
+}
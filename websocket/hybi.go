@@ -0,0 +1,324 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/garyburd/twister/web"
+	"io"
+	"os"
+	"strconv"
+	"utf8"
+)
+
+const (
+	headerSecWebSocketKey     = "Sec-Websocket-Key"
+	headerSecWebSocketVersion = "Sec-Websocket-Version"
+	headerSecWebSocketAccept  = "Sec-Websocket-Accept"
+)
+
+// Frame opcodes defined in RFC 6455.
+const (
+	opContinuation = 0
+	opText         = 1
+	opBinary       = 2
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+const maxControlPayloadSize = 125
+
+var (
+	errBadFrame       = os.NewError("twister.websocket: bad frame")
+	errNotImplemented = os.NewError("twister.websocket: not supported by protocol")
+)
+
+// Close codes defined in RFC 6455 section 7.4.1.
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseUnsupportedData  = 1003
+	CloseNoStatusReceived = 1005
+	CloseMessageTooBig    = 1009
+)
+
+// CloseError is returned by ReadMessage and Receive when the client closes
+// the connection with a close frame.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) String() string {
+	return "twister.websocket: close " + strconv.Itoa(e.Code) + " " + e.Text
+}
+
+// keyGUID is concatenated with the client's key to compute the accept value.
+var keyGUID = []byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
+
+// computeAcceptKey returns the Sec-WebSocket-Accept value for the given key.
+func computeAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write(keyGUID)
+	sum := h.Sum()
+	p := make([]byte, base64.StdEncoding.EncodedLen(len(sum)))
+	base64.StdEncoding.Encode(p, sum)
+	return string(p)
+}
+
+// upgradeHybi completes the RFC 6455 opening handshake.
+func upgradeHybi(req *web.Request, readBufSize, writeBufSize int, header web.Header) (*Conn, os.Error) {
+	if req.Header.Get(headerSecWebSocketVersion) != "13" {
+		req.Respond(web.StatusBadRequest, headerSecWebSocketVersion, "13")
+		return nil, os.NewError("twister.websocket: unsupported version")
+	}
+
+	key := req.Header.Get(headerSecWebSocketKey)
+	if key == "" {
+		req.Respond(web.StatusBadRequest)
+		return nil, os.NewError("twister.websocket: key missing")
+	}
+
+	netConn, br, bw, err := hijack(req, readBufSize, writeBufSize)
+	if err != nil {
+		return nil, err
+	}
+
+	h := make(web.Header)
+	for k, v := range header {
+		h[k] = v
+	}
+	h.Set(web.HeaderUpgrade, "websocket")
+	h.Set(web.HeaderConnection, "Upgrade")
+	h.Set(headerSecWebSocketAccept, computeAcceptKey(key))
+
+	bw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	h.WriteHttpHeader(bw)
+	if err := bw.Flush(); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	return &Conn{conn: netConn, br: br, bw: bw, hybi: true, readBuf: make([]byte, readBufSize)}, nil
+}
+
+// readFrameHeader reads the header of the next frame from the peer and
+// returns the frame opcode.
+func (conn *Conn) readFrameHeader() (opcode byte, err os.Error) {
+	var p [8]byte
+	if _, err := io.ReadFull(conn.br, p[:2]); err != nil {
+		return 0, err
+	}
+
+	final := p[0]&0x80 != 0
+	opcode = p[0] & 0xf
+	if p[0]&0x70 != 0 {
+		// Reserved bits set without a negotiated extension.
+		return 0, errBadFrame
+	}
+
+	// Frames from the client are masked. Frames from the server are not.
+	masked := p[1]&0x80 != 0
+	if masked == conn.client {
+		return 0, errBadFrame
+	}
+
+	n := int64(p[1] & 0x7f)
+	switch n {
+	case 126:
+		if _, err := io.ReadFull(conn.br, p[:2]); err != nil {
+			return 0, err
+		}
+		n = int64(binary.BigEndian.Uint16(p[:2]))
+	case 127:
+		if _, err := io.ReadFull(conn.br, p[:8]); err != nil {
+			return 0, err
+		}
+		n = int64(binary.BigEndian.Uint64(p[:8]))
+		if n < 0 {
+			return 0, errBadFrame
+		}
+	}
+
+	if opcode >= opClose && (!final || n > maxControlPayloadSize) {
+		return 0, errBadFrame
+	}
+
+	if masked {
+		if _, err := io.ReadFull(conn.br, conn.readMask[:]); err != nil {
+			return 0, err
+		}
+	} else {
+		conn.readMask = [4]byte{}
+	}
+	conn.readMaskPos = 0
+	conn.readRemaining = n
+	if opcode < opClose {
+		conn.readFinal = final
+	}
+	return opcode, nil
+}
+
+// readPayload reads and unmasks up to len(p) bytes of the current frame
+// payload.
+func (conn *Conn) readPayload(p []byte) (int, os.Error) {
+	if int64(len(p)) > conn.readRemaining {
+		p = p[:conn.readRemaining]
+	}
+	n, err := io.ReadFull(conn.br, p)
+	for i := 0; i < n; i++ {
+		p[i] ^= conn.readMask[conn.readMaskPos]
+		conn.readMaskPos = (conn.readMaskPos + 1) % 4
+	}
+	conn.readRemaining -= int64(n)
+	return n, err
+}
+
+// readHybiMessage implements ReadMessage for RFC 6455 connections.
+func (conn *Conn) readHybiMessage() ([]byte, bool, os.Error) {
+	for conn.readRemaining == 0 {
+		if conn.hasMore && conn.readFinal {
+			// End of message in a zero length frame.
+			conn.hasMore = false
+			return conn.readBuf[:0], false, nil
+		}
+		opcode, err := conn.readFrameHeader()
+		if err != nil {
+			return nil, false, err
+		}
+		switch opcode {
+		case opText, opBinary:
+			if conn.hasMore {
+				return nil, false, errBadFrame
+			}
+			conn.hasMore = true
+			conn.readOpcode = opcode
+		case opContinuation:
+			if !conn.hasMore {
+				return nil, false, errBadFrame
+			}
+		case opPing, opPong, opClose:
+			var payload [maxControlPayloadSize]byte
+			n, err := conn.readPayload(payload[:])
+			if err != nil {
+				return nil, false, err
+			}
+			switch opcode {
+			case opPing:
+				if err := conn.writeFrame(opPong, payload[:n]); err != nil {
+					return nil, false, err
+				}
+			case opClose:
+				e := &CloseError{Code: CloseNoStatusReceived}
+				if n >= 2 {
+					e.Code = int(binary.BigEndian.Uint16(payload[:2]))
+					e.Text = string(payload[2:n])
+				}
+				conn.writeFrame(opClose, payload[:n])
+				return nil, false, e
+			}
+		default:
+			return nil, false, errBadFrame
+		}
+	}
+
+	n, err := conn.readPayload(conn.readBuf)
+	if err != nil {
+		return nil, false, err
+	}
+	conn.hasMore = conn.readRemaining > 0 || !conn.readFinal
+	return conn.readBuf[:n], conn.hasMore, nil
+}
+
+// writeFrame writes a single frame to the peer. Frames written by a client
+// are masked. Only the first close frame is written.
+func (conn *Conn) writeFrame(opcode byte, p []byte) os.Error {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	if opcode == opClose {
+		if conn.closeSent {
+			return nil
+		}
+		conn.closeSent = true
+	}
+	var maskBit byte
+	if conn.client {
+		maskBit = 0x80
+	}
+	conn.bw.WriteByte(0x80 | opcode)
+	switch {
+	case len(p) < 126:
+		conn.bw.WriteByte(maskBit | byte(len(p)))
+	case len(p) < 65536:
+		var b [3]byte
+		b[0] = maskBit | 126
+		binary.BigEndian.PutUint16(b[1:], uint16(len(p)))
+		conn.bw.Write(b[:])
+	default:
+		var b [9]byte
+		b[0] = maskBit | 127
+		binary.BigEndian.PutUint64(b[1:], uint64(len(p)))
+		conn.bw.Write(b[:])
+	}
+	if conn.client {
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		conn.bw.Write(mask[:])
+		for i, b := range p {
+			conn.bw.WriteByte(b ^ mask[i%4])
+		}
+	} else {
+		conn.bw.Write(p)
+	}
+	return conn.bw.Flush()
+}
+
+// WriteClose sends a close frame with the given status code and reason to
+// the client. The reason is truncated to fit in a control frame.
+// WriteClose does not close the underlying network connection. WriteClose
+// does nothing for connections using the draft Hixie protocol.
+func (conn *Conn) WriteClose(code int, reason string) os.Error {
+	if !conn.hybi {
+		return nil
+	}
+	if n := maxControlPayloadSize - 2; len(reason) > n {
+		// Do not split a UTF-8 encoded character.
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	p := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(p, uint16(code))
+	copy(p[2:], reason)
+	return conn.writeFrame(opClose, p)
+}
+
+// WriteBinaryMessage writes a binary message to the client. Binary messages
+// are not supported by the draft Hixie protocol.
+func (conn *Conn) WriteBinaryMessage(p []byte) os.Error {
+	if !conn.hybi {
+		return errNotImplemented
+	}
+	return conn.writeFrame(opBinary, p)
+}
@@ -0,0 +1,275 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func hybiHeader(version string) web.Header {
+	return web.NewHeader(
+		"Connection", "keep-alive, Upgrade",
+		"Host", "localhost:8080",
+		"Upgrade", "websocket",
+		"Sec-Websocket-Version", version,
+		"Sec-Websocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+}
+
+var hybiTests = []struct {
+	header web.Header
+	in     string
+	out    string
+	fail   bool
+}{
+	{header: hybiHeader("8"), fail: true},
+	{
+		// Masked text message from RFC 6455 section 5.7.
+		header: hybiHeader("13"),
+		in:     "\x81\x85\x37\xfa\x21\x3d\x7f\x9f\x4d\x51\x58",
+		out:    "\x81\x05Hello\x88\x02\x03\xe8",
+	},
+	{
+		// Fragmented message with ping between fragments.
+		header: hybiHeader("13"),
+		in:     "\x01\x83\x00\x00\x00\x00Hel\x89\x80\x00\x00\x00\x00\x80\x82\x00\x00\x00\x00lo",
+		out:    "\x8a\x00\x81\x05Hello\x88\x02\x03\xe8",
+	},
+	{
+		// Message longer than read buffer followed by close.
+		header: hybiHeader("13"),
+		in:     "\x81\x8a\x00\x00\x00\x000123456789\x88\x80\x00\x00\x00\x00",
+		out:    "\x81\x0a0123456789\x88\x00",
+	},
+	{
+		// Close frame with status code and reason is echoed.
+		header: hybiHeader("13"),
+		in:     "\x88\x84\x00\x00\x00\x00\x03\xe9ab",
+		out:    "\x88\x04\x03\xe9ab",
+	},
+	{
+		// Unmasked frame.
+		header: hybiHeader("13"),
+		in:     "\x81\x05Hello",
+		out:    "\x88\x02\x03\xe8",
+	},
+}
+
+func TestHybi(t *testing.T) {
+	for _, tt := range hybiTests {
+		status, header, out := web.RunHandler("http://example.com/", "GET", tt.header, []byte(tt.in), web.HandlerFunc(testHandler))
+
+		fail := status >= 400
+		if fail != tt.fail {
+			t.Errorf("%q, fail=%v, want %v; status %d", tt.in, fail, tt.fail, status)
+			continue
+		}
+
+		if tt.fail {
+			if v := header.Get(headerSecWebSocketVersion); v != "13" {
+				t.Errorf("%q, version=%q, want 13", tt.in, v)
+			}
+			continue
+		}
+
+		br := bufio.NewReader(bytes.NewBuffer(out))
+		line, _ := br.ReadString('\n')
+		if line != "HTTP/1.1 101 Switching Protocols\r\n" {
+			t.Errorf("%q, status line=%q", tt.in, line)
+			continue
+		}
+		respHeader := make(web.Header)
+		if err := respHeader.ParseHttpHeader(br); err != nil {
+			t.Errorf("%q, header parse error %v", tt.in, err)
+			continue
+		}
+		if v := respHeader.Get(headerSecWebSocketAccept); v != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+			t.Errorf("%q, accept=%q", tt.in, v)
+		}
+		out, _ = ioutil.ReadAll(br)
+		if string(out) != tt.out {
+			t.Errorf("%q, got %q, want %q", tt.in, out, tt.out)
+		}
+	}
+}
+
+func receiveHandler(req *web.Request) {
+	c, err := Upgrade(req, 4, 1024, nil)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	c.MaxMessageSize = 8
+	for {
+		messageType, p, err := c.Receive()
+		if err != nil {
+			return
+		}
+		if messageType == BinaryMessage {
+			err = c.WriteBinaryMessage(p)
+		} else {
+			err = c.WriteMessage(p)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+var receiveTests = []struct {
+	in  string
+	out string
+}{
+	{
+		// Fragmented binary message with ping between fragments.
+		in:  "\x02\x83\x00\x00\x00\x00abc\x89\x81\x00\x00\x00\x00p\x80\x83\x00\x00\x00\x00def",
+		out: "\x8a\x01p\x82\x06abcdef\x88\x02\x03\xe8",
+	},
+	{
+		// Empty message.
+		in:  "\x81\x80\x00\x00\x00\x00",
+		out: "\x81\x00\x88\x02\x03\xe8",
+	},
+	{
+		// Message too large.
+		in:  "\x01\x85\x00\x00\x00\x0001234\x80\x85\x00\x00\x00\x0056789",
+		out: "\x88\x02\x03\xf1",
+	},
+}
+
+func TestReceive(t *testing.T) {
+	for _, tt := range receiveTests {
+		_, _, out := web.RunHandler("http://example.com/", "GET", hybiHeader("13"), []byte(tt.in), web.HandlerFunc(receiveHandler))
+		br := bufio.NewReader(bytes.NewBuffer(out))
+		br.ReadString('\n')
+		if err := make(web.Header).ParseHttpHeader(br); err != nil {
+			t.Errorf("%q, header parse error %v", tt.in, err)
+			continue
+		}
+		out, _ = ioutil.ReadAll(br)
+		if string(out) != tt.out {
+			t.Errorf("%q, got %q, want %q", tt.in, out, tt.out)
+		}
+	}
+}
+
+func TestCloseError(t *testing.T) {
+	var err os.Error
+	handler := func(req *web.Request) {
+		c, e := Upgrade(req, 16, 1024, nil)
+		if e != nil {
+			err = e
+			return
+		}
+		defer c.Close()
+		_, _, err = c.Receive()
+	}
+	web.RunHandler("http://example.com/", "GET", hybiHeader("13"), []byte("\x88\x84\x00\x00\x00\x00\x03\xe9ab"), web.HandlerFunc(handler))
+	e, ok := err.(*CloseError)
+	if !ok {
+		t.Fatalf("err = %v, want *CloseError", err)
+	}
+	if e.Code != CloseGoingAway || e.Text != "ab" {
+		t.Errorf("err = %+v, want code %d, text %q", e, CloseGoingAway, "ab")
+	}
+}
+
+var writeCloseTests = []struct {
+	reason string
+	out    string
+}{
+	{"ab", "\x88\x04\x03\xe8ab"},
+	{strings.Repeat("x", 200), "\x88\x7d\x03\xe8" + strings.Repeat("x", 123)},
+	{strings.Repeat("x", 122) + "\u00e9", "\x88\x7c\x03\xe8" + strings.Repeat("x", 122)},
+}
+
+func TestWriteClose(t *testing.T) {
+	for _, tt := range writeCloseTests {
+		handler := func(req *web.Request) {
+			c, err := Upgrade(req, 16, 1024, nil)
+			if err != nil {
+				return
+			}
+			c.WriteClose(CloseNormalClosure, tt.reason)
+			c.Close()
+		}
+		_, _, out := web.RunHandler("http://example.com/", "GET", hybiHeader("13"), nil, web.HandlerFunc(handler))
+		br := bufio.NewReader(bytes.NewBuffer(out))
+		br.ReadString('\n')
+		if err := make(web.Header).ParseHttpHeader(br); err != nil {
+			t.Errorf("%q, header parse error %v", tt.reason, err)
+			continue
+		}
+		out, _ = ioutil.ReadAll(br)
+		if string(out) != tt.out {
+			t.Errorf("%q, got %q, want %q", tt.reason, out, tt.out)
+		}
+	}
+}
+
+func TestConcurrentWrite(t *testing.T) {
+	const n = 100
+	handler := func(req *web.Request) {
+		c, err := Upgrade(req, 16, 1024, nil)
+		if err != nil {
+			return
+		}
+		done := make(chan bool)
+		go func() {
+			for i := 0; i < n; i++ {
+				c.WriteMessage([]byte("abc"))
+			}
+			done <- true
+		}()
+		for {
+			if _, _, err := c.Receive(); err != nil {
+				break
+			}
+		}
+		<-done
+		c.Close()
+	}
+	in := strings.Repeat("\x89\x80\x00\x00\x00\x00", n) + "\x88\x80\x00\x00\x00\x00"
+	_, _, out := web.RunHandler("http://example.com/", "GET", hybiHeader("13"), []byte(in), web.HandlerFunc(handler))
+	br := bufio.NewReader(bytes.NewBuffer(out))
+	br.ReadString('\n')
+	if err := make(web.Header).ParseHttpHeader(br); err != nil {
+		t.Fatalf("header parse error %v", err)
+	}
+	out, _ = ioutil.ReadAll(br)
+	counts := make(map[string]int)
+	for len(out) > 0 {
+		var frame string
+		for _, f := range []string{"\x81\x03abc", "\x8a\x00", "\x88\x00"} {
+			if strings.HasPrefix(string(out), f) {
+				frame = f
+				break
+			}
+		}
+		if frame == "" {
+			t.Fatalf("bad frame at %q", out)
+		}
+		counts[frame]++
+		out = out[len(frame):]
+	}
+	if counts["\x81\x03abc"] != n || counts["\x8a\x00"] != n || counts["\x88\x00"] != 1 {
+		t.Errorf("frame counts = %v, want %d messages, %d pongs and 1 close", counts, n, n)
+	}
+}